@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hevela/statements/config"
+	"github.com/hevela/statements/internal/app"
+	"github.com/hevela/statements/internal/usecase"
+)
+
+const usage = `Manages the emails that couldn't be delivered (dead letters) and the suppression list. The ledger is
+locked while the service runs, the commands then go through the admin endpoints of its webhook, which needs an addr
+and statusToken in the config.
+
+Usage:
+  admin list [-class class]
+  admin inspect id
+  admin replay [-class class | -all] [id...]
+  admin discard [-class class | -all] [id...]
+  admin suppressions
+  admin suppress [-reason reason] [-detail detail] email...
+  admin unsuppress email...
+
+Replayed emails go back to the outbox and are sent by the next dispatch of the service. Classes are like
+sendgrid-400, smtp-550, permanent or temporary, as shown by list.
+
+The statements of suppressed addresses are not emailed, they're written to suppressedDir or reported in
+reportsDir. Bounces, spam reports and unsubscribes reported by the webhook suppress their address.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command, args := os.Args[1], os.Args[2:]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	var run func(cfg *config.Config, args []string) error
+	switch command {
+	case "list":
+		class := flags.String("class", "", "Only the dead letters of this class")
+		run = func(cfg *config.Config, args []string) error {
+			if len(args) > 0 {
+				logrus.Fatal("list takes no ids, see inspect")
+			}
+			return app.ListDeadLetters(cfg, *class, os.Stdout)
+		}
+	case "inspect":
+		run = func(cfg *config.Config, args []string) error {
+			ids, err := parseIDs(args)
+			if err != nil {
+				return err
+			}
+			if len(ids) != 1 {
+				logrus.Fatal("inspect takes the id of a dead letter")
+			}
+			return app.InspectDeadLetter(cfg, ids[0], os.Stdout)
+		}
+	case "replay", "discard":
+		class := flags.String("class", "", "Only the dead letters of this class")
+		all := flags.Bool("all", false, "Every dead letter, when there are no ids or class")
+		run = func(cfg *config.Config, args []string) error {
+			return applyDeadLetters(cfg, command, args, *class, *all)
+		}
+	case "suppressions":
+		run = func(cfg *config.Config, args []string) error {
+			if len(args) > 0 {
+				logrus.Fatal("suppressions takes no addresses")
+			}
+			return app.ListSuppressions(cfg, os.Stdout)
+		}
+	case "suppress":
+		reason := flags.String("reason", usecase.SuppressedManual, "Why the addresses are suppressed")
+		detail := flags.String("detail", "", "More about the reason, e.g. the ticket that asked for it")
+		run = func(cfg *config.Config, emails []string) error {
+			return applyEmails(command, emails, func(emails []string) (int, error) {
+				return app.SuppressEmails(cfg, *reason, *detail, emails)
+			})
+		}
+	case "unsuppress":
+		run = func(cfg *config.Config, emails []string) error {
+			return applyEmails(command, emails, func(emails []string) (int, error) {
+				return app.UnsuppressEmails(cfg, emails)
+			})
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := flags.Parse(args); err != nil {
+		logrus.Fatal(err)
+	}
+	// flags are parsed until the first id or address, the ones after it would be taken as ids
+	for _, arg := range flags.Args() {
+		if strings.HasPrefix(arg, "-") {
+			logrus.Fatalf("%s: flag %s after the ids or addresses, flags go first", command, arg)
+		}
+	}
+
+	cfg := config.GetConfig()
+	if cfg == nil {
+		logrus.Fatal("Unable to get config")
+	}
+	if err := run(cfg, flags.Args()); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// applyDeadLetters replays or discards the dead letters of the ids, of the class or every one with all
+func applyDeadLetters(cfg *config.Config, command string, args []string, class string, all bool) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 && class == "" && !all {
+		logrus.Fatalf("%s takes ids, -class or -all", command)
+	}
+	if len(ids) > 0 && class != "" {
+		logrus.Fatalf("%s takes ids or -class, not both", command)
+	}
+	action := app.ReplayDeadLetters
+	if command == "discard" {
+		action = app.DiscardDeadLetters
+	}
+	n, err := action(cfg, class, ids)
+	if n > 0 || err == nil {
+		logrus.Infof("%s: %d dead letters", command, n)
+	}
+	return err
+}
+
+// applyEmails suppresses or unsuppresses the addresses
+func applyEmails(command string, emails []string, action func([]string) (int, error)) error {
+	if len(emails) == 0 {
+		logrus.Fatalf("%s takes the email addresses", command)
+	}
+	n, err := action(emails)
+	if n > 0 || err == nil {
+		logrus.Infof("%s: %d addresses", command, n)
+	}
+	return err
+}
+
+func parseIDs(args []string) ([]uint64, error) {
+	ids := make([]uint64, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dead letter id %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
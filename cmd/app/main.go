@@ -19,12 +19,20 @@ func main() {
 		return
 	}
 	sampleconfig := flag.Bool("sampleconfig", false, "Outputs a sample config to standard out")
+	preview := flag.String("preview", "", "Renders the email of a statement file without sending it")
+	previewDir := flag.String("previewDir", ".", "Directory the bodies rendered by -preview are written to")
 	flag.Parse()
 
 	if *sampleconfig {
 		fmt.Println(config.SampleConfig())
 		return
 	}
+	if *preview != "" {
+		if err := app.Preview(cfg, *preview, *previewDir); err != nil {
+			logrus.Error(err)
+		}
+		return
+	}
 	app.Run(cfg)
 }
 
@@ -8,11 +8,138 @@ import (
 )
 
 type Config struct {
-	Interval       string
-	StartAt        string
-	FilesDir       string
+	Interval string
+	StartAt  string
+	FilesDir string
+	// ArchiveDir and QuarantineDir are where processed and rejected statements of FilesDir are moved to
+	ArchiveDir    string
+	QuarantineDir string
+	// Transport is how the emails are delivered: sendgrid (default) or smtp
+	Transport      string
 	SendGridAPIKey string
 	TemplateID     string
+	// SendGridRateLimit is the number of requests per second sent to sendgrid, SendGridBurst how many of them can go
+	// at once, and SendGridMaxInFlight the number of requests at a time
+	SendGridRateLimit   float64
+	SendGridBurst       int
+	SendGridMaxInFlight int
+	SMTP                SMTPConfig
+	// EmailSubject, HTMLTemplate and TextTemplate are the handlebars templates the emails are rendered from when
+	// they are not rendered by sendgrid
+	EmailSubject string
+	HTMLTemplate string
+	TextTemplate string
+	Rounding     string
+	// ReportingCurrency is the currency statement totals are converted to using the rates in FXRatesFile
+	ReportingCurrency string
+	FXRatesFile       string
+	// BalanceFile keeps the closing balance of each account for the next statement
+	BalanceFile string
+	// LedgerFile records the statements processed and their state, so none is sent twice
+	LedgerFile string
+	// DispatchInterval is how often the outbox of the ledger is drained
+	DispatchInterval string
+	// BatchSize is the number of emails of the outbox sent in a request
+	BatchSize int
+	// ReportsDir is where the validation reports of the statements with invalid rows are written
+	ReportsDir string
+	// SuppressedDir is where the statements of suppressed recipients are written to deliver them by other means
+	SuppressedDir string
+	// AttachPDF attaches the statement document to the emails, PDFDir keeps a copy of it
+	AttachPDF   bool
+	PDFDir      string
+	PDFPassword PDFPasswordConfig
+	// CustomersFile has the profiles of the customers: the fields of the PDF passwords and the CC addresses
+	CustomersFile string
+	Sender        SenderConfig
+	Webhook       WebhookConfig
+	CSV           CSVConfig
+	Validation    ValidationConfig
+	Sources       []SourceConfig
+}
+
+// SMTPConfig describes the SMTP server the emails are sent to when the transport is smtp
+type SMTPConfig struct {
+	Host string
+	Port int
+	// Auth is the authentication mechanism, plain or login. No authentication without Username
+	Auth     string
+	Username string
+	Password string
+	From     string
+	// PoolSize is the number of idle connections kept open
+	PoolSize int
+	// Timeout bounds connecting to the server and then each email, e.g. "1m"
+	Timeout string
+	// Insecure allows sending the emails to servers without STARTTLS
+	Insecure bool
+}
+
+// PDFPasswordConfig tells how the PDF statements are encrypted, with a password from the customer profiles
+type PDFPasswordConfig struct {
+	Encrypt bool
+	// Field is account-number or birth-date
+	Field  string
+	Digits int
+	Hint   string
+}
+
+// SenderConfig is who the emails are sent from, the fields set in the sender of a source override the default ones
+type SenderConfig struct {
+	Email       string
+	Name        string
+	ReplyTo     string
+	ReplyToName string
+	// BCC get a blind copy of every email
+	BCC []string
+}
+
+// WebhookConfig is the HTTP server that receives the events of the sendgrid Event Webhook and answers the delivery
+// status of the statements
+type WebhookConfig struct {
+	// Addr is the address the server listens on, e.g. :8080. There's no server when it's empty
+	Addr string
+	// VerificationKey is the public key that signs the events, as given by sendgrid
+	VerificationKey string
+	// StatusToken is the bearer token of the delivery status and admin endpoints, required with an Addr
+	StatusToken string
+}
+
+// SourceConfig describes an additional directory statements are read from
+type SourceConfig struct {
+	Name          string
+	Dir           string
+	ArchiveDir    string
+	QuarantineDir string
+	CSV           CSVConfig
+	Validation    ValidationConfig
+	Sender        SenderConfig
+}
+
+// ValidationConfig tells what to do with the statements of a source that have invalid rows
+type ValidationConfig struct {
+	// Action is reject, skip or accept
+	Action     string
+	MaxSkipped int
+}
+
+// CSVConfig describes the layout of the CSV statements of a source. Columns are given by the name they
+// have in the header or by zero-based index
+type CSVConfig struct {
+	Delimiter   string
+	Quote       string
+	NoHeader    bool
+	ID          string
+	Date        string
+	Amount      string
+	Description string
+	Currency    string
+	DateLayout  string
+	// OpeningLabel and ClosingLabel are the IDs of the rows with the opening and closing balances
+	OpeningLabel string
+	ClosingLabel string
+	// TrailerLabel is the ID of the row with the record count and the control sum
+	TrailerLabel string
 }
 
 const configfile = "config/config.cfg"
@@ -24,10 +151,140 @@ interval = "24h"
 startAt = "12:00AM"
 # Directory containing the statement CSV files, relative to the root of the project
 filesDir = "statements"
+# Directories processed statements (in YYYY/MM subdirectories) and rejected statements are moved to, relative to
+# the root of the project. archive and quarantine inside filesDir when empty
+archiveDir = ""
+quarantineDir = ""
+# How the emails are delivered: "sendgrid" with a dynamic template, or "smtp" rendering the template locally
+transport = "sendgrid"
 # API key to be able to send emails
 sendGridAPIKey = "add your sendgrid API key"
-# the sendgrid dynamic template ID to use for mailing
+# the sendgrid dynamic template ID to use for mailing. When empty the emails are rendered locally
 templateID = "dynamic template ID"
+# Requests per second sent to sendgrid, and how many of them can go at once. The rate goes down while sendgrid answers
+# 429 or its rate limit headers say there are few requests left. 0 doesn't limit the rate
+sendGridRateLimit = 0
+sendGridBurst = 0
+# Number of requests to sendgrid at a time, the outbox sends as many emails or batches at once. 0 or 1 sends one at a time
+sendGridMaxInFlight = 1
+# Handlebars templates of the subject and the bodies of the emails rendered locally (smtp, sendgrid without
+# templateID and -preview). Relative to the root of the project, the plain text body is optional
+emailSubject = "Your account statement for {{first_month_year}} to {{last_month_year}}"
+htmlTemplate = "emailTemplate.html"
+textTemplate = "emailTemplate.txt"
+# How amounts with more decimals than their currency and averages are rounded: half-even, half-up, half-down, up or down
+rounding = "half-even"
+# Currency the totals are reported in, transactions without currency are assumed to be in it. Statements in other
+# currencies need the rates of fxRatesFile. Empty reports the totals in the currency of the statement
+reportingCurrency = ""
+# CSV file with the exchange rates (date,from,to,rate) used to convert foreign currency transactions, relative to the root of the project
+fxRatesFile = ""
+# File where the closing balance of each account is kept, statements without balances start from it. Relative to the root of the project
+balanceFile = "data/balances.json"
+# Database that records the state of every statement, statements already sent are not sent again. Relative to the root of the project
+# It also holds the outbox of the emails waiting to be delivered and the suppression list, without it emails are sent
+# as statements are read, to every address
+ledgerFile = "data/ledger.db"
+# How often the emails waiting in the outbox are delivered, failed deliveries are retried with an increasing delay
+dispatchInterval = "1m"
+# Number of emails of the outbox sent together in a request to sendgrid (up to 1000 recipients), 0 or 1 sends them one by one.
+# Only emails with a dynamic template and without attachments are batched
+batchSize = 0
+# Directory where a JSON report is written for every statement with rows that can't be read. Relative to the root of the project
+reportsDir = "data/reports"
+# Directory where the statements of the recipients in the suppression list are written (the data as JSON and the PDF)
+# to deliver them by other means, e.g. by post. Without it they're only reported in reportsDir. Relative to the root of the project
+# It needs the ledgerFile
+suppressedDir = ""
+# Attach a PDF with the summary and every transaction of the statement to the emails
+attachPDF = false
+# Directory where a copy of the PDF of every statement is kept, in a directory per recipient. Relative to the root of the project
+pdfDir = ""
+# JSON file with the profile of every customer by email, relative to the root of the project. cc get a copy of the
+# emails of the customer, e.g. the joint holders of the account:
+# {"user@mail.com": {"account_number": "0123456789", "birth_date": "1990-01-31", "cc": ["joint@mail.com"]}}
+customersFile = ""
+
+# Who the emails are sent from, the smtp from address when it's empty. The service doesn't start without it with
+# sendgrid. replyTo and replyToName are optional, bcc get a blind copy of every email, e.g. for compliance.
+# [sources.sender] overrides the fields it sets for a source
+# [sender]
+# email = "statements@example.com"
+# name = "Account statements"
+# replyTo = ""
+# replyToName = ""
+# bcc = []
+
+# HTTP server of the sendgrid Event Webhook, POST /sendgrid/events records the delivery, bounces and opens of the
+# emails of the statements. verificationKey is the key of the signed webhook in the mail settings of sendgrid, events
+# without a valid signature are rejected. GET /deliveries?email= answers the delivery status of the statements of a
+# customer, with the statusToken as bearer token, as do the /admin/ endpoints the admin command uses while the service
+# runs. It needs the ledger and the statusToken
+# [webhook]
+# addr = ":8080"
+# verificationKey = "MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE..."
+# statusToken = "secret"
+
+# SMTP server the emails are sent to when transport is "smtp". Connections are upgraded with STARTTLS, servers
+# without it are refused unless insecure is set. auth is "plain" or "login", credentials are only sent over TLS
+# [smtp]
+# host = "smtp.example.com"
+# port = 587
+# auth = "plain"
+# username = "statements"
+# password = "secret"
+# from = "Statements <statements@example.com>"
+# poolSize = 2
+# How long connecting to the server, and then sending each email, may take
+# timeout = "1m"
+# insecure = false
+
+# Encrypt the PDF statements with AES-256. The password of every customer comes from their profile in
+# customersFile: field is "account-number" (its last digits when digits is set) or "birth-date" (DDMMYYYY). The
+# email tells the hint, a description of the field when it's empty. Statements of customers without a password are
+# not sent
+# [pdfPassword]
+# encrypt = true
+# field = "account-number"
+# digits = 4
+# hint = ""
+
+# What to do with statements in filesDir with rows that can't be read: "reject" the statement, "skip" up to
+# maxSkipped invalid rows or "accept" it leaving out the invalid rows. Statements are rejected by default
+# [validation]
+# action = "skip"
+# maxSkipped = 5
+
+# Layout of the CSV statements in filesDir. Columns are given by header name or by zero-based index,
+# only date and amount are required. Remove the section to use the ID,Date,Transaction layout
+# [csv]
+# delimiter = ";"
+# quote = "'"
+# noHeader = false
+# id = "Reference"
+# date = "Booking date"
+# amount = "Amount"
+# description = "Concept"
+# currency = "Currency"
+# dateLayout = "02/01/2006"
+# openingLabel = "OPENING"
+# closingLabel = "CLOSING"
+# trailerLabel = "TRAILER"
+
+# Additional sources to read statements from, each one with a unique name and optionally its CSV layout
+# [[sources]]
+# name = "partner-bank"
+# dir = "statements/partner-bank"
+# archiveDir = "archive/partner-bank"
+# quarantineDir = "quarantine/partner-bank"
+# [sources.csv]
+# date = "1"
+# amount = "3"
+# [sources.validation]
+# action = "reject"
+# [sources.sender]
+# email = "statements@partner-bank.com"
+# name = "Partner Bank"
 `
 
 func SampleConfig() string {
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hevela/statements/config"
+	"github.com/hevela/statements/internal/usecase"
+)
+
+// adminTimeout is how long the admin commands wait for the service
+const adminTimeout = 10 * time.Second
+
+// ledgerAdmin manages the dead letters and the suppression list, in the ledger file or through the service when it
+// has the ledger open
+type ledgerAdmin interface {
+	DeadLetters(class string) ([]usecase.DeadLetter, error)
+	DeadLetter(id uint64) (usecase.DeadLetter, error)
+	Replay(id uint64) error
+	Discard(id uint64) error
+	Suppressions() ([]usecase.Suppression, error)
+	Suppress(email, reason, detail string) error
+	Unsuppress(email string) error
+	Close() error
+}
+
+// openAdmin opens the ledger of the config, relative to the working directory, read-only when nothing is changed.
+// While the service runs the ledger is locked, the admin endpoints of its webhook are used instead
+func openAdmin(cfg *config.Config, readOnly bool) (ledgerAdmin, error) {
+	if cfg.LedgerFile == "" {
+		return nil, errors.New("there's no ledgerFile in the config, dead letters and the suppression list are kept in the ledger")
+	}
+	p, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	open := usecase.OpenLedger
+	if readOnly {
+		open = usecase.OpenLedgerReadOnly
+	}
+	ledger, err := open(path.Join(p, cfg.LedgerFile))
+	if errors.Is(err, usecase.ErrLedgerInUse) {
+		if cfg.Webhook.Addr == "" {
+			return nil, fmt.Errorf("%w, stop the service or set its webhook addr to manage the ledger through it", err)
+		}
+		return newServiceAdmin(cfg.Webhook)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ledger, nil
+}
+
+// serviceAdmin manages the ledger through the admin endpoints of the service
+type serviceAdmin struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// newServiceAdmin returns the admin of the service listening on the webhook address, on this host
+func newServiceAdmin(cfg config.WebhookConfig) (*serviceAdmin, error) {
+	host, port, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("webhook addr: %w", err)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return &serviceAdmin{
+		url:    "http://" + net.JoinHostPort(host, port) + "/admin/",
+		token:  cfg.StatusToken,
+		client: &http.Client{Timeout: adminTimeout},
+	}, nil
+}
+
+func (s *serviceAdmin) DeadLetters(class string) ([]usecase.DeadLetter, error) {
+	var letters []usecase.DeadLetter
+	err := s.do(http.MethodGet, "deadletters?class="+url.QueryEscape(class), nil, &letters)
+	return letters, err
+}
+
+func (s *serviceAdmin) DeadLetter(id uint64) (usecase.DeadLetter, error) {
+	var letter usecase.DeadLetter
+	err := s.do(http.MethodGet, "deadletters/"+strconv.FormatUint(id, 10), nil, &letter)
+	return letter, err
+}
+
+func (s *serviceAdmin) Replay(id uint64) error {
+	return s.do(http.MethodPost, "deadletters/"+strconv.FormatUint(id, 10)+"/replay", nil, nil)
+}
+
+func (s *serviceAdmin) Discard(id uint64) error {
+	return s.do(http.MethodPost, "deadletters/"+strconv.FormatUint(id, 10)+"/discard", nil, nil)
+}
+
+func (s *serviceAdmin) Suppressions() ([]usecase.Suppression, error) {
+	var suppressions []usecase.Suppression
+	err := s.do(http.MethodGet, "suppressions", nil, &suppressions)
+	return suppressions, err
+}
+
+func (s *serviceAdmin) Suppress(email, reason, detail string) error {
+	body := map[string]string{"reason": reason, "detail": detail}
+	return s.do(http.MethodPut, "suppressions/"+url.PathEscape(email), body, nil)
+}
+
+func (s *serviceAdmin) Unsuppress(email string) error {
+	return s.do(http.MethodDelete, "suppressions/"+url.PathEscape(email), nil, nil)
+}
+
+func (s *serviceAdmin) Close() error {
+	return nil
+}
+
+// do sends a request to the admin endpoints, body and out are JSON. The errors of the service are returned as they
+// were answered
+func (s *serviceAdmin) do(method, endpoint string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, s.url+endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("service: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		return fmt.Errorf("service: %s", strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -2,13 +2,19 @@ package app
 
 import (
 	"context"
+	"fmt"
 	"github.com/hevela/statements/config"
 	"github.com/hevela/statements/internal/usecase"
 	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
+	"time"
 )
 
 func Run(cfg *config.Config) {
@@ -17,15 +23,85 @@ func Run(cfg *config.Config) {
 	if err != nil {
 		log.Println(err)
 	}
-	p = path.Join(p, cfg.FilesDir)
-	clc := usecase.NewCalculator(
-		usecase.WithDirPath(p),
-		usecase.WithAPIKey(cfg.SendGridAPIKey),
-		usecase.WithTemplateID(cfg.TemplateID),
+	renderer, err := loadRenderer(p, cfg)
+	if err != nil {
+		// the templates are only needed when the emails are not rendered by sendgrid
+		if cfg.Transport == "smtp" || cfg.TemplateID == "" {
+			logrus.Fatal(err)
+		}
+		logrus.Warnf("the emails can't be previewed: %v", err)
+	}
+	mlr, err := mailer(cfg, renderer)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if closer, ok := mlr.(io.Closer); ok {
+		defer closer.Close()
+	}
+	opts := append(readingOptions(p, cfg),
+		usecase.WithSource(usecase.NewDirSource(usecase.DefaultSourceName, path.Join(p, cfg.FilesDir),
+			dirSourceOptions(p, cfg.ArchiveDir, cfg.QuarantineDir)...)),
+		usecase.WithMailer(mlr),
+		usecase.WithRenderer(renderer),
 	)
+	if cfg.ReportsDir != "" {
+		opts = append(opts, usecase.WithReportsDir(path.Join(p, cfg.ReportsDir)))
+	}
+	if cfg.SuppressedDir != "" {
+		if cfg.LedgerFile == "" {
+			logrus.Fatal("the suppressedDir needs a ledgerFile, the suppression list is kept in the ledger")
+		}
+		opts = append(opts, usecase.WithAlternativeChannel(usecase.NewDirChannel(path.Join(p, cfg.SuppressedDir))))
+	}
+	if cfg.AttachPDF {
+		opts = append(opts, usecase.WithPDFAttachment())
+	}
+	if cfg.PDFDir != "" {
+		opts = append(opts, usecase.WithPDFDir(path.Join(p, cfg.PDFDir)))
+	}
+	if cfg.CustomersFile != "" {
+		customers, err := usecase.LoadCustomerProfiles(path.Join(p, cfg.CustomersFile))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		opts = append(opts, usecase.WithCustomerProfiles(customers))
+	}
+	if cfg.PDFPassword.Encrypt {
+		if cfg.CustomersFile == "" {
+			logrus.Fatal("the PDF statements can't be encrypted without a customersFile")
+		}
+		opts = append(opts, usecase.WithPDFPassword(pdfPassword(cfg.PDFPassword)))
+	}
+	opts = append(opts, usecase.WithSender(sender(cfg, config.SenderConfig{})))
+	var ledger *usecase.Ledger
+	if cfg.LedgerFile != "" {
+		ledger, err = usecase.OpenLedger(path.Join(p, cfg.LedgerFile))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer ledger.Close()
+		opts = append(opts, usecase.WithLedger(ledger))
+	}
+	if cfg.Transport == "" || cfg.Transport == "sendgrid" {
+		opts = append(opts, usecase.WithDispatchConcurrency(cfg.SendGridMaxInFlight))
+	}
+	if cfg.BatchSize > 1 {
+		opts = append(opts, usecase.WithBatching(cfg.BatchSize))
+	}
+	for _, src := range cfg.Sources {
+		opts = append(opts,
+			usecase.WithSource(usecase.NewDirSource(src.Name, path.Join(p, src.Dir),
+				dirSourceOptions(p, src.ArchiveDir, src.QuarantineDir)...)),
+			usecase.WithCSVMapping(src.Name, csvMapping(src.CSV)),
+			usecase.WithValidationPolicy(src.Name, validationPolicy(src.Validation)),
+			usecase.WithSourceSender(src.Name, sender(cfg, src.Sender)),
+		)
+	}
+	clc := usecase.NewCalculator(opts...)
 	// init Worker
 	wrkr := newWorker(
 		withInterval(cfg.Interval),
+		withDispatchInterval(cfg.DispatchInterval),
 		withStartAt(cfg.StartAt),
 		withContext(context.Background()),
 		withCalculator(clc),
@@ -35,10 +111,148 @@ func Run(cfg *config.Config) {
 	go func() {
 		startWorker(wrkr)
 	}()
+	webhook := startWebhook(cfg.Webhook, ledger)
 	<-shutdownChan
+	stopWebhook(webhook)
 	logrus.Info("shutting down")
 }
 
+// Preview renders the email of a statement file to dir, as <statement>.html and <statement>.txt, without sending it
+func Preview(cfg *config.Config, filename, dir string) error {
+	p, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	renderer, err := loadRenderer(p, cfg)
+	if err != nil {
+		return err
+	}
+	email, err := usecase.NewCalculator(append(readingOptions(p, cfg), usecase.WithRenderer(renderer))...).Preview(filename)
+	if err != nil {
+		return err
+	}
+	name := path.Join(dir, path.Base(filename))
+	if err := ioutil.WriteFile(name+".html", []byte(email.HTML), 0o644); err != nil {
+		return err
+	}
+	logrus.Infof("subject: %s", email.Subject)
+	logrus.Infof("HTML body written to %s.html", name)
+	if email.Text == "" {
+		return nil
+	}
+	if err := ioutil.WriteFile(name+".txt", []byte(email.Text), 0o644); err != nil {
+		return err
+	}
+	logrus.Infof("plain text body written to %s.txt", name)
+	return nil
+}
+
+// readingOptions are the settings statements are read and summarized with, the files are relative to root
+func readingOptions(root string, cfg *config.Config) []usecase.Option {
+	rounding, err := usecase.ParseRoundingMode(cfg.Rounding)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	opts := []usecase.Option{
+		usecase.WithRoundingMode(rounding),
+		usecase.WithReportingCurrency(cfg.ReportingCurrency),
+		usecase.WithCSVMapping(usecase.DefaultSourceName, csvMapping(cfg.CSV)),
+		usecase.WithValidationPolicy(usecase.DefaultSourceName, validationPolicy(cfg.Validation)),
+	}
+	if cfg.BalanceFile != "" {
+		opts = append(opts, usecase.WithBalanceFile(path.Join(root, cfg.BalanceFile)))
+	}
+	if cfg.FXRatesFile != "" {
+		rates, err := usecase.LoadFXRates(path.Join(root, cfg.FXRatesFile))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		opts = append(opts, usecase.WithFXRates(rates))
+	}
+	return opts
+}
+
+// loadRenderer reads the templates the emails are rendered from locally, relative to root
+func loadRenderer(root string, cfg *config.Config) (*usecase.Renderer, error) {
+	subject, htmlTemplate := cfg.EmailSubject, cfg.HTMLTemplate
+	if subject == "" {
+		subject = "Your account statement"
+	}
+	if htmlTemplate == "" {
+		htmlTemplate = "emailTemplate.html"
+	}
+	var textTemplate string
+	if cfg.TextTemplate != "" {
+		textTemplate = path.Join(root, cfg.TextTemplate)
+	}
+	return usecase.LoadRenderer(subject, path.Join(root, htmlTemplate), textTemplate)
+}
+
+// pdfPassword converts the password settings of the PDF statements, an unknown field stops the service
+func pdfPassword(cfg config.PDFPasswordConfig) usecase.PDFPassword {
+	field, err := usecase.ParsePasswordField(cfg.Field)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return usecase.PDFPassword{Field: field, Digits: cfg.Digits, Hint: cfg.Hint}
+}
+
+// sender converts the sender of the config with the fields override sets, e.g. the sender of a source. An
+// invalid sender stops the service, an empty one is only allowed with smtp, which sends from its own address
+func sender(cfg *config.Config, override config.SenderConfig) usecase.Sender {
+	merged := cfg.Sender
+	for _, field := range []struct{ value, override *string }{
+		{&merged.Email, &override.Email},
+		{&merged.Name, &override.Name},
+		{&merged.ReplyTo, &override.ReplyTo},
+		{&merged.ReplyToName, &override.ReplyToName},
+	} {
+		if *field.override != "" {
+			*field.value = *field.override
+		}
+	}
+	if override.BCC != nil {
+		merged.BCC = override.BCC
+	}
+	s := usecase.Sender{
+		From:    usecase.Address{Email: merged.Email, Name: merged.Name},
+		ReplyTo: usecase.Address{Email: merged.ReplyTo, Name: merged.ReplyToName},
+	}
+	for _, bcc := range merged.BCC {
+		s.BCC = append(s.BCC, usecase.Address{Email: bcc})
+	}
+	if s.From.Email == "" && cfg.Transport == "smtp" {
+		return s
+	}
+	if err := s.Validate(); err != nil {
+		logrus.Fatal(err)
+	}
+	return s
+}
+
+// csvMapping converts the CSV layout of the config, only the first character of delimiter and quote is used
+func csvMapping(cfg config.CSVConfig) usecase.CSVMapping {
+	mapping := usecase.CSVMapping{
+		NoHeader:     cfg.NoHeader,
+		ID:           cfg.ID,
+		Date:         cfg.Date,
+		Amount:       cfg.Amount,
+		Description:  cfg.Description,
+		Currency:     cfg.Currency,
+		DateLayout:   cfg.DateLayout,
+		OpeningLabel: cfg.OpeningLabel,
+		ClosingLabel: cfg.ClosingLabel,
+		TrailerLabel: cfg.TrailerLabel,
+	}
+	if d := []rune(cfg.Delimiter); len(d) > 0 {
+		mapping.Delimiter = d[0]
+	}
+	if q := []rune(cfg.Quote); len(q) > 0 {
+		mapping.Quote = q[0]
+	}
+	return mapping
+}
+
 func startWorker(w *worker) {
 	logrus.Info("starting worker")
 	if err := w.Start(); err != nil {
@@ -57,3 +271,62 @@ func setupShutdown(w *worker) chan struct{} {
 	}()
 	return shutdownComplete
 }
+
+// mailer builds the Mailer of the configured transport. sendgrid renders the emails with the dynamic template
+// when there is one
+func mailer(cfg *config.Config, renderer *usecase.Renderer) (usecase.Mailer, error) {
+	switch cfg.Transport {
+	case "", "sendgrid":
+		return usecase.NewSendGridMailer(cfg.SendGridAPIKey, cfg.TemplateID,
+			usecase.WithSendGridRenderer(renderer),
+			usecase.WithSendGridRateLimit(cfg.SendGridRateLimit, cfg.SendGridBurst),
+			usecase.WithSendGridMaxInFlight(cfg.SendGridMaxInFlight),
+		), nil
+	case "smtp":
+		var opts []usecase.SMTPOption
+		if cfg.SMTP.Username != "" {
+			opts = append(opts, usecase.WithSMTPAuth(cfg.SMTP.Auth, cfg.SMTP.Username, cfg.SMTP.Password))
+		}
+		if cfg.SMTP.PoolSize > 0 {
+			opts = append(opts, usecase.WithSMTPPoolSize(cfg.SMTP.PoolSize))
+		}
+		if cfg.SMTP.Timeout != "" {
+			timeout, err := time.ParseDuration(cfg.SMTP.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid smtp timeout: %w", err)
+			}
+			opts = append(opts, usecase.WithSMTPTimeout(timeout))
+		}
+		if cfg.SMTP.Insecure {
+			opts = append(opts, usecase.WithSMTPInsecure())
+		}
+		port := cfg.SMTP.Port
+		if port == 0 {
+			port = 587
+		}
+		return usecase.NewSMTPMailer(net.JoinHostPort(cfg.SMTP.Host, strconv.Itoa(port)), cfg.SMTP.From, renderer, opts...)
+	}
+	return nil, fmt.Errorf("unknown transport %q, use sendgrid or smtp", cfg.Transport)
+}
+
+// validationPolicy converts the validation settings of the config, an unknown action stops the service
+func validationPolicy(cfg config.ValidationConfig) usecase.ValidationPolicy {
+	action, err := usecase.ParseValidationAction(cfg.Action)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return usecase.ValidationPolicy{Action: action, MaxSkipped: cfg.MaxSkipped}
+}
+
+// dirSourceOptions sets the archive and quarantine directories of a source, relative to root. Empty ones are left
+// to their defaults inside the source directory
+func dirSourceOptions(root, archiveDir, quarantineDir string) []usecase.DirSourceOption {
+	var opts []usecase.DirSourceOption
+	if archiveDir != "" {
+		opts = append(opts, usecase.WithArchiveDir(path.Join(root, archiveDir)))
+	}
+	if quarantineDir != "" {
+		opts = append(opts, usecase.WithQuarantineDir(path.Join(root, quarantineDir)))
+	}
+	return opts
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hevela/statements/config"
+	"github.com/hevela/statements/internal/usecase"
+)
+
+// ListDeadLetters writes a line for every dead letter of class, or of every class when it's empty
+func ListDeadLetters(cfg *config.Config, class string, w io.Writer) error {
+	ledger, err := openAdmin(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer ledger.Close()
+	letters, err := ledger.DeadLetters(class)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCLASS\tATTEMPTS\tFAILED AT\tRECIPIENT\tERROR")
+	for _, letter := range letters {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\t%s\n", letter.ID, letter.Class, letter.Attempts,
+			letter.FailedAt.Format(time.RFC3339), letter.Recipient, letter.Error)
+	}
+	return tw.Flush()
+}
+
+// InspectDeadLetter writes the details of a dead letter and its email as it was rendered
+func InspectDeadLetter(cfg *config.Config, id uint64, w io.Writer) error {
+	ledger, err := openAdmin(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer ledger.Close()
+	letter, err := ledger.DeadLetter(id)
+	if err != nil {
+		return err
+	}
+	envelope := letter.Message.Envelope
+	fmt.Fprintf(w, "ID:        %d\n", letter.ID)
+	fmt.Fprintf(w, "Statement: %s\n", letter.Message.Key)
+	fmt.Fprintf(w, "Recipient: %s\n", letter.Recipient)
+	fmt.Fprintf(w, "Class:     %s\n", letter.Class)
+	fmt.Fprintf(w, "Error:     %s\n", letter.Error)
+	fmt.Fprintf(w, "Attempts:  %d\n", letter.Attempts)
+	fmt.Fprintf(w, "Queued at: %s\n", letter.Message.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Failed at: %s\n", letter.FailedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "From:      %s\n", envelope.From)
+	if envelope.ReplyTo.Email != "" {
+		fmt.Fprintf(w, "Reply-To:  %s\n", envelope.ReplyTo)
+	}
+	if len(envelope.CC) > 0 {
+		fmt.Fprintf(w, "CC:        %s\n", addressList(envelope.CC))
+	}
+	if len(envelope.BCC) > 0 {
+		fmt.Fprintf(w, "BCC:       %s\n", addressList(envelope.BCC))
+	}
+	for _, a := range letter.Message.Attachments {
+		fmt.Fprintf(w, "Attached:  %s (%s, %d bytes)\n", a.Filename, a.ContentType, len(a.Content))
+	}
+	if letter.Email == nil {
+		fmt.Fprintln(w, "\nThe email couldn't be rendered")
+		return nil
+	}
+	fmt.Fprintf(w, "Subject:   %s\n", letter.Email.Subject)
+	body := letter.Email.Text
+	if body == "" {
+		body = letter.Email.HTML
+	}
+	_, err = fmt.Fprintf(w, "\n%s\n", body)
+	return err
+}
+
+// ReplayDeadLetters puts dead letters back in the outbox, the service sends them with its next dispatch. They are
+// the ids given, or every dead letter of class when there are none. It returns how many were replayed
+func ReplayDeadLetters(cfg *config.Config, class string, ids []uint64) (int, error) {
+	return eachDeadLetter(cfg, class, ids, ledgerAdmin.Replay)
+}
+
+// DiscardDeadLetters deletes dead letters, the ids given or every dead letter of class when there are none. It
+// returns how many were discarded
+func DiscardDeadLetters(cfg *config.Config, class string, ids []uint64) (int, error) {
+	return eachDeadLetter(cfg, class, ids, ledgerAdmin.Discard)
+}
+
+// eachDeadLetter applies an action to the dead letters selected, going on after a failure. The errors are returned
+// together
+func eachDeadLetter(cfg *config.Config, class string, ids []uint64, action func(ledgerAdmin, uint64) error) (int, error) {
+	ledger, err := openAdmin(cfg, false)
+	if err != nil {
+		return 0, err
+	}
+	defer ledger.Close()
+	if len(ids) == 0 {
+		letters, err := ledger.DeadLetters(class)
+		if err != nil {
+			return 0, err
+		}
+		for _, letter := range letters {
+			ids = append(ids, letter.ID)
+		}
+	}
+	var (
+		done     int
+		failures []string
+	)
+	for _, id := range ids {
+		if err := action(ledger, id); err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		done++
+	}
+	if len(failures) > 0 {
+		return done, errors.New(strings.Join(failures, "; "))
+	}
+	return done, nil
+}
+
+func addressList(addresses []usecase.Address) string {
+	list := make([]string, len(addresses))
+	for i, a := range addresses {
+		list[i] = a.String()
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hevela/statements/config"
+)
+
+// ListSuppressions writes a line for every address of the suppression list
+func ListSuppressions(cfg *config.Config, w io.Writer) error {
+	ledger, err := openAdmin(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer ledger.Close()
+	suppressions, err := ledger.Suppressions()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tREASON\tCREATED AT\tDETAIL")
+	for _, s := range suppressions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Email, s.Reason, s.CreatedAt.Format(time.RFC3339), s.Detail)
+	}
+	return tw.Flush()
+}
+
+// SuppressEmails adds addresses to the suppression list, their statements are not emailed anymore. It returns how
+// many were added
+func SuppressEmails(cfg *config.Config, reason, detail string, emails []string) (int, error) {
+	return eachEmail(cfg, emails, func(ledger ledgerAdmin, email string) error {
+		return ledger.Suppress(email, reason, detail)
+	})
+}
+
+// UnsuppressEmails removes addresses from the suppression list. It returns how many were removed
+func UnsuppressEmails(cfg *config.Config, emails []string) (int, error) {
+	return eachEmail(cfg, emails, ledgerAdmin.Unsuppress)
+}
+
+// eachEmail applies an action to the addresses, going on after a failure. The errors are returned together
+func eachEmail(cfg *config.Config, emails []string, action func(ledgerAdmin, string) error) (int, error) {
+	ledger, err := openAdmin(cfg, false)
+	if err != nil {
+		return 0, err
+	}
+	defer ledger.Close()
+	var (
+		done     int
+		failures []string
+	)
+	for _, email := range emails {
+		if err := action(ledger, email); err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		done++
+	}
+	if len(failures) > 0 {
+		return done, errors.New(strings.Join(failures, "; "))
+	}
+	return done, nil
+}
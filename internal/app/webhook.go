@@ -0,0 +1,71 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hevela/statements/config"
+	"github.com/hevela/statements/internal/usecase"
+)
+
+// webhookShutdownTimeout is how long the requests being served are waited for on shutdown
+const webhookShutdownTimeout = 5 * time.Second
+
+// startWebhook starts the HTTP server of the sendgrid Event Webhook, of the delivery status of the statements and of
+// the administration of the ledger, nil when there's no webhook address
+func startWebhook(cfg config.WebhookConfig, ledger *usecase.Ledger) *http.Server {
+	if cfg.Addr == "" {
+		return nil
+	}
+	if ledger == nil {
+		logrus.Fatal("the webhook needs a ledgerFile to record the delivery status of the statements")
+	}
+	if cfg.StatusToken == "" {
+		logrus.Fatal("the webhook needs a statusToken to protect the delivery status of the statements")
+	}
+	webhook, err := usecase.NewSendGridWebhook(ledger, cfg.VerificationKey)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/sendgrid/events", webhook)
+	mux.Handle("/deliveries", withBearerToken(cfg.StatusToken, usecase.NewDeliveryStatusHandler(ledger)))
+	mux.Handle("/admin/", withBearerToken(cfg.StatusToken, usecase.NewAdminHandler(ledger)))
+	server := &http.Server{Addr: cfg.Addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		logrus.Infof("webhook listening on %s", cfg.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Fatalf("webhook: %v", err)
+		}
+	}()
+	return server
+}
+
+// stopWebhook stops the server after the requests being served
+func stopWebhook(server *http.Server) {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.Errorf("webhook: %v", err)
+	}
+}
+
+// withBearerToken only lets the requests with the token through
+func withBearerToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -13,11 +13,13 @@ import (
 var errStartTimeEmpty = errors.New("startTime is empty")
 
 type worker struct {
-	ctx        context.Context
-	cancel     context.CancelFunc
-	startAt    string
-	interval   time.Duration
-	calculator usecase.Calculator
+	ctx      context.Context
+	cancel   context.CancelFunc
+	startAt  string
+	interval time.Duration
+	// dispatchInterval is how often the outbox is drained
+	dispatchInterval time.Duration
+	calculator       usecase.Calculator
 }
 
 type Option func(worker *worker)
@@ -32,6 +34,19 @@ func withInterval(interval string) Option {
 	}
 }
 
+func withDispatchInterval(interval string) Option {
+	return func(worker *worker) {
+		if interval == "" {
+			return
+		}
+		inter, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		worker.dispatchInterval = inter
+	}
+}
+
 func withStartAt(startAt string) Option {
 	return func(worker *worker) {
 		if startAt == "" {
@@ -55,11 +70,12 @@ func withCalculator(clc usecase.Calculator) Option {
 
 func newWorker(opts ...Option) *worker {
 	w := &worker{
-		ctx:        context.Background(),
-		cancel:     nil,
-		startAt:    "now",
-		interval:   0,
-		calculator: nil,
+		ctx:              context.Background(),
+		cancel:           nil,
+		startAt:          "now",
+		interval:         0,
+		dispatchInterval: time.Minute,
+		calculator:       nil,
 	}
 	for _, opt := range opts {
 		opt(w)
@@ -83,6 +99,7 @@ func (w *worker) setup() (startingIn time.Duration, err error) {
 func (w *worker) start() {
 	fmt.Println("start calculating")
 	go w.calculator.Run()
+	go w.dispatch()
 	ticker := time.NewTicker(w.interval)
 	for {
 		select {
@@ -95,6 +112,21 @@ func (w *worker) start() {
 		}
 	}
 }
+
+// dispatch drains the outbox on its own schedule, so statements are delivered independently of their parsing
+func (w *worker) dispatch() {
+	ticker := time.NewTicker(w.dispatchInterval)
+	for {
+		select {
+		case <-ticker.C:
+			w.calculator.Dispatch()
+		case <-w.ctx.Done():
+			ticker.Stop()
+			return
+		}
+	}
+}
+
 func (w *worker) Stop() {
 	w.cancel()
 }
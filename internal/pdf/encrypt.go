@@ -0,0 +1,158 @@
+package pdf
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// permissions are the operations allowed to whoever opens the document with the user password: printing,
+// including high quality printing, and extracting text for accessibility. Bits 7, 8 and 13 to 32 must be set
+const permissions = int32(-1<<12) | 1<<2 | 1<<6 | 1<<7 | 1<<9 | 1<<11
+
+// maxPasswordLength is the length passwords are truncated to, in bytes
+const maxPasswordLength = 127
+
+// encryption is the AES-256 standard security handler (revision 6, ISO 32000-2). Strings and streams are
+// encrypted with AES-256-CBC using the file key, the passwords unlock the file key
+type encryption struct {
+	key []byte
+	// o, u, oe, ue and perms are the entries of the encryption dictionary
+	o, u, oe, ue, perms []byte
+}
+
+// newEncryption returns the security handler of a document opened with userPassword. Whoever has ownerPassword
+// can also change the permissions
+func newEncryption(userPassword, ownerPassword string) (*encryption, error) {
+	e := &encryption{key: make([]byte, 32)}
+	if _, err := rand.Read(e.key); err != nil {
+		return nil, err
+	}
+	var err error
+	if e.u, e.ue, err = e.password(truncatePassword(userPassword), nil); err != nil {
+		return nil, err
+	}
+	// the owner password entries are bound to the user password entry
+	if e.o, e.oe, err = e.password(truncatePassword(ownerPassword), e.u); err != nil {
+		return nil, err
+	}
+	perms, p := make([]byte, 16), permissions
+	binary.LittleEndian.PutUint32(perms, uint32(p))
+	copy(perms[4:], []byte{0xff, 0xff, 0xff, 0xff, 'T', 'a', 'd', 'b'})
+	if _, err := rand.Read(perms[12:]); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(e.key)
+	if err != nil {
+		return nil, err
+	}
+	// a single block, ECB is CBC with a zero IV
+	e.perms = make([]byte, 16)
+	block.Encrypt(e.perms, perms)
+	return e, nil
+}
+
+// password returns the hash of a password followed by its salts (U or O), and the file key encrypted with the
+// password (UE or OE)
+func (e *encryption) password(password, userKey []byte) ([]byte, []byte, error) {
+	salts := make([]byte, 16)
+	if _, err := rand.Read(salts); err != nil {
+		return nil, nil, err
+	}
+	validationSalt, keySalt := salts[:8], salts[8:]
+	entry := append(hash2B(password, validationSalt, userKey), salts...)
+	block, err := aes.NewCipher(hash2B(password, keySalt, userKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	encryptedKey := make([]byte, len(e.key))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(encryptedKey, e.key)
+	return entry, encryptedKey, nil
+}
+
+// dict returns the encryption dictionary
+func (e *encryption) dict() string {
+	return fmt.Sprintf("<< /Filter /Standard /V 5 /R 6 /Length 256 "+
+		"/CF << /StdCF << /AuthEvent /DocOpen /CFM /AESV3 /Length 32 >> >> /StmF /StdCF /StrF /StdCF "+
+		"/O <%x> /U <%x> /OE <%x> /UE <%x> /P %d /Perms <%x> /EncryptMetadata true >>",
+		e.o, e.u, e.oe, e.ue, permissions, e.perms)
+}
+
+// encrypt encrypts a string or a stream with AES-256-CBC, the random IV goes first
+func (e *encryption) encrypt(data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(e.key)
+	if err != nil {
+		return nil, err
+	}
+	// PKCS#5 padding, a full block when the data is already aligned
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	padded := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	out := make([]byte, aes.BlockSize+len(padded))
+	if _, err := rand.Read(out[:aes.BlockSize]); err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], padded)
+	return out, nil
+}
+
+// hash2B is the hash of a password of revision 6 (algorithm 2.B of ISO 32000-2). userKey is the U entry when
+// hashing the owner password
+func hash2B(password, salt, userKey []byte) []byte {
+	sum := sha256.Sum256(concat(password, salt, userKey))
+	k := sum[:]
+	for round := 0; ; round++ {
+		k1 := bytes.Repeat(concat(password, k, userKey), 64)
+		block, _ := aes.NewCipher(k[:16])
+		encrypted := make([]byte, len(k1))
+		cipher.NewCBCEncrypter(block, k[16:32]).CryptBlocks(encrypted, k1)
+		// the first 16 bytes as a big-endian number modulo 3 pick the next hash
+		var h hash.Hash
+		switch new(big.Int).Mod(new(big.Int).SetBytes(encrypted[:16]), big.NewInt(3)).Int64() {
+		case 0:
+			h = sha256.New()
+		case 1:
+			h = sha512.New384()
+		default:
+			h = sha512.New()
+		}
+		h.Write(encrypted)
+		k = h.Sum(nil)
+		if round >= 63 && int(encrypted[len(encrypted)-1]) <= round-31 {
+			return k[:32]
+		}
+	}
+}
+
+// truncatePassword returns the UTF-8 bytes of a password, up to maxPasswordLength
+func truncatePassword(password string) []byte {
+	b := []byte(password)
+	if len(b) > maxPasswordLength {
+		b = b[:maxPasswordLength]
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// randomID returns a file identifier, encrypted documents must have one
+func randomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,66 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io/ioutil"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocument_Encrypt(t *testing.T) {
+	doc := New(Info{Title: "Account statement"})
+	doc.AddPage()
+	doc.Text(50, 60, "Balance: 34.74")
+	doc.Encrypt("1234", "")
+
+	got, err := doc.Output()
+	assert.NoError(t, err)
+	assert.Contains(t, string(got), "/Filter /Standard /V 5 /R 6")
+	assert.Contains(t, string(got), "/P -1340")
+	assert.Regexp(t, `/Encrypt 8 0 R /ID \[<[0-9a-f]{32}> <[0-9a-f]{32}>\]`, string(got))
+	assert.NotContains(t, string(got), "Account statement")
+
+	// open the document as a reader would: check the password and decrypt the file key with it
+	entry := func(name string) []byte {
+		value := regexp.MustCompile(`/` + name + ` <([0-9a-f]+)>`).FindSubmatch(got)
+		decoded, err := hex.DecodeString(string(value[1]))
+		assert.NoError(t, err)
+		return decoded
+	}
+	u, ue := entry("U"), entry("UE")
+	assert.Len(t, u, 48)
+	assert.Equal(t, u[:32], hash2B([]byte("1234"), u[32:40], nil))
+	assert.NotEqual(t, u[:32], hash2B([]byte("4321"), u[32:40], nil))
+	key := decrypt(t, hash2B([]byte("1234"), u[40:48], nil), make([]byte, aes.BlockSize), ue)
+
+	// the permissions are encrypted with the file key to detect tampering
+	perms := make([]byte, 16)
+	block, err := aes.NewCipher(key)
+	assert.NoError(t, err)
+	block.Decrypt(perms, entry("Perms"))
+	assert.Equal(t, []byte{0xc4, 0xfa, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 'T', 'a', 'd', 'b'}, perms[:12])
+
+	streams := regexp.MustCompile(`(?s)stream\n(.*?)\nendstream`).FindAllSubmatch(got, -1)
+	assert.Len(t, streams, 1)
+	data := streams[0][1]
+	padded := decrypt(t, key, data[:aes.BlockSize], data[aes.BlockSize:])
+	r, err := zlib.NewReader(bytes.NewReader(padded[:len(padded)-int(padded[len(padded)-1])]))
+	assert.NoError(t, err)
+	contents, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "BT /F1 10 Tf 50 781.89 Td (Balance: 34.74) Tj ET\n", string(contents))
+}
+
+func decrypt(t *testing.T, key, iv, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	assert.NoError(t, err)
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	return out
+}
@@ -0,0 +1,350 @@
+// Package pdf writes simple PDF documents: text in the standard Helvetica fonts and lines, on A4 pages.
+// It's enough for the statements and has no dependencies
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// PageWidth and PageHeight are the size of an A4 page in points
+	PageWidth  = 595.28
+	PageHeight = 841.89
+)
+
+// Font is one of the standard fonts every PDF reader has
+type Font int
+
+const (
+	Regular Font = iota
+	Bold
+)
+
+// fontNames are the PDF names of the fonts, in the resources of every page
+var fontNames = map[Font]string{Regular: "F1", Bold: "F2"}
+
+// Info is the metadata of a document
+type Info struct {
+	Title   string
+	Author  string
+	Subject string
+	// Created is the creation date, left out when it's zero
+	Created time.Time
+}
+
+// Document is a PDF document being written. Coordinates are in points from the top left corner of the page. A
+// misuse, e.g. drawing before AddPage, is kept and returned by Output
+type Document struct {
+	info    Info
+	pages   []*bytes.Buffer
+	current int
+	font    Font
+	size    float64
+	// userPassword opens the document when it's encrypted, ownerPassword also changes its permissions
+	encrypted                   bool
+	userPassword, ownerPassword string
+	// err is the first misuse of the document, what's drawn after it is discarded
+	err error
+}
+
+// New returns an empty document, AddPage must be called before drawing
+func New(info Info) *Document {
+	return &Document{info: info, current: -1, size: 10}
+}
+
+// AddPage adds a page at the end of the document and makes it the current one
+func (d *Document) AddPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.current = len(d.pages) - 1
+}
+
+// PageCount returns the number of pages of the document
+func (d *Document) PageCount() int {
+	return len(d.pages)
+}
+
+// SetPage makes the page n (starting at 1) the current one, e.g. to write the page numbers once the document
+// is complete
+func (d *Document) SetPage(n int) {
+	if n < 1 || n > len(d.pages) {
+		d.fail(fmt.Errorf("pdf: page %d out of range", n))
+		return
+	}
+	d.current = n - 1
+}
+
+// SetFont sets the font and its size in points of the next texts
+func (d *Document) SetFont(font Font, size float64) {
+	d.font, d.size = font, size
+}
+
+// Text writes s with its baseline at y, starting at x
+func (d *Document) Text(x, y float64, s string) {
+	fmt.Fprintf(d.page(), "BT /%s %s Tf %s %s Td (%s) Tj ET\n",
+		fontNames[d.font], num(d.size), num(x), num(PageHeight-y), escape(encode(s)))
+}
+
+// TextRight writes s with its baseline at y, ending at x
+func (d *Document) TextRight(x, y float64, s string) {
+	d.Text(x-d.TextWidth(s), y, s)
+}
+
+// Line draws a line of the given width
+func (d *Document) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(d.page(), "%s w %s %s m %s %s l S\n", num(width), num(x1), num(PageHeight-y1), num(x2), num(PageHeight-y2))
+}
+
+// TextWidth returns the width of s in points with the current font
+func (d *Document) TextWidth(s string) float64 {
+	widths := helveticaWidths
+	if d.font == Bold {
+		widths = helveticaBoldWidths
+	}
+	var total int
+	for _, b := range encode(s) {
+		w := defaultWidth
+		if b >= firstWidthChar && int(b-firstWidthChar) < len(widths) {
+			w = widths[b-firstWidthChar]
+		}
+		total += w
+	}
+	return float64(total) * d.size / 1000
+}
+
+// Fit shortens s with an ellipsis so it's not wider than width with the current font
+func (d *Document) Fit(s string, width float64) string {
+	if d.TextWidth(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && d.TextWidth(string(runes)+"...") > width {
+		runes = runes[:len(runes)-1]
+	}
+	return strings.TrimSpace(string(runes)) + "..."
+}
+
+// Encrypt encrypts the document with AES-256, it can only be opened with userPassword. Printing and copying text
+// for accessibility are allowed, ownerPassword is needed to change the permissions. A random owner password is used
+// when it's empty
+func (d *Document) Encrypt(userPassword, ownerPassword string) {
+	d.encrypted, d.userPassword, d.ownerPassword = true, userPassword, ownerPassword
+}
+
+// Output returns the document
+func (d *Document) Output() ([]byte, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.pages) == 0 {
+		return nil, fmt.Errorf("pdf: the document has no pages")
+	}
+	w := &writer{}
+	if d.encrypted {
+		owner := d.ownerPassword
+		if owner == "" {
+			random, err := randomID()
+			if err != nil {
+				return nil, err
+			}
+			owner = random
+		}
+		var err error
+		if w.enc, err = newEncryption(d.userPassword, owner); err != nil {
+			return nil, err
+		}
+	}
+	w.buf.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	// objects 1 to 4 are the catalog, the page tree and the fonts, then every page and its contents
+	const firstPage = 5
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	infoObj := firstPage + 2*len(d.pages)
+	catalog := "<< /Type /Catalog /Pages 2 0 R >>"
+	if w.enc != nil {
+		// AES-256 is an extension of PDF 1.7, it's part of PDF 2.0
+		catalog = "<< /Type /Catalog /Pages 2 0 R /Extensions << /ADBE << /BaseVersion /1.7 /ExtensionLevel 8 >> >> >>"
+	}
+	w.object(1, catalog)
+	w.object(2, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	w.object(3, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	w.object(4, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		pageObj := firstPage + 2*i
+		w.object(pageObj, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", num(PageWidth), num(PageHeight), pageObj+1))
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(page.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		if err := w.stream(pageObj+1, "/Filter /FlateDecode", compressed.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	info, err := d.infoDict(w)
+	if err != nil {
+		return nil, err
+	}
+	w.object(infoObj, info)
+	trailer, size := fmt.Sprintf("/Root 1 0 R /Info %d 0 R", infoObj), infoObj
+	if w.enc != nil {
+		id, err := randomID()
+		if err != nil {
+			return nil, err
+		}
+		size++
+		w.object(size, w.enc.dict())
+		trailer += fmt.Sprintf(" /Encrypt %d 0 R /ID [<%s> <%s>]", size, id, id)
+	}
+	w.trailer(size, trailer)
+	return w.buf.Bytes(), nil
+}
+
+// page returns the current page, or a buffer that is discarded when there's none
+func (d *Document) page() *bytes.Buffer {
+	if d.current < 0 {
+		d.fail(errors.New("pdf: AddPage must be called before drawing"))
+		return &bytes.Buffer{}
+	}
+	return d.pages[d.current]
+}
+
+// fail keeps the first misuse of the document
+func (d *Document) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *Document) infoDict(w *writer) (string, error) {
+	fields := [][2]string{{"Producer", "statements"}, {"Title", d.info.Title}, {"Author", d.info.Author}, {"Subject", d.info.Subject}}
+	if !d.info.Created.IsZero() {
+		fields = append(fields, [2]string{"CreationDate", "D:" + d.info.Created.UTC().Format("20060102150405Z")})
+	}
+	var entries []string
+	for _, f := range fields {
+		if f[1] == "" {
+			continue
+		}
+		s, err := w.str(encode(f[1]))
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, fmt.Sprintf("/%s %s", f[0], s))
+	}
+	return "<< " + strings.Join(entries, " ") + " >>", nil
+}
+
+// writer writes the objects of a document keeping their offsets for the cross-reference table. Strings and
+// streams are encrypted when enc is set
+type writer struct {
+	buf     bytes.Buffer
+	offsets []int
+	enc     *encryption
+}
+
+func (w *writer) object(n int, body string) {
+	w.begin(n)
+	fmt.Fprintf(&w.buf, "%s\nendobj\n", body)
+}
+
+func (w *writer) stream(n int, dict string, data []byte) error {
+	if w.enc != nil {
+		var err error
+		if data, err = w.enc.encrypt(data); err != nil {
+			return err
+		}
+	}
+	w.begin(n)
+	fmt.Fprintf(&w.buf, "<< %s /Length %d >>\nstream\n", dict, len(data))
+	w.buf.Write(data)
+	w.buf.WriteString("\nendstream\nendobj\n")
+	return nil
+}
+
+// str returns a string object, encrypted strings are written in hexadecimal
+func (w *writer) str(s []byte) (string, error) {
+	if w.enc == nil {
+		return "(" + escape(s) + ")", nil
+	}
+	encrypted, err := w.enc.encrypt(s)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%x>", encrypted), nil
+}
+
+func (w *writer) begin(n int) {
+	for len(w.offsets) < n {
+		w.offsets = append(w.offsets, 0)
+	}
+	w.offsets[n-1] = w.buf.Len()
+	fmt.Fprintf(&w.buf, "%d 0 obj\n", n)
+}
+
+// trailer writes the cross-reference table and the trailer, entries are added to its dictionary
+func (w *writer) trailer(size int, entries string) {
+	start := w.buf.Len()
+	fmt.Fprintf(&w.buf, "xref\n0 %d\n0000000000 65535 f \n", size+1)
+	for _, offset := range w.offsets {
+		fmt.Fprintf(&w.buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&w.buf, "trailer\n<< /Size %d %s >>\nstartxref\n%d\n%%%%EOF\n", size+1, entries, start)
+}
+
+// num formats a number with up to two decimals
+func num(f float64) string {
+	s := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.2f", f), "0"), ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// escape escapes the characters with a meaning in PDF strings
+func escape(s []byte) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '\\', '(', ')':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n', '\r', '\t':
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// winAnsi are the characters of WinAnsiEncoding outside of Latin-1
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+}
+
+// encode converts s to WinAnsiEncoding, the characters it doesn't have are replaced with ?
+func encode(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r < 0x80 || (r >= 0xa0 && r <= 0xff):
+			out = append(out, byte(r))
+		case winAnsi[r] != 0:
+			out = append(out, winAnsi[r])
+		default:
+			out = append(out, '?')
+		}
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocument_Output(t *testing.T) {
+	doc := New(Info{Title: "Statement (July)", Created: time.Date(2021, 8, 31, 12, 0, 0, 0, time.UTC)})
+	doc.AddPage()
+	doc.SetFont(Bold, 18)
+	doc.Text(50, 60, "Account statement")
+	doc.AddPage()
+	doc.SetFont(Regular, 10)
+	doc.TextRight(545, 100, `Año (1) \ 2€`)
+	doc.Line(50, 110, 545, 110, 0.5)
+
+	got, err := doc.Output()
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(got, []byte("%PDF-1.7\n")))
+	assert.True(t, bytes.HasSuffix(got, []byte("%%EOF\n")))
+	assert.Contains(t, string(got), "/Type /Pages /Kids [5 0 R 7 0 R] /Count 2")
+	assert.Contains(t, string(got), "/Title (Statement \\(July\\))")
+	assert.Contains(t, string(got), "/CreationDate (D:20210831120000Z)")
+
+	// every entry of the cross-reference table points to its object
+	xref := regexp.MustCompile(`(?m)^(\d{10}) 00000 n $`).FindAllSubmatch(got, -1)
+	assert.Len(t, xref, 9)
+	for i, entry := range xref {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		assert.True(t, bytes.HasPrefix(got[offset:], []byte(strconv.Itoa(i+1)+" 0 obj\n")), "object %d", i+1)
+	}
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(got)
+	offset, _ := strconv.Atoi(string(startxref[1]))
+	assert.True(t, bytes.HasPrefix(got[offset:], []byte("xref\n0 10\n")))
+
+	// the contents of the second page
+	streams := regexp.MustCompile(`(?s)stream\n(.*?)\nendstream`).FindAllSubmatch(got, -1)
+	assert.Len(t, streams, 2)
+	r, err := zlib.NewReader(bytes.NewReader(streams[1][1]))
+	assert.NoError(t, err)
+	contents, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "BT /F1 10 Tf 492.75 741.89 Td (A\xf1o \\(1\\) \\\\ 2\x80) Tj ET\n0.5 w 50 731.89 m 545 731.89 l S\n", string(contents))
+}
+
+func TestDocument_Output_noPages(t *testing.T) {
+	_, err := New(Info{}).Output()
+	assert.Error(t, err)
+}
+
+func TestDocument_Output_misuse(t *testing.T) {
+	d := New(Info{})
+	d.Text(10, 10, "before the first page")
+	d.AddPage()
+	_, err := d.Output()
+	assert.EqualError(t, err, "pdf: AddPage must be called before drawing")
+
+	d = New(Info{})
+	d.AddPage()
+	d.SetPage(2)
+	d.Text(10, 10, "still on the first page")
+	_, err = d.Output()
+	assert.EqualError(t, err, "pdf: page 2 out of range")
+}
+
+func TestDocument_TextWidth(t *testing.T) {
+	doc := New(Info{})
+	doc.SetFont(Regular, 10)
+	assert.InDelta(t, 27.8, doc.TextWidth("00000"), 0.001)
+	doc.SetFont(Bold, 20)
+	assert.InDelta(t, 14.44, doc.TextWidth("A"), 0.001)
+}
+
+func TestDocument_Fit(t *testing.T) {
+	doc := New(Info{})
+	doc.SetFont(Regular, 10)
+	assert.Equal(t, "Groceries", doc.Fit("Groceries", 100))
+	got := doc.Fit("Payment to the supermarket around the corner", 100)
+	assert.Equal(t, "Payment to the sup...", got)
+	assert.LessOrEqual(t, doc.TextWidth(got), 100.0)
+}
@@ -0,0 +1,142 @@
+package usecase
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// adminSuppression is the body of a request that suppresses an address
+type adminSuppression struct {
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// NewAdminHandler returns the handler of the administration of the dead letters and the suppression list, so they're
+// managed while the service holds the ledger. It's mounted at /admin/:
+//
+//	GET    /admin/deadletters?class=        the dead letters, of a class when it's set
+//	GET    /admin/deadletters/{id}          a dead letter
+//	POST   /admin/deadletters/{id}/replay   puts a dead letter back in the outbox
+//	POST   /admin/deadletters/{id}/discard  deletes a dead letter
+//	GET    /admin/suppressions              the suppression list
+//	PUT    /admin/suppressions/{email}      suppresses an address, with the reason and detail as JSON
+//	DELETE /admin/suppressions/{email}      unsuppresses an address
+func NewAdminHandler(ledger *Ledger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+		switch {
+		case parts[0] == "deadletters":
+			adminDeadLetters(ledger, w, r, parts[1:])
+		case parts[0] == "suppressions":
+			adminSuppressions(ledger, w, r, parts[1:])
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func adminDeadLetters(ledger *Ledger, w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		letters, err := ledger.DeadLetters(r.URL.Query().Get("class"))
+		if letters == nil {
+			letters = []DeadLetter{}
+		}
+		writeAdminJSON(w, letters, err)
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		letter, err := ledger.DeadLetter(id)
+		writeAdminJSON(w, letter, err)
+		return
+	}
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	switch parts[1] {
+	case "replay":
+		writeAdminResult(w, ledger.Replay(id))
+	case "discard":
+		writeAdminResult(w, ledger.Discard(id))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func adminSuppressions(ledger *Ledger, w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0:
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		suppressions, err := ledger.Suppressions()
+		if suppressions == nil {
+			suppressions = []Suppression{}
+		}
+		writeAdminJSON(w, suppressions, err)
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var s adminSuppression
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&s); err != nil || s.Reason == "" {
+			http.Error(w, "the reason of the suppression is required", http.StatusBadRequest)
+			return
+		}
+		writeAdminResult(w, ledger.Suppress(parts[0], s.Reason, s.Detail))
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		writeAdminResult(w, ledger.Unsuppress(parts[0]))
+	case len(parts) == 1:
+		w.Header().Set("Allow", http.MethodPut+", "+http.MethodDelete)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// allowMethod answers 405 to the requests of another method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// writeAdminJSON answers v as JSON, or the error
+func writeAdminJSON(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		writeAdminResult(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// writeAdminResult answers the outcome of an action, the error is the body of the answer so the admin command
+// shows it as is
+func writeAdminResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrDeadLetterNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
@@ -0,0 +1,109 @@
+package usecase
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAdminHandler(t *testing.T) {
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	entry := &ledgerEntry{Recipient: "user@mail.com", Period: "2021-07/2021-07", Hash: "abc"}
+	assert.NoError(t, ledger.enqueue(entry, testEnvelope, templateData{Email: "user@mail.com"}, nil))
+	messages, err := ledger.pending(time.Now())
+	assert.NoError(t, err)
+	_, err = ledger.abandon(messages[0], ErrPermanentDelivery, nil)
+	assert.NoError(t, err)
+	handler := NewAdminHandler(ledger)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "dead letters", method: http.MethodGet, target: "/admin/deadletters", wantStatus: http.StatusOK, wantBody: `"recipient":"user@mail.com"`},
+		{name: "dead letters of another class", method: http.MethodGet, target: "/admin/deadletters?class=temporary", wantStatus: http.StatusOK, wantBody: "[]"},
+		{name: "dead letter", method: http.MethodGet, target: "/admin/deadletters/1", wantStatus: http.StatusOK, wantBody: `"class":"permanent"`},
+		{name: "unknown dead letter", method: http.MethodGet, target: "/admin/deadletters/2", wantStatus: http.StatusNotFound, wantBody: "dead letter not found: 2"},
+		{name: "invalid ID", method: http.MethodGet, target: "/admin/deadletters/abc", wantStatus: http.StatusNotFound},
+		{name: "replay by GET", method: http.MethodGet, target: "/admin/deadletters/1/replay", wantStatus: http.StatusMethodNotAllowed},
+		{name: "suppress", method: http.MethodPut, target: "/admin/suppressions/User@mail.com", body: `{"reason": "manual", "detail": "asked by support"}`, wantStatus: http.StatusNoContent},
+		{name: "suppress without reason", method: http.MethodPut, target: "/admin/suppressions/user@mail.com", body: `{}`, wantStatus: http.StatusBadRequest},
+		{name: "suppressions", method: http.MethodGet, target: "/admin/suppressions", wantStatus: http.StatusOK, wantBody: `"detail":"asked by support"`},
+		{name: "unsuppress", method: http.MethodDelete, target: "/admin/suppressions/user@mail.com", wantStatus: http.StatusNoContent},
+		{name: "no suppressions", method: http.MethodGet, target: "/admin/suppressions", wantStatus: http.StatusOK, wantBody: "[]"},
+		{name: "replay", method: http.MethodPost, target: "/admin/deadletters/1/replay", wantStatus: http.StatusNoContent},
+		{name: "replay again", method: http.MethodPost, target: "/admin/deadletters/1/replay", wantStatus: http.StatusNotFound},
+		{name: "unknown path", method: http.MethodGet, target: "/admin/outbox", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+			assert.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			assert.Contains(t, w.Body.String(), tt.wantBody)
+		})
+	}
+
+	// the replayed email is back in the outbox
+	messages, err = ledger.pending(time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+}
+
+func TestNewAdminHandler_deadLetterJSON(t *testing.T) {
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	entry := &ledgerEntry{Recipient: "user@mail.com", Period: "2021-07/2021-07", Hash: "abc"}
+	assert.NoError(t, ledger.enqueue(entry, testEnvelope, templateData{Email: "user@mail.com"}, nil))
+	messages, err := ledger.pending(time.Now())
+	assert.NoError(t, err)
+	_, err = ledger.abandon(messages[0], ErrPermanentDelivery, nil)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	NewAdminHandler(ledger).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/deadletters/1", nil))
+	var got DeadLetter
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	want, err := ledger.DeadLetter(1)
+	assert.NoError(t, err)
+	assert.Equal(t, want.Recipient, got.Recipient)
+	assert.Equal(t, want.Message, got.Message)
+}
+
+func TestOpenLedgerReadOnly(t *testing.T) {
+	filename := path.Join(t.TempDir(), "ledger.db")
+	_, err := OpenLedgerReadOnly(filename)
+	assert.Error(t, err)
+
+	ledger, err := OpenLedger(filename)
+	assert.NoError(t, err)
+	assert.NoError(t, ledger.Suppress("user@mail.com", "manual", ""))
+	assert.NoError(t, ledger.Close())
+
+	first, err := OpenLedgerReadOnly(filename)
+	assert.NoError(t, err)
+	defer first.Close()
+	second, err := OpenLedgerReadOnly(filename)
+	assert.NoError(t, err)
+	defer second.Close()
+	_, err = OpenLedger(filename)
+	assert.True(t, errors.Is(err, ErrLedgerInUse), err)
+	suppressions, err := second.Suppressions()
+	assert.NoError(t, err)
+	assert.Len(t, suppressions, 1)
+	assert.Error(t, second.Suppress("other@mail.com", "manual", ""))
+}
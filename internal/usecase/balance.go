@@ -0,0 +1,96 @@
+package usecase
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// applyBalances calculates the opening, closing, lowest and running balances of the statement. The opening
+// balance is the one declared by the statement, or derived from its declared closing balance, or the closing
+// balance of the previous statement, in that order. Statements without any of them start from zero. The balances
+// must be in the currency of the reported amounts, see toReportingCurrency
+func (s *statementSummary) applyBalances() {
+	var opening money
+	switch {
+	case s.openingBalance != nil:
+		opening = s.openingBalance.amount
+	case s.closingBalance != nil:
+		opening = s.closingBalance.amount - s.total
+	case s.previousBalance != nil:
+		opening = s.previousBalance.amount
+	}
+	running, lowest := opening, opening
+	for i := range s.transactions {
+		running += s.transactions[i].reportedAmount
+		s.transactions[i].balance = running
+		if running < lowest {
+			lowest = running
+		}
+	}
+	s.opening, s.closing, s.lowest = opening, running, lowest
+}
+
+// storedBalance is the JSON representation of a balance in the balance file
+type storedBalance struct {
+	// Amount is in minor units of Currency (cents when it's empty), empty for the balances saved before it was kept
+	Amount   int64     `json:"amount"`
+	Date     time.Time `json:"date"`
+	Currency string    `json:"currency,omitempty"`
+}
+
+// fileBalanceStore keeps the closing balances in a JSON file, keyed by account
+type fileBalanceStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (s *fileBalanceStore) closingBalance(account string) (*balance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	balances, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	b, found := balances[account]
+	if !found {
+		return nil, nil
+	}
+	return &balance{amount: money(b.Amount), date: b.Date, currency: b.Currency}, nil
+}
+
+func (s *fileBalanceStore) saveClosingBalance(account string, b balance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	balances, err := s.load()
+	if err != nil {
+		return err
+	}
+	balances[account] = storedBalance{Amount: int64(b.amount), Date: b.date, Currency: b.currency}
+	data, err := json.MarshalIndent(balances, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func (s *fileBalanceStore) load() (map[string]storedBalance, error) {
+	balances := map[string]storedBalance{}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return balances, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &balances); err != nil {
+		return nil, err
+	}
+	return balances, nil
+}
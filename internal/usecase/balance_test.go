@@ -0,0 +1,118 @@
+package usecase
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_statementSummary_applyBalances(t *testing.T) {
+	transactions := func() []transaction {
+		return []transaction{
+			{id: "0", reportedAmount: -3000},
+			{id: "1", reportedAmount: 5000},
+			{id: "2", reportedAmount: -1000},
+		}
+	}
+	tests := []struct {
+		name        string
+		summary     statementSummary
+		wantOpening money
+		wantClosing money
+		wantLowest  money
+		wantRunning []money
+	}{
+		{
+			name:        "must start from the declared opening balance",
+			summary:     statementSummary{openingBalance: &balance{amount: 2000}, previousBalance: &balance{amount: 99}},
+			wantOpening: 2000,
+			wantClosing: 3000,
+			wantLowest:  -1000,
+			wantRunning: []money{-1000, 4000, 3000},
+		},
+		{
+			name:        "must derive the opening balance from the declared closing balance",
+			summary:     statementSummary{closingBalance: &balance{amount: 3000}, total: 1000},
+			wantOpening: 2000,
+			wantClosing: 3000,
+			wantLowest:  -1000,
+			wantRunning: []money{-1000, 4000, 3000},
+		},
+		{
+			name:        "must start from the previous closing balance",
+			summary:     statementSummary{previousBalance: &balance{amount: 5000}},
+			wantOpening: 5000,
+			wantClosing: 6000,
+			wantLowest:  2000,
+			wantRunning: []money{2000, 7000, 6000},
+		},
+		{
+			name:        "must start from zero without balances",
+			summary:     statementSummary{},
+			wantOpening: 0,
+			wantClosing: 1000,
+			wantLowest:  -3000,
+			wantRunning: []money{-3000, 2000, 1000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.summary
+			s.transactions = transactions()
+			s.applyBalances()
+			assert.Equal(t, tt.wantOpening, s.opening)
+			assert.Equal(t, tt.wantClosing, s.closing)
+			assert.Equal(t, tt.wantLowest, s.lowest)
+			var running []money
+			for _, trn := range s.transactions {
+				running = append(running, trn.balance)
+			}
+			assert.Equal(t, tt.wantRunning, running)
+		})
+	}
+}
+
+func Test_statementSummary_toReportingCurrency_balances(t *testing.T) {
+	rates, err := readFXRates(strings.NewReader("date,from,to,rate\n2021-07-01,EUR,MXN,20\n"))
+	assert.NoError(t, err)
+	contents := ":20:STMT\n:25:123456789\n:28C:1/1\n:60F:C210701EUR100,00\n:61:2107150715C60,50NTRF\n:62F:C210731EUR160,50\n"
+	summary, err := processStatement("user@mail.com.sta", strings.NewReader(contents), parseConfig{})
+	assert.NoError(t, err)
+
+	got, err := summary.toReportingCurrency("MXN", rates, RoundHalfEven)
+	assert.NoError(t, err)
+	got.applyBalances()
+	assert.Equal(t, &balance{amount: 200000, date: time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC), currency: "MXN"}, got.openingBalance)
+	assert.Equal(t, money(200000), got.opening)
+	assert.Equal(t, money(321000), got.closing)
+	assert.Equal(t, money(321000), got.closingBalance.amount)
+
+	// the closing balance of the previous statement is kept with its currency
+	summary.openingBalance, summary.closingBalance = nil, nil
+	summary.previousBalance = &balance{amount: 10000, currency: "EUR"}
+	got, err = summary.toReportingCurrency("MXN", rates, RoundHalfEven)
+	assert.NoError(t, err)
+	got.applyBalances()
+	assert.Equal(t, money(200000), got.opening)
+	assert.Equal(t, money(321000), got.closing)
+
+	summary.previousBalance = &balance{amount: 200000, currency: "MXN"}
+	_, err = summary.toReportingCurrency("", rates, RoundHalfEven)
+	assert.Error(t, err, "a balance in another currency needs a reporting currency")
+}
+
+func Test_fileBalanceStore(t *testing.T) {
+	store := &fileBalanceStore{path: path.Join(t.TempDir(), "data", "balances.json")}
+	got, err := store.closingBalance("user@mail.com")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	closing := balance{amount: 12345, date: time.Date(2021, 8, 31, 0, 0, 0, 0, time.UTC), currency: "MXN"}
+	assert.NoError(t, store.saveClosingBalance("user@mail.com", closing))
+	got, err = store.closingBalance("user@mail.com")
+	assert.NoError(t, err)
+	assert.Equal(t, &closing, got)
+}
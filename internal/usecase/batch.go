@@ -0,0 +1,36 @@
+package usecase
+
+// batcher groups the emails of the outbox to send them together. A batch is flushed when it has size emails, the
+// last one when the outbox is done
+type batcher struct {
+	size    int
+	flush   func(batch []outboxMessage)
+	pending []outboxMessage
+}
+
+func newBatcher(size int, flush func(batch []outboxMessage)) *batcher {
+	return &batcher{size: size, flush: flush}
+}
+
+// add adds an email to the current batch, flushing it when it's full
+func (b *batcher) add(msg outboxMessage) {
+	b.pending = append(b.pending, msg)
+	if len(b.pending) < b.size {
+		return
+	}
+	b.flush(b.take())
+}
+
+// close flushes the current batch
+func (b *batcher) close() {
+	if batch := b.take(); len(batch) > 0 {
+		b.flush(batch)
+	}
+}
+
+// take returns the current batch and starts the next one
+func (b *batcher) take() []outboxMessage {
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
@@ -0,0 +1,93 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_batcher(t *testing.T) {
+	var batches [][]string
+	b := newBatcher(2, func(batch []outboxMessage) {
+		var recipients []string
+		for _, msg := range batch {
+			recipients = append(recipients, msg.Recipient)
+		}
+		batches = append(batches, recipients)
+	})
+
+	// full batches are flushed right away
+	for _, r := range []string{"a", "b", "c"} {
+		b.add(outboxMessage{Recipient: r})
+	}
+	assert.Equal(t, [][]string{{"a", "b"}}, batches)
+
+	// the rest is flushed when the outbox is done
+	b.close()
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}}, batches)
+	b.close()
+	assert.Len(t, batches, 2)
+}
+
+// batchMailer is a BatchMailer that keeps the batches it sends, failing the emails of the recipients in errs
+type batchMailer struct {
+	recordingMailer
+	batches [][]string
+	errs    map[string]error
+}
+
+func (m *batchMailer) SendBatch(emails []Email) []SendResult {
+	results := make([]SendResult, len(emails))
+	var recipients []string
+	for i, email := range emails {
+		recipients = append(recipients, email.Data.Email)
+		results[i] = SendResult{MessageID: fmt.Sprintf("batch-%d", len(m.batches)), Err: m.errs[email.Data.Email]}
+	}
+	m.batches = append(m.batches, recipients)
+	return results
+}
+
+func Test_calculator_Dispatch_batches(t *testing.T) {
+	dir := t.TempDir()
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	for _, name := range []string{"a", "b", "c"} {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name+"@mail.com.csv"), []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n"), 0o600))
+	}
+	mailer := &batchMailer{errs: map[string]error{
+		"b@mail.com": errors.New("something bad happened"),
+		"c@mail.com": fmt.Errorf("%w: invalid address", ErrPermanentDelivery),
+	}}
+	c := NewCalculator(WithDirPath(dir), WithLedger(ledger), WithMailer(mailer), WithBatching(2))
+
+	c.Run()
+	messages, err := ledger.pending(time.Now())
+	assert.NoError(t, err)
+	keys := map[string]string{}
+	for _, msg := range messages {
+		keys[msg.Recipient] = msg.Key
+	}
+	c.Dispatch()
+
+	assert.Len(t, mailer.batches, 2)
+	assert.ElementsMatch(t, []string{"a@mail.com", "b@mail.com", "c@mail.com"}, append(mailer.batches[0], mailer.batches[1]...))
+	assert.Empty(t, mailer.sent)
+	// every statement gets the result of its own email
+	entry := ledgerEntryByKey(t, ledger, keys["a@mail.com"])
+	assert.Equal(t, stateSent, entry.State)
+	assert.Contains(t, entry.MessageID, "batch-")
+	messages, err = ledger.pending(time.Now().Add(minRetryDelay))
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "b@mail.com", messages[0].Recipient)
+	}
+	entry = ledgerEntryByKey(t, ledger, keys["c@mail.com"])
+	assert.Equal(t, stateFailed, entry.State)
+	assert.Contains(t, entry.Error, "invalid address")
+}
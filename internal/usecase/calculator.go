@@ -1,27 +1,25 @@
 package usecase
 
 import (
-	"encoding/csv"
-	"encoding/json"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/sendgrid/sendgrid-go"
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	sendgridGetRequest = sendgrid.GetRequest
-	sendgridAPI        = sendgrid.API
-)
-
 type Option func(c *calculator)
 
 func WithDirPath(dirPath string) Option {
@@ -30,156 +28,857 @@ func WithDirPath(dirPath string) Option {
 	}
 }
 
-func WithAPIKey(apikey string) Option {
+// WithMailer sets the Mailer the emails of the statements are delivered with
+func WithMailer(mailer Mailer) Option {
+	return func(c *calculator) {
+		c.mailer = mailer
+	}
+}
+
+// WithRenderer sets the Renderer the emails are previewed with
+func WithRenderer(renderer *Renderer) Option {
+	return func(c *calculator) {
+		c.renderer = renderer
+	}
+}
+
+// WithPDFAttachment attaches the statement document, a PDF with the summary and every transaction, to the emails
+func WithPDFAttachment() Option {
+	return func(c *calculator) {
+		c.attachPDF = true
+	}
+}
+
+// WithPDFDir keeps a copy of the statement document of every statement in dir, in a directory per recipient
+func WithPDFDir(dir string) Option {
+	return func(c *calculator) {
+		c.pdfDir = dir
+	}
+}
+
+// WithCustomerProfiles sets the profiles of the customers, by their email
+func WithCustomerProfiles(customers CustomerProfiles) Option {
 	return func(c *calculator) {
-		c.apikey = apikey
+		c.customers = customers
 	}
 }
 
-func WithTemplateID(templateID string) Option {
+// WithPDFPassword encrypts the statement documents with AES-256, with a password derived from the profile of the
+// customer. The email tells the hint of the password. Statements of customers without a password are not sent
+func WithPDFPassword(password PDFPassword) Option {
 	return func(c *calculator) {
-		c.templateID = templateID
+		c.pdfPassword = &password
+	}
+}
+
+// WithSender sets who the emails are sent from
+func WithSender(sender Sender) Option {
+	return func(c *calculator) {
+		c.sender = sender
+	}
+}
+
+// WithSourceSender sets who the emails of the statements of a source are sent from, e.g. for a tenant with
+// its own brand. The sender of WithSender is used for the other sources
+func WithSourceSender(source string, sender Sender) Option {
+	return func(c *calculator) {
+		c.sourceSenders[source] = sender
+	}
+}
+
+// WithBatching sends the emails of the outbox in batches of up to size emails, with a mailer that supports it
+// (BatchMailer)
+func WithBatching(size int) Option {
+	return func(c *calculator) {
+		c.batchSize = size
+	}
+}
+
+// WithDispatchConcurrency sends up to n emails, or batches of emails, of the outbox at once. The mailer may
+// limit the requests further
+func WithDispatchConcurrency(n int) Option {
+	return func(c *calculator) {
+		c.dispatchConcurrency = n
+	}
+}
+
+// WithAlternativeChannel delivers the statements of the recipients in the suppression list by other means. The
+// suppression list is kept in the ledger, statements are not sent without WithLedger
+func WithAlternativeChannel(channel AlternativeChannel) Option {
+	return func(c *calculator) {
+		c.channel = channel
+	}
+}
+
+// WithCSVMapping sets the layout of the CSV statements of a source
+func WithCSVMapping(source string, mapping CSVMapping) Option {
+	return func(c *calculator) {
+		c.csvMappings[source] = mapping
+	}
+}
+
+// WithRoundingMode sets how amounts and averages are rounded to minor units, half-even by default
+func WithRoundingMode(mode RoundingMode) Option {
+	return func(c *calculator) {
+		c.rounding = mode
+	}
+}
+
+// WithReportingCurrency sets the currency the statement totals are reported in, transactions without
+// currency are assumed to be in it
+func WithReportingCurrency(currency string) Option {
+	return func(c *calculator) {
+		c.reportingCurrency = strings.ToUpper(currency)
+	}
+}
+
+// WithFXRates sets the exchange rates used to convert transactions to the reporting currency
+func WithFXRates(rates *FXRates) Option {
+	return func(c *calculator) {
+		c.fxRates = rates
+	}
+}
+
+// WithBalanceFile keeps the closing balance of each account in a JSON file, statements without balances
+// start from the closing balance of the previous statement sent to the same account
+func WithBalanceFile(path string) Option {
+	return func(c *calculator) {
+		c.balances = &fileBalanceStore{path: path}
+	}
+}
+
+// WithValidationPolicy sets what happens to the statements of a source with invalid rows, they are rejected by default
+func WithValidationPolicy(source string, policy ValidationPolicy) Option {
+	return func(c *calculator) {
+		c.validationPolicies[source] = policy
+	}
+}
+
+// WithReportsDir writes a JSON validation report to dir for every statement with invalid rows
+func WithReportsDir(dir string) Option {
+	return func(c *calculator) {
+		c.reportsDir = dir
+	}
+}
+
+// WithLedger records the state of every statement in a ledger, statements already sent are skipped
+func WithLedger(ledger *Ledger) Option {
+	return func(c *calculator) {
+		c.ledger = ledger
+	}
+}
+
+// WithSource adds a StatementSource to read statements from, it can be used several times
+func WithSource(src StatementSource) Option {
+	return func(c *calculator) {
+		c.sources = append(c.sources, src)
 	}
 }
 
 func NewCalculator(options ...Option) Calculator {
 	c := &calculator{
-		dirPath: "",
+		dirPath:            "",
+		csvMappings:        map[string]CSVMapping{},
+		validationPolicies: map[string]ValidationPolicy{},
+		sourceSenders:      map[string]Sender{},
 	}
 	for _, opt := range options {
 		opt(c)
 	}
+	// the configured directory is the default source
+	if c.dirPath != "" {
+		c.sources = append([]StatementSource{NewDirSource(DefaultSourceName, c.dirPath)}, c.sources...)
+	}
 	return c
 }
 
-// Run is the entrypoint for the file reading and parsing. It reads all files in the configured directory
+// Run is the entrypoint for the file reading and parsing. It reads all statements in the configured sources
 func (c calculator) Run() {
-	// read files in path
-	files, err := ioutil.ReadDir(c.dirPath)
-	if err != nil {
-		logrus.Fatal(err)
-	}
-	for _, file := range files {
-		if file.IsDir() || file.Name() == ".gitignore" || file.Name() == "readme.md" {
+	for _, src := range c.sources {
+		refs, err := src.List()
+		if err != nil {
+			logrus.Errorf("listing source %s: %v", src.Name(), err)
 			continue
 		}
-		logrus.Info("processing file: ", file.Name())
-		// process each file
-		sttmntSummary, err := processFile(path.Join(c.dirPath, file.Name()))
-		if err != nil {
+		for _, ref := range refs {
+			c.runStatement(src, ref)
+		}
+	}
+}
+
+func (c calculator) runStatement(src StatementSource, ref StatementRef) {
+	logrus.Info("processing file: ", ref.Name)
+	// process each file
+	queued, err := c.queueStatement(src, ref)
+	if os.IsNotExist(err) {
+		// the delivery of its email moved it meanwhile
+		return
+	}
+	if err != nil {
+		// the statement is set aside with the error, so it's not read again until it's fixed
+		logrus.Error(err)
+		if err := src.Reject(ref, err); err != nil {
 			logrus.Error(err)
 		}
-		tplData, err := getEmailTemplateData(file.Name(), sttmntSummary)
-		err = c.SendMail(tplData)
+		return
+	}
+	if queued {
+		// the file stays until its email is delivered, see settle
+		logrus.Info("file queued for delivery")
+		return
+	}
+	if err := src.Ack(ref); err != nil {
+		logrus.Error(err)
+	}
+	logrus.Info("file processed OK")
+}
+
+// queueStatement reads a statement and writes its email to the outbox, unless the ledger has it as sent, as
+// suppressed while its recipient still is, or it's already in the outbox. Every step is recorded in the ledger
+// before moving to the next one. It tells if the email is waiting in the outbox, without a ledger it's sent
+// right away
+func (c calculator) queueStatement(src StatementSource, ref StatementRef) (bool, error) {
+	sttmntSummary, err := c.readStatement(src, ref)
+	if err != nil {
+		return false, err
+	}
+	entry := &ledgerEntry{
+		Recipient: recipientEmail(ref.Name),
+		Period:    statementPeriod(sttmntSummary),
+		Hash:      sttmntSummary.contentHash,
+		Source:    ref.Source,
+		File:      ref.Name,
+	}
+	previous, err := c.ledger.lookup(*entry)
+	if err != nil {
+		return false, err
+	}
+	if previous != nil {
+		if previous.State == stateSent {
+			logrus.Infof("%s: already sent to %s on %s, skipping", ref.Name, previous.Recipient, previous.UpdatedAt.Format(time.RFC3339))
+			return false, nil
+		}
+		if previous.State == stateSuppressed {
+			// it was already routed to the alternative channel, it's only queued again once unsuppressed
+			suppression, err := c.ledger.suppression(previous.Recipient)
+			if err != nil {
+				return false, err
+			}
+			if suppression != nil {
+				logrus.Infof("%s: not emailed to %s, %s, skipping", ref.Name, previous.Recipient, suppression)
+				return false, nil
+			}
+		}
+		queued, err := c.ledger.queued(*entry)
 		if err != nil {
+			return false, err
+		}
+		if queued {
+			logrus.Infof("%s: already waiting in the outbox, skipping", ref.Name)
+			return true, nil
+		}
+		entry.Attempts = previous.Attempts
+	}
+	if err := c.ledger.record(entry, stateParsed, nil); err != nil {
+		return false, err
+	}
+	tplData, err := getEmailTemplateData(ref.Name, sttmntSummary)
+	if err != nil {
+		return false, c.fail(entry, err)
+	}
+	attachments, err := c.statementDocument(entry, &tplData, sttmntSummary)
+	if err != nil {
+		return false, c.fail(entry, err)
+	}
+	if err := c.enqueue(entry, c.envelope(ref.Source, entry.Recipient), tplData, attachments); err != nil {
+		return false, err
+	}
+	// the statement is already on its way, a balance that can't be saved doesn't make it fail
+	if c.balances != nil {
+		closing := balance{amount: sttmntSummary.closing, date: sttmntSummary.statementDate, currency: sttmntSummary.currency}
+		if err := c.balances.saveClosingBalance(tplData.Email, closing); err != nil {
 			logrus.Error(err)
+		}
+	}
+	return c.ledger != nil, nil
+}
+
+func (c calculator) readStatement(src StatementSource, ref StatementRef) (statementSummary, error) {
+	file, err := src.Open(ref)
+	if err != nil {
+		return statementSummary{}, err
+	}
+	defer file.Close()
+	// the hash of the contents tells apart statements with the same recipient and period
+	hash := sha256.New()
+	contents := io.TeeReader(file, hash)
+	summary, err := processStatement(ref.Name, contents, parseConfig{csv: c.csvMappings[ref.Source], rounding: c.rounding})
+	if err := c.validate(ref, summary, err); err != nil {
+		return statementSummary{}, err
+	}
+	if _, err := io.Copy(ioutil.Discard, contents); err != nil {
+		return statementSummary{}, err
+	}
+	summary.contentHash = hex.EncodeToString(hash.Sum(nil))
+	if err := summary.reconcile(); err != nil {
+		return statementSummary{}, err
+	}
+	// statements without balances start from the closing balance of the previous one
+	if summary.openingBalance == nil && summary.closingBalance == nil && c.balances != nil {
+		if summary.previousBalance, err = c.balances.closingBalance(recipientEmail(ref.Name)); err != nil {
+			return statementSummary{}, err
+		}
+	}
+	if summary, err = summary.toReportingCurrency(c.reportingCurrency, c.fxRates, c.rounding); err != nil {
+		return statementSummary{}, err
+	}
+	summary.applyBalances()
+	return summary, nil
+}
+
+// Preview renders the email of a statement file without sending it or moving the file. The statement is read with
+// the settings of the default source
+func (c calculator) Preview(filename string) (RenderedEmail, error) {
+	if c.renderer == nil {
+		return RenderedEmail{}, errors.New("no renderer configured")
+	}
+	// the validation report of a preview is not kept
+	c.reportsDir = ""
+	ref := StatementRef{Source: DefaultSourceName, Name: path.Base(filename)}
+	summary, err := c.readStatement(NewDirSource(DefaultSourceName, path.Dir(filename)), ref)
+	if err != nil {
+		return RenderedEmail{}, err
+	}
+	data, err := getEmailTemplateData(ref.Name, summary)
+	if err != nil {
+		return RenderedEmail{}, err
+	}
+	return c.renderer.Render(data)
+}
+
+// enqueue writes the email of a statement to the outbox. Without a ledger there is no outbox nor suppression list,
+// the email is sent right away unless there's an alternative channel for the suppressed recipients
+func (c calculator) enqueue(entry *ledgerEntry, envelope Envelope, data templateData, attachments []Attachment) error {
+	if c.ledger == nil {
+		if c.channel != nil {
+			return errors.New("the suppression list is kept in the ledger, statements are not sent without it")
+		}
+		if _, err := c.send(envelope, data, attachments...); err != nil {
+			return fmt.Errorf("sending the statement: %w", err)
+		}
+		return nil
+	}
+	return c.ledger.enqueue(entry, envelope, data, attachments)
+}
+
+// envelope returns the addresses of the email of a statement: the sender of its source and the CC of the
+// customer, e.g. the joint holders of the account
+func (c calculator) envelope(source, recipient string) Envelope {
+	sender, found := c.sourceSenders[source]
+	if !found {
+		sender = c.sender
+	}
+	envelope := Envelope{From: sender.From, ReplyTo: sender.ReplyTo, BCC: sender.BCC}
+	for _, cc := range c.customers[strings.ToLower(recipient)].CC {
+		envelope.CC = append(envelope.CC, Address{Email: cc})
+	}
+	return envelope
+}
+
+// statementDocument renders the PDF of a statement when it's attached to the email or kept in a directory,
+// encrypted when there's a password policy. It returns the attachments of the email
+func (c calculator) statementDocument(entry *ledgerEntry, data *templateData, summary statementSummary) ([]Attachment, error) {
+	if !c.attachPDF && c.pdfDir == "" {
+		return nil, nil
+	}
+	var password string
+	if c.pdfPassword != nil {
+		profile, found := c.customers[strings.ToLower(entry.Recipient)]
+		if !found {
+			return nil, fmt.Errorf("%w: %s has no customer profile", ErrNoPDFPassword, entry.Recipient)
+		}
+		var err error
+		if password, err = c.pdfPassword.password(profile); err != nil {
+			return nil, err
+		}
+		data.PasswordHint = c.pdfPassword.hint()
+	}
+	content, err := statementPDF(*data, summary, password)
+	if err != nil {
+		return nil, fmt.Errorf("rendering the statement document: %w", err)
+	}
+	if c.pdfDir != "" {
+		if err := writeStatementPDF(c.pdfDir, entry.Recipient, entry.Period, content); err != nil {
+			return nil, err
+		}
+	}
+	if !c.attachPDF {
+		return nil, nil
+	}
+	return []Attachment{{Filename: statementAttachment(entry.Period), ContentType: "application/pdf", Content: content}}, nil
+}
+
+// Dispatch delivers the emails waiting in the outbox. Deliveries that fail with a temporary error stay in the outbox
+// and are retried later, permanent errors take the email out of it. An email may be delivered more than once if the
+// service stops right after sending it
+func (c calculator) Dispatch() {
+	if c.ledger == nil {
+		return
+	}
+	messages, err := c.ledger.pending(time.Now())
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	// the suppression list is checked right before sending, addresses may be suppressed after their email was queued
+	suppressions, err := c.ledger.suppressionsByEmail()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	deliverable := messages[:0]
+	for _, msg := range messages {
+		if s, found := suppressions[strings.ToLower(msg.Recipient)]; found {
+			c.suppress(msg, s)
+			continue
+		}
+		deliverable = append(deliverable, msg)
+	}
+	messages = deliverable
+	// goSend runs up to dispatchConcurrency sends at once
+	concurrency := c.dispatchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var sending sync.WaitGroup
+	defer sending.Wait()
+	goSend := func(send func()) {
+		slots <- struct{}{}
+		sending.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				sending.Done()
+			}()
+			send()
+		}()
+	}
+	batchMailer, ok := c.mailer.(BatchMailer)
+	if !ok || c.batchSize <= 1 {
+		for _, msg := range messages {
+			msg := msg
+			goSend(func() {
+				messageID, err := c.send(c.outboxEmail(msg, suppressions).Envelope, msg.Data, msg.Attachments...)
+				c.settle(msg, messageID, err)
+			})
+		}
+		return
+	}
+	b := newBatcher(c.batchSize, func(batch []outboxMessage) {
+		goSend(func() {
+			emails := make([]Email, len(batch))
+			for i, msg := range batch {
+				emails[i] = c.outboxEmail(msg, suppressions)
+			}
+			for i, result := range batchMailer.SendBatch(emails) {
+				c.settle(batch[i], result.MessageID, result.Err)
+			}
+		})
+	})
+	for _, msg := range messages {
+		b.add(msg)
+	}
+	b.close()
+}
+
+// outboxEmail returns the email of a message of the outbox, without the copies to suppressed addresses
+func (c calculator) outboxEmail(msg outboxMessage, suppressions map[string]Suppression) Email {
+	envelope := msg.Envelope
+	if envelope.From.Email == "" {
+		// queued before the sender was kept with the email
+		envelope = c.envelope(DefaultSourceName, msg.Recipient)
+	}
+	envelope.CC, envelope.BCC = unsuppressed(envelope.CC, suppressions), unsuppressed(envelope.BCC, suppressions)
+	envelope.Statement = msg.Key
+	return Email{Envelope: envelope, Data: msg.Data, Attachments: msg.Attachments}
+}
+
+// suppress records the statement of a suppressed recipient as suppressed instead of sending its email. It's
+// delivered by the alternative channel, if any, and reported to operations in the reports directory
+func (c calculator) suppress(msg outboxMessage, s Suppression) {
+	entry, err := c.ledger.skip(msg, s)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	logrus.Warnf("the statement of %s is not emailed, %s", msg.Recipient, s)
+	c.moveStatementFile(entry, nil)
+	statement := SuppressedStatement{
+		Recipient:   entry.Recipient,
+		Period:      entry.Period,
+		Source:      entry.Source,
+		File:        entry.File,
+		Suppression: s,
+		Data:        msg.Data,
+		Attachments: msg.Attachments,
+	}
+	report := suppressionReport{SuppressedStatement: statement}
+	if c.channel != nil {
+		if err := c.channel.Deliver(statement); err != nil {
+			logrus.Errorf("delivering the statement of %s by the alternative channel: %v", msg.Recipient, err)
+			report.Error = err.Error()
 		} else {
-			logrus.Info("file processed OK")
+			report.Routed = true
 		}
 	}
+	if c.reportsDir == "" {
+		return
+	}
+	report.ReportedAt = time.Now()
+	if err := writeSuppressionReport(c.reportsDir, report); err != nil {
+		logrus.Error(err)
+	}
 }
 
-// SendMail builds the input for the sendgrid API. Sends an email using templateData and the apikey/templateID provided
-func (c calculator) SendMail(data templateData) error {
-	request := sendgridGetRequest(c.apikey, "/v3/mail/send", "https://api.sendgrid.com")
-	request.Method = "POST"
+// settle records the outcome of sending a message of the outbox
+func (c calculator) settle(msg outboxMessage, messageID string, err error) {
+	if errors.Is(err, ErrPermanentDelivery) || (err != nil && msg.Attempts+1 >= maxDeliveryAttempts) {
+		// sending it again won't help, the statement is left as failed with the reason and the email is kept
+		// as a dead letter
+		logrus.Errorf("the statement of %s can't be delivered: %v", msg.Recipient, err)
+		entry, abandonErr := c.ledger.abandon(msg, err, c.rendered(msg))
+		if abandonErr != nil {
+			logrus.Error(abandonErr)
+			return
+		}
+		c.moveStatementFile(entry, err)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("delivering the statement of %s: %v", msg.Recipient, err)
+		if err := c.ledger.retry(msg, err, time.Now()); err != nil {
+			logrus.Error(err)
+		}
+		return
+	}
+	entry, err := c.ledger.delivered(msg, messageID)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	logrus.Infof("statement delivered to %s, message ID %s", msg.Recipient, messageID)
+	c.moveStatementFile(entry, nil)
+}
 
-	bodyTpl := `{"personalizations": [{"to": [{"email": "%s"}],"dynamic_template_data":%s}],"from": {"email": "vellonce@gmail.com"},"template_id": "%s"}`
-	var jsonData []byte
-	jsonData, err := json.Marshal(data)
+// moveStatementFile archives the file of a statement whose email is settled, or quarantines it with the reason the
+// email couldn't be delivered. Files already moved, e.g. the statements of replayed dead letters, are left alone
+func (c calculator) moveStatementFile(entry *ledgerEntry, reason error) {
+	var src StatementSource
+	for _, s := range c.sources {
+		if s.Name() == entry.Source {
+			src = s
+		}
+	}
+	if src == nil || entry.File == "" {
+		return
+	}
+	ref := StatementRef{Source: entry.Source, Name: entry.File}
+	var err error
+	if reason != nil {
+		err = src.Reject(ref, reason)
+	} else {
+		err = src.Ack(ref)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Error(err)
+	}
+}
+
+// rendered returns the email of a message as the renderer renders it, nil without a renderer or when it fails
+func (c calculator) rendered(msg outboxMessage) *RenderedEmail {
+	if c.renderer == nil {
+		return nil
+	}
+	email, err := c.renderer.Render(msg.Data)
 	if err != nil {
-		return err
+		return nil
+	}
+	return &email
+}
+
+// send delivers an email with the configured Mailer
+func (c calculator) send(envelope Envelope, data templateData, attachments ...Attachment) (string, error) {
+	if c.mailer == nil {
+		return "", errors.New("no mailer configured")
+	}
+	return c.mailer.Send(envelope, data, attachments...)
+}
+
+// fail records the failure of a statement in the ledger and returns it
+func (c calculator) fail(entry *ledgerEntry, reason error) error {
+	if err := c.ledger.record(entry, stateFailed, reason); err != nil {
+		logrus.Error(err)
 	}
-	request.Body = []byte(fmt.Sprintf(bodyTpl, data.Email, string(jsonData), c.templateID))
-	_, err = sendgridAPI(request)
-	return err
+	return reason
+}
+
+// validate applies the validation policy of the source to the invalid rows of a statement, or to the error that
+// stopped its parsing. The report is written when there is something to report
+func (c calculator) validate(ref StatementRef, summary statementSummary, parseErr error) error {
+	report := newValidationReport(ref, c.validationPolicies[ref.Source], summary, parseErr)
+	report.CheckedAt = time.Now()
+	if len(report.Issues) > 0 {
+		logrus.Warnf("%s: %d invalid rows, statement %s", ref.Name, len(report.Issues), report.Status)
+		if c.reportsDir != "" {
+			if err := writeValidationReport(c.reportsDir, report); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+	if report.Status == validationRejected {
+		return &validationError{report: report}
+	}
+	return nil
 }
 
 // helper functions
 
-func processFile(path string) (statementSummary, error) {
-	var (
-		firstLine = true
-		debit     = []float64{}
-		credit    = []float64{}
-		result    = statementSummary{}
-	)
-	file, err := os.Open(path)
+// processStatement parses the statement with the parser matching its name or contents and summarizes its transactions
+func processStatement(name string, r io.Reader, cfg parseConfig) (statementSummary, error) {
+	br := bufio.NewReader(r)
+	parser, err := parserFor(name, br, cfg)
 	if err != nil {
 		return statementSummary{}, err
 	}
-	defer file.Close()
-	parser := csv.NewReader(file)
-	parser.FieldsPerRecord = 3
-	result.monthSummary = make(map[string]int)
-	// read the file line by line to save memory (versus reading all the file at once)
-	for {
-		record, err := parser.Read()
-		if err == io.EOF {
-			break
+	builder := newSummaryBuilder(cfg.rounding)
+	// transactions are summarized as they are parsed to save memory (versus reading all the file at once)
+	meta, err := parser.parse(br, builder.add, builder.invalid)
+	if err != nil {
+		return statementSummary{}, err
+	}
+	result := builder.summary()
+	result.openingBalance = meta.openingBalance
+	result.closingBalance = meta.closingBalance
+	result.controlCount = meta.controlCount
+	result.controlSum = meta.controlSum
+	// the rates of the closing date are used for the whole statement
+	if meta.closingBalance != nil {
+		result.statementDate = meta.closingBalance.date
+	}
+	return result, nil
+}
+
+// summaryBuilder accumulates the transactions of a statement into a statementSummary
+type summaryBuilder struct {
+	result   statementSummary
+	rounding RoundingMode
+}
+
+func newSummaryBuilder(rounding RoundingMode) *summaryBuilder {
+	return &summaryBuilder{
+		result: statementSummary{
+			monthSummary: make(map[string]int),
+			currencies:   make(map[string]*currencySummary),
+		},
+		rounding: rounding,
+	}
+}
+
+func (b *summaryBuilder) add(t transaction) error {
+	t.reportedAmount = t.amount
+	b.result.transactions = append(b.result.transactions, t)
+	cs, found := b.result.currencies[t.currency]
+	if !found {
+		cs = &currencySummary{credit: []money{}, debit: []money{}}
+		b.result.currencies[t.currency] = cs
+	}
+	// distinguish between credit/debit to calculate averages
+	if t.amount < 0 {
+		cs.credit = append(cs.credit, t.amount)
+	} else {
+		cs.debit = append(cs.debit, t.amount)
+	}
+	// summarize operations per month
+	b.result.monthSummary[t.date.Format("2006-01")]++
+	if t.date.After(b.result.statementDate) {
+		b.result.statementDate = t.date
+	}
+	return nil
+}
+
+// invalid keeps the rows that can't be read, the validation policy decides what to do with them
+func (b *summaryBuilder) invalid(e rowError) error {
+	b.result.issues = append(b.result.issues, e)
+	return nil
+}
+
+// summary calculates the totals, they are only calculated for statements in a single currency. Statements with
+// several currencies need to be converted to a reporting currency
+func (b *summaryBuilder) summary() statementSummary {
+	for currency, cs := range b.result.currencies {
+		cs.avgCredit = getAvg(cs.credit, b.rounding)
+		cs.avgDebit = getAvg(cs.debit, b.rounding)
+		if len(b.result.currencies) == 1 {
+			b.result.currency = currency
+			b.result.total = cs.total()
+			b.result.avgCredit = cs.avgCredit
+			b.result.avgDebit = cs.avgDebit
+		}
+	}
+	return b.result
+}
+
+// toReportingCurrency converts the transactions and the balances to the reporting currency with the rates of the
+// statement date and calculates the totals with them. Transactions and balances without currency are already in the
+// reporting currency, they only take its decimals
+func (s statementSummary) toReportingCurrency(currency string, rates *FXRates, mode RoundingMode) (statementSummary, error) {
+	if currency == "" {
+		if len(s.currencies) > 1 {
+			return statementSummary{}, errors.New("the statement has transactions in several currencies, a reporting currency is required")
+		}
+		for _, b := range []*balance{s.openingBalance, s.closingBalance, s.previousBalance} {
+			if b != nil && b.currency != "" && s.currency != "" && b.currency != s.currency {
+				return statementSummary{}, fmt.Errorf("the statement has a balance in %s and transactions in %s, a reporting currency is required", b.currency, s.currency)
+			}
+		}
+		// balances without currency are in the currency of the transactions
+		for _, b := range []**balance{&s.openingBalance, &s.closingBalance, &s.previousBalance} {
+			if *b == nil || (*b).currency != "" {
+				continue
+			}
+			converted, err := s.convertBalance(*b, s.currency, rates, mode)
+			if err != nil {
+				return statementSummary{}, err
+			}
+			*b = converted
+		}
+		return s, nil
+	}
+	// transactions without currency are in the reporting currency
+	if cs, found := s.currencies[""]; found {
+		delete(s.currencies, "")
+		for _, amounts := range [][]money{cs.credit, cs.debit} {
+			for i, amount := range amounts {
+				converted, err := amount.convert("", currency, big.NewRat(1, 1), mode)
+				if err != nil {
+					return statementSummary{}, err
+				}
+				amounts[i] = converted
+			}
 		}
+		if reporting, found := s.currencies[currency]; found {
+			reporting.credit = append(reporting.credit, cs.credit...)
+			reporting.debit = append(reporting.debit, cs.debit...)
+			reporting.avgCredit = getAvg(reporting.credit, mode)
+			reporting.avgDebit = getAvg(reporting.debit, mode)
+		} else {
+			cs.avgCredit = getAvg(cs.credit, mode)
+			cs.avgDebit = getAvg(cs.debit, mode)
+			s.currencies[currency] = cs
+		}
+	}
+	for code, cs := range s.currencies {
+		rate, err := rates.rate(code, currency, s.statementDate)
 		if err != nil {
 			return statementSummary{}, err
 		}
-		// skip the first line (line with headers) of CSV
-		if firstLine {
-			firstLine = false
-			continue
+		cs.rate = rate
+	}
+	var (
+		credit, debit []money
+		transactions  = make([]transaction, len(s.transactions))
+	)
+	s.total = 0
+	for i, t := range s.transactions {
+		code := t.currency
+		if code == "" {
+			code = currency
 		}
-		// add amounts to calculate total
-		amount := getAmount(record[2])
-		result.total += amount
-		// distinguish between credit/debit to calculate averages
-		if amount < 0 {
-			credit = append(credit, amount)
-		} else {
-			debit = append(debit, amount)
+		reported, err := t.amount.convert(t.currency, currency, s.currencies[code].rate, mode)
+		if err != nil {
+			return statementSummary{}, err
 		}
-		// summarize operations per month
-		date := string([]byte(record[1])[:7])
-		_, found := result.monthSummary[date]
-		if !found {
-			result.monthSummary[date] = 1
+		t.reportedAmount = reported
+		transactions[i] = t
+		s.total += reported
+		if reported < 0 {
+			credit = append(credit, reported)
 		} else {
-			result.monthSummary[date] += 1
+			debit = append(debit, reported)
 		}
 	}
-	result.avgCredit = getAvg(credit)
-	result.avgDebit = getAvg(debit)
-	return result, nil
+	s.transactions = transactions
+	s.currency = currency
+	s.avgCredit = getAvg(credit, mode)
+	s.avgDebit = getAvg(debit, mode)
+	for _, b := range []**balance{&s.openingBalance, &s.closingBalance, &s.previousBalance} {
+		converted, err := s.convertBalance(*b, currency, rates, mode)
+		if err != nil {
+			return statementSummary{}, err
+		}
+		*b = converted
+	}
+	return s, nil
 }
 
-func getAmount(amnt string) float64 {
-	operation := string([]byte(amnt)[0])
-	amount, err := strconv.ParseFloat(string([]byte(amnt)[1:]), 64)
-	if err != nil {
-		logrus.Error(err)
+// convertBalance converts a balance to the reporting currency with the rate of the statement date, the one the
+// transactions are converted with. Balances without currency are in the reporting currency
+func (s statementSummary) convertBalance(b *balance, currency string, rates *FXRates, mode RoundingMode) (*balance, error) {
+	if b == nil || b.currency == currency {
+		return b, nil
 	}
-	if operation == "-" {
-		amount *= -1
+	rate := big.NewRat(1, 1)
+	if b.currency != "" {
+		var err error
+		if rate, err = rates.rate(b.currency, currency, s.statementDate); err != nil {
+			return nil, err
+		}
+	}
+	amount, err := b.amount.convert(b.currency, currency, rate, mode)
+	if err != nil {
+		return nil, err
 	}
-	return amount
+	return &balance{amount: amount, date: b.date, currency: currency}, nil
+}
+
+// getAmount parses a signed amount of a currency, the sign is optional for positive amounts
+func getAmount(amnt, currency string, mode RoundingMode) (money, error) {
+	return parseMoney(amnt, currency, mode)
 }
 
-func getAvg(vals []float64) float64 {
-	sum := 0.0
+// getAvg returns the average of the values rounded to minor units, 0 if there are no values
+func getAvg(vals []money, mode RoundingMode) money {
+	return sumMoney(vals).div(len(vals), mode)
+}
+
+func sumMoney(vals []money) money {
+	var sum money
 	for _, v := range vals {
 		sum += v
 	}
-	return sum / float64(len(vals))
+	return sum
 }
 
 func getEmailTemplateData(filename string, statement statementSummary) (templateData, error) {
 	var err error
-	email := string([]byte(filename)[:len(filename)-4])
+	email := recipientEmail(filename)
 	template := templateData{
-		Email:        email,
-		TotalBalance: fmt.Sprintf("%.2f", statement.total),
-		AvgCredit:    fmt.Sprintf("%.2f", statement.avgCredit),
-		AvgDebit:     fmt.Sprintf("%.2f", statement.avgDebit),
+		Email:           email,
+		TotalBalance:    statement.total.format(statement.currency),
+		PreviousBalance: statement.opening.format(statement.currency),
+		NewBalance:      statement.closing.format(statement.currency),
+		LowestBalance:   statement.lowest.format(statement.currency),
+		AvgCredit:       statement.avgCredit.format(statement.currency),
+		AvgDebit:        statement.avgDebit.format(statement.currency),
 	}
 	e := strings.Split(email, "@")
 	template.Name = strings.Title(e[0])
+	template.Currency = statement.currency
+	template.CurrencySummary = getCurrencySummary(statement)
+	if len(statement.monthSummary) == 0 {
+		return templateData{}, errors.New("the statement has no transactions")
+	}
 	// sort monthSummary keys
 	keys := make([]string, 0, len(statement.monthSummary))
 	for k := range statement.monthSummary {
@@ -209,6 +908,41 @@ func getEmailTemplateData(filename string, statement statementSummary) (template
 	return template, nil
 }
 
+// getCurrencySummary summarizes the transactions by currency, only if some of them are in a foreign currency
+func getCurrencySummary(statement statementSummary) []currencyOperation {
+	codes := make([]string, 0, len(statement.currencies))
+	foreign := false
+	for code := range statement.currencies {
+		codes = append(codes, code)
+		foreign = foreign || (code != "" && code != statement.currency)
+	}
+	if !foreign {
+		return nil
+	}
+	sort.Strings(codes)
+	summary := make([]currencyOperation, 0, len(codes))
+	for _, code := range codes {
+		cs := statement.currencies[code]
+		operation := currencyOperation{
+			Currency:     code,
+			Total:        cs.total().format(code),
+			AvgDebit:     cs.avgDebit.format(code),
+			AvgCredit:    cs.avgCredit.format(code),
+			Transactions: len(cs.credit) + len(cs.debit),
+		}
+		if cs.rate != nil {
+			operation.Rate = cs.rate.FloatString(6)
+		}
+		summary = append(summary, operation)
+	}
+	return summary
+}
+
+// recipientEmail returns the email a statement is sent to, statements are named after it
+func recipientEmail(filename string) string {
+	return strings.TrimSuffix(filename, path.Ext(filename))
+}
+
 func humanizeMonth(monthNumber, year string) (string, error) {
 	month, err := strconv.Atoi(monthNumber)
 	if err != nil {
@@ -1,29 +1,156 @@
 package usecase
 
+import (
+	"math/big"
+	"time"
+)
+
 type statementSummary struct {
-	total        float64
-	avgCredit    float64
-	avgDebit     float64
-	monthSummary map[string]int
+	total          money
+	avgCredit      money
+	avgDebit       money
+	monthSummary   map[string]int
+	openingBalance *balance
+	closingBalance *balance
+	// currency is the currency of the totals, empty if the transactions don't have one
+	currency string
+	// currencies summarizes the transactions by their currency
+	currencies map[string]*currencySummary
+	// statementDate is the date of the closing balance or of the last transaction
+	statementDate time.Time
+	// previousBalance is the stored closing balance of the previous statement
+	previousBalance *balance
+	controlCount    *int
+	controlSum      *money
+	// issues are the rows that couldn't be read
+	issues []rowError
+	// contentHash is the SHA-256 of the statement file
+	contentHash string
+	// transactions are kept in the order they were read, with their running balance
+	transactions []transaction
+	// opening, closing and lowest are the balances of the period in the reporting currency, the declared and
+	// previous balances are converted to it too
+	opening money
+	closing money
+	lowest  money
+}
+
+// currencySummary holds the transactions of a statement in one currency
+type currencySummary struct {
+	credit    []money
+	debit     []money
+	avgCredit money
+	avgDebit  money
+	// rate is the rate used to convert the currency to the reporting currency
+	rate *big.Rat
+}
+
+func (cs currencySummary) total() money {
+	return sumMoney(cs.credit) + sumMoney(cs.debit)
+}
+
+// balance is an account balance declared by the statement itself
+type balance struct {
+	amount money
+	date   time.Time
+	// currency is the currency of the account, empty if the statement doesn't tell. Balances without currency are
+	// in the reporting currency, like the transactions
+	currency string
+}
+
+// statementMeta holds the information a statementParser reads about the whole statement
+type statementMeta struct {
+	openingBalance *balance
+	closingBalance *balance
+	// controlCount and controlSum are the record count and the sum of the amounts declared by the statement
+	controlCount *int
+	controlSum   *money
+}
+
+// transaction is a single operation of a statement, as read by a statementParser
+type transaction struct {
+	id          string
+	date        time.Time
+	amount      money
+	description string
+	currency    string
+	// reportedAmount is the amount in the reporting currency
+	reportedAmount money
+	// balance is the running balance after the transaction
+	balance money
 }
 
 type calculator struct {
-	dirPath    string
-	apikey     string
-	templateID string
+	dirPath string
+	mailer  Mailer
+	// renderer renders the emails of Preview and of the dead letters
+	renderer *Renderer
+	sources  []StatementSource
+	// csvMappings are the CSV layouts by source name
+	csvMappings map[string]CSVMapping
+	rounding    RoundingMode
+	// reportingCurrency is the currency totals are converted to with fxRates
+	reportingCurrency string
+	fxRates           *FXRates
+	balances          balanceStore
+	// validationPolicies are the validation policies by source name
+	validationPolicies map[string]ValidationPolicy
+	reportsDir         string
+	ledger             *Ledger
+	// attachPDF attaches the statement document to the emails, pdfDir keeps a copy of it
+	attachPDF bool
+	pdfDir    string
+	// pdfPassword encrypts the statement document with a password from the profile of the customer in customers
+	pdfPassword *PDFPassword
+	customers   CustomerProfiles
+	// sender is who the emails are sent from, sourceSenders overrides it for some sources
+	sender        Sender
+	sourceSenders map[string]Sender
+	// batchSize groups the emails of the outbox, they're sent one by one when it's 0
+	batchSize int
+	// channel delivers the statements of suppressed recipients, they're only reported without it
+	channel AlternativeChannel
+	// dispatchConcurrency is the number of emails or batches of the outbox sent at once, one when 0
+	dispatchConcurrency int
 }
 
 type templateData struct {
-	Email          string           `json:"email"`
-	Name           string           `json:"name"`
-	TotalBalance   string           `json:"total_balance"`
-	FirstMonthYear string           `json:"first_month_year"`
-	LastMonthYear  string           `json:"last_month_year"`
-	AvgDebit       string           `json:"avg_debit"`
-	AvgCredit      string           `json:"avg_credit"`
-	MonthSummary   []monthOperation `json:"month_summary"`
+	Email        string `json:"email"`
+	Name         string `json:"name"`
+	TotalBalance string `json:"total_balance"`
+	// PreviousBalance and NewBalance are the opening and closing balances of the period
+	PreviousBalance string           `json:"previous_balance,omitempty"`
+	NewBalance      string           `json:"new_balance,omitempty"`
+	LowestBalance   string           `json:"lowest_balance,omitempty"`
+	FirstMonthYear  string           `json:"first_month_year"`
+	LastMonthYear   string           `json:"last_month_year"`
+	AvgDebit        string           `json:"avg_debit"`
+	AvgCredit       string           `json:"avg_credit"`
+	MonthSummary    []monthOperation `json:"month_summary"`
+	// Currency is the currency of the totals and balances, empty when the statement doesn't tell. CurrencySummary
+	// is only set for statements with foreign currency transactions
+	Currency        string              `json:"currency,omitempty"`
+	CurrencySummary []currencyOperation `json:"currency_summary,omitempty"`
+	// PasswordHint tells how to open the statement document when it's encrypted
+	PasswordHint string `json:"password_hint,omitempty"`
 }
 type monthOperation struct {
 	Month        string `json:"month"`
 	Transactions int    `json:"transactions"`
 }
+type currencyOperation struct {
+	Currency     string `json:"currency"`
+	Total        string `json:"total"`
+	AvgDebit     string `json:"avg_debit"`
+	AvgCredit    string `json:"avg_credit"`
+	Transactions int    `json:"transactions"`
+	Rate         string `json:"rate"`
+}
+
+// StatementRef identifies a statement inside a StatementSource
+type StatementRef struct {
+	// Source is the name of the source the statement was listed from
+	Source string
+	// Name is the file name of the statement, it's named after the recipient's email
+	Name string
+}
@@ -1,12 +1,14 @@
 package usecase
 
 import (
-	"errors"
-	"github.com/sendgrid/rest"
 	"github.com/stretchr/testify/assert"
-	"net/http"
+	"io/ioutil"
+	"os"
+	"path"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewCalculator(t *testing.T) {
@@ -31,28 +33,23 @@ func TestNewCalculator(t *testing.T) {
 	}
 }
 
-func TestWithAPIKey(t *testing.T) {
-	type args struct {
-		apikey string
-	}
+func TestWithMailer(t *testing.T) {
 	tests := []struct {
-		name string
-		args args
-		calc calculator
+		name   string
+		mailer Mailer
+		calc   calculator
 	}{
 		{
-			name: "must set the API key for the calculator",
-			args: args{
-				apikey: "abcdefg",
-			},
-			calc: calculator{},
+			name:   "must set the mailer for the calculator",
+			mailer: NopMailer{},
+			calc:   calculator{},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			opt := WithAPIKey(tt.args.apikey)
+			opt := WithMailer(tt.mailer)
 			opt(&tt.calc)
-			assert.Equal(t, tt.calc.apikey, tt.args.apikey)
+			assert.Equal(t, tt.mailer, tt.calc.mailer)
 		})
 	}
 }
@@ -85,160 +82,118 @@ func TestWithDirPath(t *testing.T) {
 	}
 }
 
-func TestWithTemplateID(t *testing.T) {
-	type args struct {
-		templateID string
-	}
+func TestWithSource(t *testing.T) {
 	tests := []struct {
-		name string
-		args args
-		calc calculator
+		name    string
+		options []Option
+		want    []string
 	}{
 		{
-			name: "must set the templateID for calculator",
-			args: args{
-				templateID: "template-id",
+			name:    "must use the dir path as the default source",
+			options: []Option{WithDirPath("some/path")},
+			want:    []string{DefaultSourceName},
+		},
+		{
+			name: "must add the sources after the default one",
+			options: []Option{
+				WithSource(NewDirSource("partner", "other/path")),
+				WithDirPath("some/path"),
 			},
-			calc: calculator{},
+			want: []string{DefaultSourceName, "partner"},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			opt := WithTemplateID(tt.args.templateID)
-			opt(&tt.calc)
-			assert.Equal(t, tt.calc.templateID, tt.args.templateID)
+			c := NewCalculator(tt.options...).(*calculator)
+			var got []string
+			for _, src := range c.sources {
+				got = append(got, src.Name())
+			}
+			assert.Equal(t, tt.want, got)
 		})
 	}
 }
 
-func Test_calculator_SendMail(t *testing.T) {
-	type globals struct {
-		sendgridGetRequest func(key, endpoint, host string) rest.Request
-		sendgridAPI        func(request rest.Request) (*rest.Response, error)
-	}
+func Test_getAmount(t *testing.T) {
 	type args struct {
-		data templateData
+		amnt     string
+		currency string
+		mode     RoundingMode
 	}
 	tests := []struct {
 		name    string
 		args    args
-		globals globals
+		want    money
 		wantErr bool
 	}{
 		{
-			name: "success: must send an email",
+			name: "should get a positive amount",
 			args: args{
-				data: templateData{
-					Email:          "test@email.com",
-					Name:           "test",
-					TotalBalance:   "34.74",
-					FirstMonthYear: "July 2021",
-					LastMonthYear:  "August 2021",
-					AvgDebit:       "35.25",
-					AvgCredit:      "-15.38",
-					MonthSummary: []monthOperation{
-						{
-							Month:        "July of 2021",
-							Transactions: 2,
-						},
-						{
-							Month:        "August of 2021",
-							Transactions: 2,
-						},
-					},
-				},
+				amnt: "+100.55",
 			},
-			globals: globals{
-				sendgridGetRequest: func(key, endpoint, host string) rest.Request {
-					return rest.Request{}
-				},
-				sendgridAPI: func(request rest.Request) (*rest.Response, error) {
-					body := "{\"personalizations\": [{\"to\": [{\"email\": \"test@email.com\"}],\"dynamic_template_data\":{\"email\":\"test@email.com\",\"name\":\"test\",\"total_balance\":\"34.74\",\"first_month_year\":\"July 2021\",\"last_month_year\":\"August 2021\",\"avg_debit\":\"35.25\",\"avg_credit\":\"-15.38\",\"month_summary\":[{\"month\":\"July of 2021\",\"transactions\":2},{\"month\":\"August of 2021\",\"transactions\":2}]}}],\"from\": {\"email\": \"vellonce@gmail.com\"},\"template_id\": \"\"}"
-					assert.Equal(t, body, string(request.Body))
-					return &rest.Response{
-						StatusCode: http.StatusAccepted,
-					}, nil
-				},
+			want: money(10055),
+		},
+		{
+			name: "should get a negative amount",
+			args: args{
+				amnt: "-100.55",
 			},
-			wantErr: false,
+			want: money(-10055),
 		},
 		{
-			name: "failure: returns an error if couldn't send an email",
+			name: "should get a positive amount without sign",
 			args: args{
-				data: templateData{
-					Email:          "test@email.com",
-					Name:           "test",
-					TotalBalance:   "34.74",
-					FirstMonthYear: "July 2021",
-					LastMonthYear:  "August 2021",
-					AvgDebit:       "35.25",
-					AvgCredit:      "-15.38",
-					MonthSummary: []monthOperation{
-						{
-							Month:        "July of 2021",
-							Transactions: 2,
-						},
-						{
-							Month:        "August of 2021",
-							Transactions: 2,
-						},
-					},
-				},
+				amnt: "100.5",
 			},
-			globals: globals{
-				sendgridGetRequest: func(key, endpoint, host string) rest.Request {
-					return rest.Request{}
-				},
-				sendgridAPI: func(request rest.Request) (*rest.Response, error) {
-					body := "{\"personalizations\": [{\"to\": [{\"email\": \"test@email.com\"}],\"dynamic_template_data\":{\"email\":\"test@email.com\",\"name\":\"test\",\"total_balance\":\"34.74\",\"first_month_year\":\"July 2021\",\"last_month_year\":\"August 2021\",\"avg_debit\":\"35.25\",\"avg_credit\":\"-15.38\",\"month_summary\":[{\"month\":\"July of 2021\",\"transactions\":2},{\"month\":\"August of 2021\",\"transactions\":2}]}}],\"from\": {\"email\": \"vellonce@gmail.com\"},\"template_id\": \"\"}"
-					assert.Equal(t, body, string(request.Body))
-					return &rest.Response{
-						StatusCode: http.StatusBadRequest,
-					}, errors.New("something bad happened")
-				},
+			want: money(10050),
+		},
+		{
+			name: "should round the amount half-even by default",
+			args: args{
+				amnt: "100.125",
 			},
-			wantErr: true,
+			want: money(10012),
 		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			sendgridAPI = tt.globals.sendgridAPI
-			sendgridGetRequest = tt.globals.sendgridGetRequest
-			c := calculator{}
-			if err := c.SendMail(tt.args.data); (err != nil) != tt.wantErr {
-				t.Errorf("SendMail() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
-	}
-}
-
-func Test_getAmount(t *testing.T) {
-	type args struct {
-		amnt string
-	}
-	tests := []struct {
-		name string
-		args args
-		want float64
-	}{
 		{
-			name: "should get a positive amount",
+			name: "should round the amount with the rounding mode",
 			args: args{
-				amnt: "+100.55",
+				amnt: "100.125",
+				mode: RoundHalfUp,
 			},
-			want: float64(100.55),
+			want: money(10013),
 		},
 		{
-			name: "should get a negative amount",
+			name: "should round the amount to the minor units of the currency",
 			args: args{
-				amnt: "-100.55",
+				amnt:     "100.5",
+				currency: "JPY",
+			},
+			want: money(100),
+		},
+		{
+			name: "should keep the three decimals of the currency",
+			args: args{
+				amnt:     "-1.125",
+				currency: "KWD",
 			},
-			want: float64(-100.55),
+			want: money(-1125),
+		},
+		{
+			name: "should return an error if the amount is not a number",
+			args: args{
+				amnt: "100,55",
+			},
+			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := getAmount(tt.args.amnt); got != tt.want {
+			got, err := getAmount(tt.args.amnt, tt.args.currency, tt.args.mode)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getAmount() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
 				t.Errorf("getAmount() = %v, want %v", got, tt.want)
 			}
 		})
@@ -247,29 +202,39 @@ func Test_getAmount(t *testing.T) {
 
 func Test_getAvg(t *testing.T) {
 	type args struct {
-		vals []float64
+		vals []money
+		mode RoundingMode
 	}
 	tests := []struct {
 		name string
 		args args
-		want float64
+		want money
 	}{
 		{
 			name: "must get the average of the values passed",
 			args: args{
-				vals: []float64{
-					float64(3),
-					float64(3.5),
-					float64(4),
-					float64(3.5),
-				},
+				vals: []money{300, 350, 400, 350},
+			},
+			want: money(350),
+		},
+		{
+			name: "must round the average to cents",
+			args: args{
+				vals: []money{100, 100, 101},
 			},
-			want: float64(3.5),
+			want: money(100),
+		},
+		{
+			name: "must return 0 if there are no values",
+			args: args{
+				vals: []money{},
+			},
+			want: money(0),
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := getAvg(tt.args.vals); got != tt.want {
+			if got := getAvg(tt.args.vals, tt.args.mode); got != tt.want {
 				t.Errorf("getAvg() = %v, want %v", got, tt.want)
 			}
 		})
@@ -292,9 +257,12 @@ func Test_getEmailTemplateData(t *testing.T) {
 			args: args{
 				filename: "user@mail.com.csv",
 				statement: statementSummary{
-					total:     50,
-					avgCredit: 35.5,
-					avgDebit:  -40.66,
+					total:     5000,
+					avgCredit: 3550,
+					avgDebit:  -4066,
+					opening:   1000,
+					closing:   6000,
+					lowest:    500,
 					monthSummary: map[string]int{
 						"2022-08": 3,
 						"2022-09": 5,
@@ -302,13 +270,16 @@ func Test_getEmailTemplateData(t *testing.T) {
 				},
 			},
 			want: templateData{
-				Email:          "user@mail.com",
-				Name:           "User",
-				TotalBalance:   "50.00",
-				FirstMonthYear: "August of 2022",
-				LastMonthYear:  "September of 2022",
-				AvgDebit:       "-40.66",
-				AvgCredit:      "35.50",
+				Email:           "user@mail.com",
+				Name:            "User",
+				TotalBalance:    "50.00",
+				PreviousBalance: "10.00",
+				NewBalance:      "60.00",
+				LowestBalance:   "5.00",
+				FirstMonthYear:  "August of 2022",
+				LastMonthYear:   "September of 2022",
+				AvgDebit:        "-40.66",
+				AvgCredit:       "35.50",
 				MonthSummary: []monthOperation{
 					{
 						Month:        "August of 2022",
@@ -327,9 +298,9 @@ func Test_getEmailTemplateData(t *testing.T) {
 			args: args{
 				filename: "user@mail.com.csv",
 				statement: statementSummary{
-					total:     50,
-					avgCredit: 35.5,
-					avgDebit:  -40.66,
+					total:     5000,
+					avgCredit: 3550,
+					avgDebit:  -4066,
 					monthSummary: map[string]int{
 						"2022-eee": 3,
 						"2022-09":  5,
@@ -339,6 +310,17 @@ func Test_getEmailTemplateData(t *testing.T) {
 			want:    templateData{},
 			wantErr: true,
 		},
+		{
+			name: "must return an error if the statement has no transactions",
+			args: args{
+				filename: "user@mail.com.csv",
+				statement: statementSummary{
+					monthSummary: map[string]int{},
+				},
+			},
+			want:    templateData{},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -398,9 +380,9 @@ func Test_humanizeMonth(t *testing.T) {
 	}
 }
 
-func Test_processFile(t *testing.T) {
+func Test_processStatement(t *testing.T) {
 	type args struct {
-		path string
+		contents string
 	}
 	tests := []struct {
 		name    string
@@ -408,18 +390,88 @@ func Test_processFile(t *testing.T) {
 		want    statementSummary
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{
+			name: "must summarize the statement",
+			args: args{
+				contents: "ID,Date,Transaction\n0,2021-07-15,+60.5\n1,2021-07-28,-10.5\n2,2021-08-02,-20.5\n3,2021-08-13,+10\n",
+			},
+			want: statementSummary{
+				total:     3950,
+				avgCredit: -1550,
+				avgDebit:  3525,
+				monthSummary: map[string]int{
+					"2021-07": 2,
+					"2021-08": 2,
+				},
+				currencies: map[string]*currencySummary{
+					"": {
+						credit:    []money{-1050, -2050},
+						debit:     []money{6050, 1000},
+						avgCredit: -1550,
+						avgDebit:  3525,
+					},
+				},
+				statementDate: time.Date(2021, 8, 13, 0, 0, 0, 0, time.UTC),
+				transactions: []transaction{
+					{id: "0", date: time.Date(2021, 7, 15, 0, 0, 0, 0, time.UTC), amount: 6050, reportedAmount: 6050},
+					{id: "1", date: time.Date(2021, 7, 28, 0, 0, 0, 0, time.UTC), amount: -1050, reportedAmount: -1050},
+					{id: "2", date: time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC), amount: -2050, reportedAmount: -2050},
+					{id: "3", date: time.Date(2021, 8, 13, 0, 0, 0, 0, time.UTC), amount: 1000, reportedAmount: 1000},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "must keep the rows that don't have 3 fields as issues",
+			args: args{
+				contents: "ID,Date,Transaction\n0,2021-07-15\n",
+			},
+			want: statementSummary{
+				monthSummary: map[string]int{},
+				currencies:   map[string]*currencySummary{},
+				issues: []rowError{
+					{line: 2, column: "Transaction", reason: "missing column"},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "must return an error if the header can't be read",
+			args: args{
+				contents: "\"ID,Date,Transaction\n",
+			},
+			want:    statementSummary{},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := processFile(tt.args.path)
+			got, err := processStatement("user@mail.com.csv", strings.NewReader(tt.args.contents), parseConfig{})
 			if (err != nil) != tt.wantErr {
-				t.Errorf("processFile() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("processStatement() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("processFile() got = %v, want %v", got, tt.want)
+				t.Errorf("processStatement() got = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func Test_calculator_Preview(t *testing.T) {
+	dir := t.TempDir()
+	filename := path.Join(dir, "user@mail.com.csv")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n1,2021-07-28,-10.3\n"), 0o600))
+	renderer, err := NewRenderer("Statement of {{first_month_year}}", "<p>{{name}}: {{total_balance}}</p>", "")
+	assert.NoError(t, err)
+
+	got, err := NewCalculator(WithRenderer(renderer)).Preview(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, RenderedEmail{Subject: "Statement of July of 2021", HTML: "<p>User: 50.20</p>"}, got)
+	// the statement is left where it was
+	_, err = os.Stat(filename)
+	assert.NoError(t, err)
+
+	_, err = NewCalculator().Preview(filename)
+	assert.EqualError(t, err, "no renderer configured")
+}
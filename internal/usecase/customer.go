@@ -0,0 +1,126 @@
+package usecase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrNoPDFPassword is returned for statements whose customer has no profile, or no value in the field the password
+// of the statement document is taken from. They are not sent, the document can't go unencrypted
+var ErrNoPDFPassword = errors.New("no password for the statement document")
+
+// CustomerProfile is what's known of a customer besides their statements
+type CustomerProfile struct {
+	AccountNumber string `json:"account_number"`
+	// BirthDate is in the YYYY-MM-DD format
+	BirthDate string `json:"birth_date"`
+	// CC get a copy of the emails of the customer, e.g. the joint holders of the account
+	CC []string `json:"cc,omitempty"`
+}
+
+// CustomerProfiles are the profiles of the customers by the email their statements are sent to
+type CustomerProfiles map[string]CustomerProfile
+
+// LoadCustomerProfiles reads the customers file, a JSON object with the profile of every recipient, e.g.:
+// {"user@mail.com": {"account_number": "0123456789", "birth_date": "1990-01-31"}}
+func LoadCustomerProfiles(path string) (CustomerProfiles, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	profiles := CustomerProfiles{}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("reading the customers file %s: %w", path, err)
+	}
+	// email addresses are compared without case
+	normalized := make(CustomerProfiles, len(profiles))
+	for email, profile := range profiles {
+		normalized[strings.ToLower(email)] = profile
+	}
+	return normalized, nil
+}
+
+// PasswordField is the field of the customer profile the password of the statement documents comes from
+type PasswordField int
+
+const (
+	// AccountNumberPassword is the account number, or its last digits
+	AccountNumberPassword PasswordField = iota
+	// BirthDatePassword is the birth date as DDMMYYYY
+	BirthDatePassword
+)
+
+var passwordFields = map[string]PasswordField{
+	"account-number": AccountNumberPassword,
+	"birth-date":     BirthDatePassword,
+}
+
+// ParsePasswordField returns the password field by name: account-number or birth-date. An empty name is
+// account-number
+func ParsePasswordField(name string) (PasswordField, error) {
+	if name == "" {
+		return AccountNumberPassword, nil
+	}
+	field, ok := passwordFields[strings.ToLower(name)]
+	if !ok {
+		return AccountNumberPassword, fmt.Errorf("unknown password field %q", name)
+	}
+	return field, nil
+}
+
+// PDFPassword tells how the password of the statement document of every customer is derived from their profile
+type PDFPassword struct {
+	Field PasswordField
+	// Digits is the number of last digits of the account number used, all of them when 0
+	Digits int
+	// Hint is told in the email so the customer knows the password, a description of the field when empty
+	Hint string
+}
+
+// password returns the password of the statement document of a customer
+func (p PDFPassword) password(profile CustomerProfile) (string, error) {
+	switch p.Field {
+	case BirthDatePassword:
+		if profile.BirthDate == "" {
+			return "", fmt.Errorf("%w: the customer has no birth date", ErrNoPDFPassword)
+		}
+		date, err := time.Parse("2006-01-02", profile.BirthDate)
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid birth date %q", ErrNoPDFPassword, profile.BirthDate)
+		}
+		return date.Format("02012006"), nil
+	default:
+		digits := strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, profile.AccountNumber)
+		if digits == "" || len(digits) < p.Digits {
+			return "", fmt.Errorf("%w: the customer has no account number with %d digits", ErrNoPDFPassword, p.Digits)
+		}
+		if p.Digits > 0 {
+			digits = digits[len(digits)-p.Digits:]
+		}
+		return digits, nil
+	}
+}
+
+// hint returns what the email tells the customer about the password
+func (p PDFPassword) hint() string {
+	switch {
+	case p.Hint != "":
+		return p.Hint
+	case p.Field == BirthDatePassword:
+		return "your birth date as DDMMYYYY"
+	case p.Digits > 0:
+		return fmt.Sprintf("the last %d digits of your account number", p.Digits)
+	default:
+		return "your account number"
+	}
+}
@@ -0,0 +1,100 @@
+package usecase
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadCustomerProfiles(t *testing.T) {
+	filename := path.Join(t.TempDir(), "customers.json")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(`{"User@Mail.com": {"account_number": "0123-4567-89", "birth_date": "1990-01-31"}}`), 0o600))
+
+	got, err := LoadCustomerProfiles(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, CustomerProfiles{"user@mail.com": {AccountNumber: "0123-4567-89", BirthDate: "1990-01-31"}}, got)
+
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(`[]`), 0o600))
+	_, err = LoadCustomerProfiles(filename)
+	assert.Error(t, err)
+}
+
+func TestParsePasswordField(t *testing.T) {
+	field, err := ParsePasswordField("")
+	assert.NoError(t, err)
+	assert.Equal(t, AccountNumberPassword, field)
+	field, err = ParsePasswordField("Birth-Date")
+	assert.NoError(t, err)
+	assert.Equal(t, BirthDatePassword, field)
+	_, err = ParsePasswordField("rfc")
+	assert.Error(t, err)
+}
+
+func TestPDFPassword_password(t *testing.T) {
+	profile := CustomerProfile{AccountNumber: "0123-4567-89", BirthDate: "1990-01-31"}
+	tests := []struct {
+		name     string
+		password PDFPassword
+		profile  CustomerProfile
+		want     string
+		wantHint string
+		wantErr  bool
+	}{
+		{
+			name:     "success: the whole account number",
+			profile:  profile,
+			want:     "0123456789",
+			wantHint: "your account number",
+		},
+		{
+			name:     "success: the last digits of the account number",
+			password: PDFPassword{Digits: 4},
+			profile:  profile,
+			want:     "6789",
+			wantHint: "the last 4 digits of your account number",
+		},
+		{
+			name:     "success: the birth date",
+			password: PDFPassword{Field: BirthDatePassword, Hint: "your date of birth, e.g. 31011990"},
+			profile:  profile,
+			want:     "31011990",
+			wantHint: "your date of birth, e.g. 31011990",
+		},
+		{
+			name:     "failure: an account number shorter than the digits",
+			password: PDFPassword{Digits: 4},
+			profile:  CustomerProfile{AccountNumber: "12"},
+			wantErr:  true,
+		},
+		{
+			name:     "failure: no birth date",
+			password: PDFPassword{Field: BirthDatePassword},
+			profile:  CustomerProfile{AccountNumber: "0123"},
+			wantErr:  true,
+		},
+		{
+			name:     "failure: invalid birth date",
+			password: PDFPassword{Field: BirthDatePassword},
+			profile:  CustomerProfile{BirthDate: "31/01/1990"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.password.password(tt.profile)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("password() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrNoPDFPassword), err)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantHint, tt.password.hint())
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package usecase
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// deadLetterBucket is the bbolt bucket with the emails that couldn't be delivered, keyed by their ID
+var deadLetterBucket = []byte("deadletters")
+
+// maxDeliveryAttempts is the number of times an email of the outbox is sent before it's given up
+const maxDeliveryAttempts = 10
+
+// ErrDeadLetterNotFound is returned for the IDs of dead letters that don't exist
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is an email that couldn't be delivered: rejected by the email provider, or failing for
+// maxDeliveryAttempts attempts. It's kept until it's replayed or discarded
+type DeadLetter struct {
+	ID        uint64 `json:"id"`
+	Recipient string `json:"recipient"`
+	// Class groups the dead letters by the kind of error, e.g. sendgrid-400, smtp-550, permanent or temporary
+	Class    string    `json:"class"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+	// Email is the email as it was rendered, nil when it couldn't be rendered
+	Email *RenderedEmail `json:"email,omitempty"`
+	// Message is the email as it was in the outbox, replaying it puts it back
+	Message outboxMessage `json:"message"`
+}
+
+// errorClass returns the class of the error of a dead letter
+func errorClass(err error) string {
+	var (
+		sgErr   *SendGridError
+		smtpErr *SMTPError
+	)
+	switch {
+	case errors.As(err, &sgErr):
+		return fmt.Sprintf("sendgrid-%d", sgErr.StatusCode)
+	case errors.As(err, &smtpErr):
+		return fmt.Sprintf("smtp-%d", smtpErr.Code)
+	case errors.Is(err, ErrPermanentDelivery):
+		return "permanent"
+	default:
+		return "temporary"
+	}
+}
+
+// DeadLetters returns the dead letters of a class, all of them when class is empty, oldest first
+func (l *Ledger) DeadLetters(class string) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := l.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(deadLetterBucket).ForEach(func(k, v []byte) error {
+			var letter DeadLetter
+			if err := json.Unmarshal(v, &letter); err != nil {
+				return fmt.Errorf("dead letter %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			if class == "" || letter.Class == class {
+				letters = append(letters, letter)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+	return letters, nil
+}
+
+// DeadLetter returns a dead letter by ID
+func (l *Ledger) DeadLetter(id uint64) (DeadLetter, error) {
+	var letter DeadLetter
+	err := l.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		letter, err = getDeadLetter(tx, id)
+		return err
+	})
+	if err != nil {
+		return DeadLetter{}, fmt.Errorf("dead letters: %w", err)
+	}
+	return letter, nil
+}
+
+// Replay puts a dead letter back in the outbox with no attempts, the next Dispatch sends it. Statements sent or
+// waiting in the outbox since are not replayed
+func (l *Ledger) Replay(id uint64) error {
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		letter, err := getDeadLetter(tx, id)
+		if err != nil {
+			return err
+		}
+		key := []byte(letter.Message.Key)
+		entry, err := getEntry(tx, key)
+		if err != nil {
+			return err
+		}
+		if entry.State == stateSent {
+			return fmt.Errorf("the statement of dead letter %d was already sent", id)
+		}
+		if tx.Bucket(outboxBucket).Get(key) != nil {
+			return fmt.Errorf("the statement of dead letter %d is already waiting in the outbox", id)
+		}
+		now := time.Now()
+		msg := letter.Message
+		msg.Attempts, msg.LastError, msg.NextAttempt = 0, "", now
+		entry.State, entry.Error, entry.UpdatedAt = stateRendered, "", now
+		if err := putJSON(tx.Bucket(outboxBucket), key, msg); err != nil {
+			return err
+		}
+		if err := putJSON(tx.Bucket(ledgerBucket), key, entry); err != nil {
+			return err
+		}
+		return tx.Bucket(deadLetterBucket).Delete(deadLetterKey(id))
+	})
+	if err != nil {
+		return fmt.Errorf("dead letters: %w", err)
+	}
+	return nil
+}
+
+// Discard deletes a dead letter, its statement stays failed in the ledger
+func (l *Ledger) Discard(id uint64) error {
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		if _, err := getDeadLetter(tx, id); err != nil {
+			return err
+		}
+		return tx.Bucket(deadLetterBucket).Delete(deadLetterKey(id))
+	})
+	if err != nil {
+		return fmt.Errorf("dead letters: %w", err)
+	}
+	return nil
+}
+
+func getDeadLetter(tx *bbolt.Tx, id uint64) (DeadLetter, error) {
+	data := tx.Bucket(deadLetterBucket).Get(deadLetterKey(id))
+	if data == nil {
+		return DeadLetter{}, fmt.Errorf("%w: %d", ErrDeadLetterNotFound, id)
+	}
+	var letter DeadLetter
+	err := json.Unmarshal(data, &letter)
+	return letter, err
+}
+
+// deadLetterKey is the key of a dead letter, big endian so they're kept in the order they failed
+func deadLetterKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
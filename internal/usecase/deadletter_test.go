@@ -0,0 +1,133 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_errorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: &SendGridError{StatusCode: http.StatusBadRequest}, want: "sendgrid-400"},
+		{err: fmt.Errorf("sending: %w", &SMTPError{Code: 550}), want: "smtp-550"},
+		{err: fmt.Errorf("%w: rendering the email", ErrPermanentDelivery), want: "permanent"},
+		{err: errors.New("connection reset by peer"), want: "temporary"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, errorClass(tt.err), tt.err.Error())
+	}
+}
+
+func Test_calculator_Dispatch_deadLetters(t *testing.T) {
+	dir := t.TempDir()
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "user@mail.com.csv"), []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n"), 0o600))
+	renderer, err := NewRenderer("Statement of {{first_month_year}}", "<p>{{name}}</p>", "")
+	assert.NoError(t, err)
+	rejected := &SendGridError{
+		StatusCode: http.StatusBadRequest,
+		Errors:     []SendGridErrorDetail{{Message: "Does not contain a valid address.", Field: "personalizations.0.to.0.email"}},
+	}
+	mailer := &recordingMailer{err: rejected}
+	c := NewCalculator(WithDirPath(dir), WithLedger(ledger), WithMailer(mailer), WithRenderer(renderer))
+
+	c.Run()
+	c.Dispatch()
+
+	letters, err := ledger.DeadLetters("")
+	assert.NoError(t, err)
+	if !assert.Len(t, letters, 1) {
+		return
+	}
+	letter := letters[0]
+	assert.Equal(t, uint64(1), letter.ID)
+	assert.Equal(t, "user@mail.com", letter.Recipient)
+	assert.Equal(t, "sendgrid-400", letter.Class)
+	assert.Equal(t, rejected.Error(), letter.Error)
+	assert.Equal(t, 1, letter.Attempts)
+	if assert.NotNil(t, letter.Email) {
+		assert.Equal(t, "Statement of July of 2021", letter.Email.Subject)
+		assert.Equal(t, "<p>User</p>", letter.Email.HTML)
+	}
+	letters, err = ledger.DeadLetters("sendgrid-429")
+	assert.NoError(t, err)
+	assert.Empty(t, letters)
+
+	// replayed, the email goes back to the outbox and is sent by the next dispatch
+	assert.NoError(t, ledger.Replay(letter.ID))
+	_, err = ledger.DeadLetter(letter.ID)
+	assert.True(t, errors.Is(err, ErrDeadLetterNotFound), err)
+	mailer.err, mailer.messageID = nil, "abc"
+	c.Dispatch()
+	entry := ledgerEntryByKey(t, ledger, letter.Message.Key)
+	assert.Equal(t, stateSent, entry.State)
+	assert.Equal(t, "abc", entry.MessageID)
+	assert.Len(t, mailer.sent, 1)
+	assert.True(t, errors.Is(ledger.Replay(letter.ID), ErrDeadLetterNotFound))
+}
+
+func Test_calculator_Dispatch_maxDeliveryAttempts(t *testing.T) {
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	entry := &ledgerEntry{Recipient: "user@mail.com", Period: "2021-07/2021-07", Hash: "abc"}
+	assert.NoError(t, ledger.enqueue(entry, testEnvelope, templateData{Email: "user@mail.com"}, nil))
+	c := NewCalculator(WithLedger(ledger), WithMailer(&recordingMailer{err: errors.New("connection reset by peer")})).(*calculator)
+
+	for attempt := 1; attempt <= maxDeliveryAttempts; attempt++ {
+		messages, err := ledger.pending(time.Now().Add(maxRetryDelay))
+		assert.NoError(t, err)
+		if !assert.Len(t, messages, 1, "attempt %d", attempt) {
+			return
+		}
+		c.settle(messages[0], "", errors.New("connection reset by peer"))
+	}
+
+	messages, err := ledger.pending(time.Now().Add(maxRetryDelay))
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+	letters, err := ledger.DeadLetters("temporary")
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, maxDeliveryAttempts, letters[0].Attempts)
+		assert.Nil(t, letters[0].Email)
+	}
+}
+
+func TestLedger_Replay(t *testing.T) {
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	entry := &ledgerEntry{Recipient: "user@mail.com", Period: "2021-07/2021-07", Hash: "abc"}
+	assert.NoError(t, ledger.enqueue(entry, testEnvelope, templateData{Email: "user@mail.com"}, nil))
+	messages, err := ledger.pending(time.Now())
+	assert.NoError(t, err)
+	_, err = ledger.abandon(messages[0], ErrPermanentDelivery, nil)
+	assert.NoError(t, err)
+
+	// the statement was queued again by a later run
+	assert.NoError(t, ledger.enqueue(entry, testEnvelope, templateData{Email: "user@mail.com"}, nil))
+	assert.EqualError(t, ledger.Replay(1), "dead letters: the statement of dead letter 1 is already waiting in the outbox")
+	messages, err = ledger.pending(time.Now())
+	assert.NoError(t, err)
+	_, err = ledger.delivered(messages[0], "abc")
+	assert.NoError(t, err)
+	assert.EqualError(t, ledger.Replay(1), "dead letters: the statement of dead letter 1 was already sent")
+
+	assert.NoError(t, ledger.Discard(1))
+	letters, err := ledger.DeadLetters("")
+	assert.NoError(t, err)
+	assert.Empty(t, letters)
+	assert.True(t, errors.Is(ledger.Discard(1), ErrDeadLetterNotFound))
+}
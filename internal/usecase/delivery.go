@@ -0,0 +1,199 @@
+package usecase
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// deliveryBucket is the bbolt bucket with what the email provider reported about the email of every statement,
+// keyed like the ledger
+var deliveryBucket = []byte("deliveries")
+
+// maxDeliveryEvents is the number of events kept per statement, the oldest ones are dropped, e.g. repeated opens
+const maxDeliveryEvents = 50
+
+// eventRanks tells how significant the events are, the status of a delivery is its most significant event.
+// Events arrive out of order: a late processed doesn't hide a delivered. Other events don't change the status
+var eventRanks = map[string]int{
+	"processed":   1,
+	"deferred":    2,
+	"delivered":   3,
+	"bounce":      3,
+	"dropped":     3,
+	"open":        4,
+	"click":       5,
+	"spamreport":  6,
+	"unsubscribe": 6,
+}
+
+// DeliveryEvent is an event of the email of a statement reported by the email provider
+type DeliveryEvent struct {
+	// Event is the kind of event: processed, deferred, delivered, bounce, dropped, open, click, spamreport...
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	// Reason explains bounces, drops and deferrals, it's the reply of the receiving server for deliveries
+	Reason    string `json:"reason,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	// ID identifies the event, an event reported twice is recorded once
+	ID string `json:"id,omitempty"`
+}
+
+// DeliveryStatus is what the email provider reported about the email of a statement
+type DeliveryStatus struct {
+	Recipient string `json:"recipient"`
+	// Status is the most significant event, e.g. delivered, bounce or open
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	// Delivered tells if the email reached the mailbox of the customer
+	Delivered bool            `json:"delivered"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Events    []DeliveryEvent `json:"events"`
+}
+
+// add records an event and updates the status, it returns false for events already recorded
+func (s *DeliveryStatus) add(event DeliveryEvent) bool {
+	for _, e := range s.Events {
+		if event.ID != "" && e.ID == event.ID {
+			return false
+		}
+	}
+	s.Events = append(s.Events, event)
+	sort.SliceStable(s.Events, func(i, j int) bool { return s.Events[i].Timestamp.Before(s.Events[j].Timestamp) })
+	if len(s.Events) > maxDeliveryEvents {
+		s.Events = s.Events[len(s.Events)-maxDeliveryEvents:]
+	}
+	var top *DeliveryEvent
+	for i, e := range s.Events {
+		// the latest of the most significant events
+		if rank := eventRanks[e.Event]; rank > 0 && (top == nil || rank >= eventRanks[top.Event]) {
+			top = &s.Events[i]
+		}
+	}
+	if top != nil {
+		s.Status, s.Reason = top.Event, top.Reason
+		s.Delivered = eventRanks[top.Event] >= eventRanks["delivered"] && top.Event != "bounce" && top.Event != "dropped"
+	}
+	s.UpdatedAt = time.Now()
+	return true
+}
+
+// statementEvent is an event about the email of the statement with the key given
+type statementEvent struct {
+	Statement string
+	Recipient string
+	// Suppress is the reason to add the address of the event to the suppression list, empty when it's not added
+	Suppress string
+	DeliveryEvent
+}
+
+// recordEvents saves the events of the emails of statements. Events of statements the ledger doesn't have are
+// ignored, e.g. of emails sent by something else with the same account, and so are the events of the copies. Bounces,
+// spam reports and unsubscribes add their address to the suppression list. It returns how many events were
+// recorded and how many were ignored
+func (l *Ledger) recordEvents(events []statementEvent) (recorded, ignored int, err error) {
+	err = l.db.Update(func(tx *bbolt.Tx) error {
+		recorded, ignored = 0, 0
+		bucket := tx.Bucket(deliveryBucket)
+		for _, event := range events {
+			key := []byte(event.Statement)
+			entry, err := getEntry(tx, key)
+			if event.Statement == "" || err != nil {
+				ignored++
+				continue
+			}
+			// copies bounce too, their address is suppressed as well. The first suppression of an address is kept
+			if event.Suppress != "" && tx.Bucket(suppressionBucket).Get([]byte(strings.ToLower(event.Recipient))) == nil {
+				err := putSuppression(tx, Suppression{
+					Email:     event.Recipient,
+					Reason:    event.Suppress,
+					Detail:    event.Reason,
+					CreatedAt: event.Timestamp,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			// the copies of the email come with the same statement, only the customer's events are recorded
+			if !strings.EqualFold(entry.Recipient, event.Recipient) {
+				ignored++
+				continue
+			}
+			status := DeliveryStatus{Recipient: entry.Recipient}
+			if data := bucket.Get(key); data != nil {
+				if err := json.Unmarshal(data, &status); err != nil {
+					return fmt.Errorf("statement %s: %w", key, err)
+				}
+			}
+			if !status.add(event.DeliveryEvent) {
+				continue
+			}
+			if err := putJSON(bucket, key, status); err != nil {
+				return err
+			}
+			recorded++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("deliveries: %w", err)
+	}
+	return recorded, ignored, nil
+}
+
+// StatementDelivery tells if a customer got a statement: how far the processing of the statement got and what the
+// email provider reported about its email
+type StatementDelivery struct {
+	Statement string `json:"statement"`
+	Period    string `json:"period"`
+	File      string `json:"file"`
+	// State is the state of the statement in the ledger: parsed, rendered, sent, failed or suppressed
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Delivery is nil until the email provider reports an event of the email
+	Delivery *DeliveryStatus `json:"delivery,omitempty"`
+}
+
+// Deliveries returns the statements of a recipient with their delivery status, the latest period first
+func (l *Ledger) Deliveries(recipient string) ([]StatementDelivery, error) {
+	var deliveries []StatementDelivery
+	err := l.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(ledgerBucket).ForEach(func(k, v []byte) error {
+			var entry ledgerEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("statement %s: %w", k, err)
+			}
+			if !strings.EqualFold(entry.Recipient, recipient) {
+				return nil
+			}
+			delivery := StatementDelivery{
+				Statement: string(k),
+				Period:    entry.Period,
+				File:      entry.File,
+				State:     string(entry.State),
+				Error:     entry.Error,
+				MessageID: entry.MessageID,
+				UpdatedAt: entry.UpdatedAt,
+			}
+			if data := tx.Bucket(deliveryBucket).Get(k); data != nil {
+				delivery.Delivery = &DeliveryStatus{}
+				if err := json.Unmarshal(data, delivery.Delivery); err != nil {
+					return fmt.Errorf("statement %s: %w", k, err)
+				}
+			}
+			deliveries = append(deliveries, delivery)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("deliveries: %w", err)
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool { return deliveries[i].Period > deliveries[j].Period })
+	return deliveries, nil
+}
@@ -0,0 +1,108 @@
+package usecase
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fxRate is the rate of a currency pair since a date
+type fxRate struct {
+	date time.Time
+	rate *big.Rat
+}
+
+// FXRates is a table of exchange rates by date. Each rate is valid from its date until the next rate of the same pair
+type FXRates struct {
+	// rates by pair (e.g. USD/MXN), sorted by date
+	rates map[string][]fxRate
+}
+
+// LoadFXRates reads a rate table from a CSV file with the columns date (YYYY-MM-DD), from, to and rate, where
+// rate is the amount of the "to" currency one unit of the "from" currency is worth. The first row is the header
+func LoadFXRates(path string) (*FXRates, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readFXRates(file)
+}
+
+func readFXRates(r io.Reader) (*FXRates, error) {
+	table := &FXRates{rates: map[string][]fxRate{}}
+	parser := csv.NewReader(r)
+	parser.FieldsPerRecord = 4
+	firstLine := true
+	for {
+		record, err := parser.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fx rates: %w", err)
+		}
+		// skip the first line (line with headers) of CSV
+		if firstLine {
+			firstLine = false
+			continue
+		}
+		line, _ := parser.FieldPos(0)
+		date, err := time.Parse("2006-01-02", strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, fmt.Errorf("fx rates: line %d: %w", line, err)
+		}
+		rate, ok := new(big.Rat).SetString(strings.TrimSpace(record[3]))
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("fx rates: line %d: invalid rate %q", line, record[3])
+		}
+		pair := fxPair(record[1], record[2])
+		table.rates[pair] = append(table.rates[pair], fxRate{date: date, rate: rate})
+	}
+	for _, rates := range table.rates {
+		sort.Slice(rates, func(i, j int) bool { return rates[i].date.Before(rates[j].date) })
+	}
+	return table, nil
+}
+
+// rate returns the rate to convert from one currency to another on a date. The inverse rate is used
+// when the table only has the opposite pair
+func (t *FXRates) rate(from, to string, date time.Time) (*big.Rat, error) {
+	if from == to {
+		return big.NewRat(1, 1), nil
+	}
+	if t != nil {
+		if rate := latestRate(t.rates[fxPair(from, to)], date); rate != nil {
+			return rate, nil
+		}
+		if rate := latestRate(t.rates[fxPair(to, from)], date); rate != nil {
+			return new(big.Rat).Inv(rate), nil
+		}
+	}
+	return nil, fmt.Errorf("no exchange rate from %s to %s on %s", from, to, date.Format("2006-01-02"))
+}
+
+// latestRate returns the last rate on or before date, nil if there's none
+func latestRate(rates []fxRate, date time.Time) *big.Rat {
+	i := sort.Search(len(rates), func(i int) bool { return rates[i].date.After(date) })
+	if i == 0 {
+		return nil
+	}
+	return rates[i-1].rate
+}
+
+func fxPair(from, to string) string {
+	return strings.ToUpper(strings.TrimSpace(from)) + "/" + strings.ToUpper(strings.TrimSpace(to))
+}
+
+// convert converts an amount of a currency to another with an exchange rate, rounding the result to minor units
+// of the other currency. The rate of amounts without currency is 1, they only change their decimals
+func (m money) convert(from, to string, rate *big.Rat, mode RoundingMode) (money, error) {
+	amount := new(big.Rat).SetFrac(new(big.Int).Mul(big.NewInt(int64(m)), minorUnits(to)), minorUnits(from))
+	return roundRat(amount.Mul(amount, rate), mode)
+}
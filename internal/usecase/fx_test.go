@@ -0,0 +1,85 @@
+package usecase
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fxTable = `date,from,to,rate
+2021-07-01,USD,MXN,20.10
+2021-08-01,USD,MXN,19.95
+2021-08-01,MXN,EUR,0.0425
+`
+
+func TestFXRates_rate(t *testing.T) {
+	rates, err := readFXRates(strings.NewReader(fxTable))
+	assert.NoError(t, err)
+	tests := []struct {
+		name     string
+		from, to string
+		date     time.Time
+		want     *big.Rat
+		wantErr  bool
+	}{
+		{name: "same currency", from: "MXN", to: "MXN", date: time.Now(), want: big.NewRat(1, 1)},
+		{name: "rate of the date", from: "USD", to: "MXN", date: time.Date(2021, 7, 31, 0, 0, 0, 0, time.UTC), want: big.NewRat(2010, 100)},
+		{name: "latest rate", from: "USD", to: "MXN", date: time.Date(2021, 8, 31, 0, 0, 0, 0, time.UTC), want: big.NewRat(1995, 100)},
+		{name: "inverse rate", from: "EUR", to: "MXN", date: time.Date(2021, 8, 31, 0, 0, 0, 0, time.UTC), want: big.NewRat(10000, 425)},
+		{name: "no rate before the date", from: "USD", to: "MXN", date: time.Date(2021, 6, 30, 0, 0, 0, 0, time.UTC), wantErr: true},
+		{name: "unknown pair", from: "JPY", to: "MXN", date: time.Date(2021, 8, 31, 0, 0, 0, 0, time.UTC), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rates.rate(tt.from, tt.to, tt.date)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("rate() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				assert.Equal(t, 0, tt.want.Cmp(got), "got %s", got)
+			}
+		})
+	}
+}
+
+func Test_readFXRates_invalidRate(t *testing.T) {
+	_, err := readFXRates(strings.NewReader("date,from,to,rate\n2021-07-01,USD,MXN,-1\n"))
+	assert.EqualError(t, err, `fx rates: line 2: invalid rate "-1"`)
+}
+
+func Test_statementSummary_toReportingCurrency(t *testing.T) {
+	rates, err := readFXRates(strings.NewReader(fxTable))
+	assert.NoError(t, err)
+	contents := "ID,Date,Transaction,Currency\n" +
+		"0,2021-08-01,+100.00,\n" +
+		"1,2021-08-02,-10.00,USD\n" +
+		"2,2021-08-03,+20.00,MXN\n"
+	cfg := parseConfig{csv: CSVMapping{ID: "ID", Date: "Date", Amount: "Transaction", Currency: "Currency"}}
+
+	summary, err := processStatement("user@mail.com.csv", strings.NewReader(contents), cfg)
+	assert.NoError(t, err)
+	_, err = summary.toReportingCurrency("", rates, RoundHalfEven)
+	assert.Error(t, err, "a statement with several currencies needs a reporting currency")
+
+	summary, err = processStatement("user@mail.com.csv", strings.NewReader(contents), cfg)
+	assert.NoError(t, err)
+	got, err := summary.toReportingCurrency("MXN", rates, RoundHalfEven)
+	assert.NoError(t, err)
+	assert.Equal(t, "MXN", got.currency)
+	// 100 + 20 MXN - 10 USD * 19.95
+	assert.Equal(t, money(-7950), got.total)
+	assert.Equal(t, money(-19950), got.avgCredit)
+	assert.Equal(t, money(6000), got.avgDebit)
+
+	tpl, err := getEmailTemplateData("user@mail.com.csv", got)
+	assert.NoError(t, err)
+	assert.Equal(t, "MXN", tpl.Currency)
+	assert.Equal(t, []currencyOperation{
+		{Currency: "MXN", Total: "120.00", AvgDebit: "60.00", AvgCredit: "0.00", Transactions: 2, Rate: "1.000000"},
+		{Currency: "USD", Total: "-10.00", AvgDebit: "0.00", AvgCredit: "-10.00", Transactions: 1, Rate: "19.950000"},
+	}, tpl.CurrencySummary)
+}
@@ -1,6 +1,53 @@
 package usecase
 
+import "io"
+
 type Calculator interface {
+	// Run reads the statements of every source and writes their emails to the outbox
 	Run()
-	SendMail(data templateData) error
+	// Dispatch delivers the emails waiting in the outbox
+	Dispatch()
+	// Preview renders the email of a statement file without sending it
+	Preview(filename string) (RenderedEmail, error)
+}
+
+// Mailer delivers the email of a statement. Errors matching ErrPermanentDelivery are not retried, errors
+// implementing DelayedError are retried after the delay they ask for
+type Mailer interface {
+	// Send delivers the email to the recipient of data, with the addresses of envelope and the attachments. It
+	// returns the ID the email provider gave to it, if any
+	Send(envelope Envelope, data templateData, attachments ...Attachment) (messageID string, err error)
+}
+
+// BatchMailer is a Mailer that can send several emails with one request to the email provider
+type BatchMailer interface {
+	Mailer
+	// SendBatch sends the emails and returns the result of each one, in their order
+	SendBatch(emails []Email) []SendResult
+}
+
+// AlternativeChannel delivers the statements of suppressed recipients by other means than email, e.g. by post
+type AlternativeChannel interface {
+	Deliver(statement SuppressedStatement) error
+}
+
+// StatementSource is a backend the calculator reads statements from
+type StatementSource interface {
+	// Name identifies the source in logs and in the StatementRef it lists
+	Name() string
+	// List returns the statements that are ready to be processed
+	List() ([]StatementRef, error)
+	// Open returns the contents of a listed statement
+	Open(ref StatementRef) (io.ReadCloser, error)
+	// Ack acknowledges that a statement was processed and delivered, so it's not listed again
+	Ack(ref StatementRef) error
+	// Reject sets aside a statement that can't be parsed or delivered, so it's not listed again. reason tells why
+	Reject(ref StatementRef, reason error) error
+}
+
+// balanceStore keeps the closing balance of each account, so the next statement can start from it
+type balanceStore interface {
+	// closingBalance returns the last saved closing balance of the account, nil if there's none
+	closingBalance(account string) (*balance, error)
+	saveClosingBalance(account string, b balance) error
 }
@@ -0,0 +1,181 @@
+package usecase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// ledgerBucket is the bbolt bucket with the ledger entries, keyed by ledgerKey
+var ledgerBucket = []byte("statements")
+
+// ledgerBuckets are every bucket of the ledger database, OpenLedger creates them
+var ledgerBuckets = [][]byte{ledgerBucket, outboxBucket, deadLetterBucket, deliveryBucket, suppressionBucket}
+
+// ErrLedgerInUse is returned when another process, e.g. the service, has the ledger open
+var ErrLedgerInUse = errors.New("in use by another process")
+
+// ledgerState is the processing state of a statement
+type ledgerState string
+
+const (
+	stateParsed   ledgerState = "parsed"
+	stateRendered ledgerState = "rendered"
+	stateSent     ledgerState = "sent"
+	stateFailed   ledgerState = "failed"
+	// stateSuppressed statements are not emailed, their recipient is in the suppression list
+	stateSuppressed ledgerState = "suppressed"
+)
+
+// ledgerEntry records how far the processing of a statement got
+type ledgerEntry struct {
+	Recipient string      `json:"recipient"`
+	Period    string      `json:"period"`
+	Hash      string      `json:"hash"`
+	Source    string      `json:"source"`
+	File      string      `json:"file"`
+	State     ledgerState `json:"state"`
+	// Error is the reason of the last failure
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts"`
+	// MessageID is the ID the email provider gave to the email of the statement
+	MessageID string    `json:"message_id,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// key identifies the statement by recipient, period and contents, so the same statement is recognized even
+// if it's renamed or comes back from the quarantine
+func (e ledgerEntry) key() []byte {
+	return []byte(strings.Join([]string{e.Recipient, e.Period, e.Hash}, "|"))
+}
+
+// Ledger is a persistent record of the statements processed and their state, kept in an embedded bbolt
+// database. Statements it has as sent are not sent again. The same database holds the outbox of the emails
+// waiting to be delivered and the dead letters of the emails that couldn't be
+type Ledger struct {
+	db *bbolt.DB
+}
+
+// OpenLedger opens the ledger database, creating it if it doesn't exist. The database is locked while it's open,
+// a second process using the same file waits up to a second and fails
+func OpenLedger(filename string) (*Ledger, error) {
+	if err := os.MkdirAll(path.Dir(filename), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := openLedgerDB(filename, false)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range ledgerBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ledger: %w", err)
+	}
+	return &Ledger{db: db}, nil
+}
+
+// OpenLedgerReadOnly opens an existing ledger database to read it, e.g. to list the dead letters. Other read-only
+// processes can open it at the same time, the service can't
+func OpenLedgerReadOnly(filename string) (*Ledger, error) {
+	db, err := openLedgerDB(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		for _, bucket := range ledgerBuckets {
+			if tx.Bucket(bucket) == nil {
+				return fmt.Errorf("%s has no %s, it's created when the service opens the ledger", filename, bucket)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ledger: %w", err)
+	}
+	return &Ledger{db: db}, nil
+}
+
+func openLedgerDB(filename string, readOnly bool) (*bbolt.DB, error) {
+	db, err := bbolt.Open(filename, 0o600, &bbolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		return nil, fmt.Errorf("ledger: %s is %w, e.g. the service", filename, ErrLedgerInUse)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ledger: %w", err)
+	}
+	return db, nil
+}
+
+// Close closes the ledger database
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
+
+// lookup returns the entry of a statement, nil if the statement was never processed or there's no ledger
+func (l *Ledger) lookup(e ledgerEntry) (*ledgerEntry, error) {
+	if l == nil {
+		return nil, nil
+	}
+	var found *ledgerEntry
+	err := l.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(ledgerBucket).Get(e.key())
+		if data == nil {
+			return nil
+		}
+		found = &ledgerEntry{}
+		return json.Unmarshal(data, found)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ledger: %w", err)
+	}
+	return found, nil
+}
+
+// record saves the state of a statement, a failure keeps the reason. It's a no-op without a ledger
+func (l *Ledger) record(e *ledgerEntry, state ledgerState, reason error) error {
+	if l == nil {
+		return nil
+	}
+	e.State, e.Error, e.UpdatedAt = state, "", time.Now()
+	if state == stateParsed {
+		e.Attempts++
+	}
+	if reason != nil {
+		e.Error = reason.Error()
+	}
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		return putJSON(tx.Bucket(ledgerBucket), e.key(), e)
+	})
+	if err != nil {
+		return fmt.Errorf("ledger: %w", err)
+	}
+	return nil
+}
+
+// statementPeriod returns the months a statement covers, e.g.: 2021-07/2021-08
+func statementPeriod(s statementSummary) string {
+	months := make([]string, 0, len(s.monthSummary))
+	for month := range s.monthSummary {
+		months = append(months, month)
+	}
+	if len(months) == 0 {
+		return s.statementDate.Format("2006-01")
+	}
+	sort.Strings(months)
+	return months[0] + "/" + months[len(months)-1]
+}
@@ -0,0 +1,79 @@
+package usecase
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedger_record(t *testing.T) {
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "data", "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+
+	entry := &ledgerEntry{Recipient: "user@mail.com", Period: "2021-07/2021-08", Hash: "abc", Source: "default", File: "user@mail.com.csv"}
+	got, err := ledger.lookup(*entry)
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	assert.NoError(t, ledger.record(entry, stateParsed, nil))
+	assert.NoError(t, ledger.record(entry, stateFailed, errors.New("something bad happened")))
+	got, err = ledger.lookup(*entry)
+	assert.NoError(t, err)
+	assert.Equal(t, stateFailed, got.State)
+	assert.Equal(t, "something bad happened", got.Error)
+	assert.Equal(t, 1, got.Attempts)
+
+	assert.NoError(t, ledger.record(entry, stateParsed, nil))
+	assert.NoError(t, ledger.record(entry, stateSent, nil))
+	got, err = ledger.lookup(*entry)
+	assert.NoError(t, err)
+	assert.Equal(t, stateSent, got.State)
+	assert.Empty(t, got.Error)
+	assert.Equal(t, 2, got.Attempts)
+
+	// a statement of another period is a different entry
+	other := ledgerEntry{Recipient: "user@mail.com", Period: "2021-09/2021-09", Hash: "abc"}
+	got, err = ledger.lookup(other)
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestLedger_nil(t *testing.T) {
+	var ledger *Ledger
+	got, err := ledger.lookup(ledgerEntry{})
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+	assert.NoError(t, ledger.record(&ledgerEntry{}, stateSent, nil))
+}
+
+func Test_calculator_Run_skipsSentStatements(t *testing.T) {
+	dir := t.TempDir()
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	mailer := &recordingMailer{}
+
+	c := NewCalculator(WithDirPath(dir), WithLedger(ledger), WithMailer(mailer))
+	// the statement comes back, e.g. after a crash between sending it and archiving it
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "user@mail.com.csv"), []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n"), 0o600))
+		c.Run()
+		c.Dispatch()
+	}
+
+	assert.Len(t, mailer.sent, 1)
+	now := time.Now()
+	archived, err := ioutil.ReadDir(path.Join(dir, "archive", now.Format("2006"), now.Format("01")))
+	assert.NoError(t, err)
+	assert.Len(t, archived, 2)
+}
+
+func Test_statementPeriod(t *testing.T) {
+	assert.Equal(t, "2021-07/2021-08", statementPeriod(statementSummary{monthSummary: map[string]int{"2021-08": 1, "2021-07": 2}}))
+	assert.Equal(t, "2021-08", statementPeriod(statementSummary{statementDate: time.Date(2021, 8, 31, 0, 0, 0, 0, time.UTC)}))
+}
@@ -0,0 +1,116 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrPermanentDelivery is matched by the errors of emails the email provider won't accept however many times
+// they are sent, e.g. an invalid API key or an invalid recipient
+var ErrPermanentDelivery = errors.New("permanent delivery failure")
+
+// DelayedError is a delivery error that asks to wait before sending the email again
+type DelayedError interface {
+	error
+	Delay() time.Duration
+}
+
+// Attachment is a file attached to an email
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"`
+}
+
+// Address is an email address with an optional display name
+type Address struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+// String returns the address as in an email header, e.g.: "Statements" <statements@bank.com>
+func (a Address) String() string {
+	return (&mail.Address{Name: a.Name, Address: a.Email}).String()
+}
+
+// Sender is who the emails of a source are sent from
+type Sender struct {
+	From Address
+	// ReplyTo is where the replies go, From when it's empty
+	ReplyTo Address
+	// BCC get a blind copy of every email, e.g. for compliance
+	BCC []Address
+}
+
+// Validate checks the addresses of the sender
+func (s Sender) Validate() error {
+	if s.From.Email == "" {
+		return errors.New("the sender has no from address")
+	}
+	addresses := append([]Address{s.From}, s.BCC...)
+	if s.ReplyTo.Email != "" {
+		addresses = append(addresses, s.ReplyTo)
+	}
+	for _, a := range addresses {
+		if _, err := mail.ParseAddress(a.Email); err != nil {
+			return fmt.Errorf("invalid sender address %q: %w", a.Email, err)
+		}
+	}
+	return nil
+}
+
+// Envelope are the addresses of an email besides its recipient, which is the email of the template data
+type Envelope struct {
+	From    Address   `json:"from"`
+	ReplyTo Address   `json:"reply_to,omitempty"`
+	CC      []Address `json:"cc,omitempty"`
+	BCC     []Address `json:"bcc,omitempty"`
+	// Statement is the key of the statement of the email in the ledger, the email provider sends it back with the
+	// events of the email
+	Statement string `json:"statement,omitempty"`
+}
+
+// copies returns the CC and BCC addresses without the recipient and without repeating any of them, the email
+// providers reject an address that's given twice
+func (e Envelope) copies(to string) (cc, bcc []Address) {
+	seen := map[string]bool{strings.ToLower(to): true}
+	unique := func(addresses []Address) []Address {
+		var out []Address
+		for _, a := range addresses {
+			key := strings.ToLower(a.Email)
+			if a.Email == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			out = append(out, a)
+		}
+		return out
+	}
+	return unique(e.CC), unique(e.BCC)
+}
+
+// Email is an email of a statement waiting to be sent
+type Email struct {
+	Envelope    Envelope
+	Data        templateData
+	Attachments []Attachment
+}
+
+// SendResult is the outcome of sending an email of a batch, the emails sent together share the message ID
+type SendResult struct {
+	MessageID string
+	Err       error
+}
+
+// NopMailer is a Mailer that only logs the emails, for dry runs and tests
+type NopMailer struct{}
+
+func (NopMailer) Send(envelope Envelope, data templateData, attachments ...Attachment) (string, error) {
+	logrus.Infof("not sending the statement of %s", data.Email)
+	return "", nil
+}
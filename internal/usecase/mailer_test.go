@@ -0,0 +1,59 @@
+package usecase
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingMailer is a Mailer that keeps the emails instead of sending them, it fails with err when it's set
+type recordingMailer struct {
+	sent        []templateData
+	envelopes   []Envelope
+	attachments [][]Attachment
+	attempts    int
+	err         error
+	messageID   string
+}
+
+func (m *recordingMailer) Send(envelope Envelope, data templateData, attachments ...Attachment) (string, error) {
+	m.attempts++
+	if m.err != nil {
+		return "", m.err
+	}
+	m.sent = append(m.sent, data)
+	m.envelopes = append(m.envelopes, envelope)
+	m.attachments = append(m.attachments, attachments)
+	return m.messageID, nil
+}
+
+func TestNopMailer_Send(t *testing.T) {
+	id, err := NopMailer{}.Send(Envelope{}, templateData{Email: "user@mail.com"})
+	assert.NoError(t, err)
+	assert.Empty(t, id)
+}
+
+func Test_calculator_send_withoutMailer(t *testing.T) {
+	_, err := calculator{}.send(Envelope{}, templateData{Email: "user@mail.com"})
+	assert.EqualError(t, err, "no mailer configured")
+}
+
+func TestSender_Validate(t *testing.T) {
+	assert.NoError(t, Sender{From: Address{Email: "statements@bank.com", Name: "Bank"}, BCC: []Address{{Email: "compliance@bank.com"}}}.Validate())
+	assert.Error(t, Sender{}.Validate())
+	assert.Error(t, Sender{From: Address{Email: "statements"}}.Validate())
+	assert.Error(t, Sender{From: Address{Email: "statements@bank.com"}, ReplyTo: Address{Email: "support@bank.com>"}}.Validate())
+}
+
+func Test_calculator_envelope(t *testing.T) {
+	bank := Sender{From: Address{Email: "statements@bank.com"}, BCC: []Address{{Email: "compliance@bank.com"}}}
+	tenant := Sender{From: Address{Email: "statements@tenant.com", Name: "Tenant"}, ReplyTo: Address{Email: "support@tenant.com"}}
+	c := NewCalculator(
+		WithSender(bank),
+		WithSourceSender("tenant", tenant),
+		WithCustomerProfiles(CustomerProfiles{"user@mail.com": {CC: []string{"joint@mail.com"}}}),
+	).(*calculator)
+
+	assert.Equal(t, Envelope{From: bank.From, BCC: bank.BCC, CC: []Address{{Email: "joint@mail.com"}}}, c.envelope(DefaultSourceName, "User@mail.com"))
+	assert.Equal(t, Envelope{From: tenant.From, ReplyTo: tenant.ReplyTo}, c.envelope("tenant", "other@mail.com"))
+}
@@ -0,0 +1,148 @@
+package usecase
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// defaultDecimals is the number of decimals of the amounts without currency and of the currencies that are not
+// in currencyDecimals
+const defaultDecimals = 2
+
+// currencyDecimals are the ISO 4217 exponents of the currencies without two decimals
+var currencyDecimals = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// decimals returns the number of decimals of the minor units of a currency, e.g.: 2 for cents, 0 for JPY
+func decimals(currency string) int {
+	if d, found := currencyDecimals[strings.ToUpper(currency)]; found {
+		return d
+	}
+	return defaultDecimals
+}
+
+// minorUnits returns the number of minor units in a major unit of a currency, e.g.: 100 cents in a dollar
+func minorUnits(currency string) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals(currency))), nil)
+}
+
+// decimalAmount matches a signed decimal amount, e.g.: -1234.56
+var decimalAmount = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)$`)
+
+// money is an exact amount in minor units of its currency, e.g. cents or yens. The currency is kept next to it,
+// by the transaction, balance or statement it belongs to. Amounts are parsed and rounded to minor units once,
+// so adding them up never drifts the way float64 sums do
+type money int64
+
+// RoundingMode tells how amounts with more decimals than minor units, and averages, are rounded
+type RoundingMode int
+
+const (
+	// RoundHalfEven rounds to the nearest minor unit, ties go to the even one (banker's rounding)
+	RoundHalfEven RoundingMode = iota
+	// RoundHalfUp rounds to the nearest minor unit, ties go away from zero
+	RoundHalfUp
+	// RoundHalfDown rounds to the nearest minor unit, ties go towards zero
+	RoundHalfDown
+	// RoundUp rounds away from zero
+	RoundUp
+	// RoundDown rounds towards zero (truncates)
+	RoundDown
+)
+
+var roundingModes = map[string]RoundingMode{
+	"half-even": RoundHalfEven,
+	"half-up":   RoundHalfUp,
+	"half-down": RoundHalfDown,
+	"up":        RoundUp,
+	"down":      RoundDown,
+}
+
+// ParseRoundingMode returns the rounding mode by name: half-even, half-up, half-down, up or down.
+// An empty name is half-even
+func ParseRoundingMode(name string) (RoundingMode, error) {
+	if name == "" {
+		return RoundHalfEven, nil
+	}
+	mode, ok := roundingModes[strings.ToLower(name)]
+	if !ok {
+		return RoundHalfEven, fmt.Errorf("unknown rounding mode %q", name)
+	}
+	return mode, nil
+}
+
+// parseMoney parses a decimal amount with an optional sign, rounding it to minor units of its currency
+func parseMoney(amount, currency string, mode RoundingMode) (money, error) {
+	amount = strings.TrimSpace(amount)
+	if !decimalAmount.MatchString(amount) {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	r, ok := new(big.Rat).SetString(strings.TrimPrefix(amount, "+"))
+	if !ok {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	return roundRat(r.Mul(r, new(big.Rat).SetInt(minorUnits(currency))), mode)
+}
+
+// roundRat rounds a rational number of minor units to an integer number of them
+func roundRat(r *big.Rat, mode RoundingMode) (money, error) {
+	quo, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		// compare the remainder with half the denominator: 2*|rem| vs denom
+		half := new(big.Int).Abs(rem)
+		half.Lsh(half, 1)
+		cmp := half.Cmp(r.Denom())
+		var away bool
+		switch mode {
+		case RoundUp:
+			away = true
+		case RoundDown:
+			away = false
+		case RoundHalfUp:
+			away = cmp >= 0
+		case RoundHalfDown:
+			away = cmp > 0
+		default:
+			away = cmp > 0 || (cmp == 0 && quo.Bit(0) == 1)
+		}
+		if away {
+			quo.Add(quo, big.NewInt(int64(r.Sign())))
+		}
+	}
+	if !quo.IsInt64() {
+		return 0, fmt.Errorf("amount %s out of range", r.FloatString(2))
+	}
+	return money(quo.Int64()), nil
+}
+
+// div divides an amount, rounding the result to minor units
+func (m money) div(n int, mode RoundingMode) money {
+	if n == 0 {
+		return 0
+	}
+	// the quotient of two int64 always fits in an int64
+	q, _ := roundRat(big.NewRat(int64(m), int64(n)), mode)
+	return q
+}
+
+// format formats the amount with the decimals of its currency, e.g.: -15.38, or -1538 in JPY
+func (m money) format(currency string) string {
+	sign := ""
+	units := new(big.Int).SetInt64(int64(m))
+	if units.Sign() < 0 {
+		sign = "-"
+		units.Abs(units)
+	}
+	d := decimals(currency)
+	if d == 0 {
+		return sign + units.String()
+	}
+	major, minor := new(big.Int).QuoRem(units, minorUnits(currency), new(big.Int))
+	return fmt.Sprintf("%s%s.%0*d", sign, major.String(), d, minor.Int64())
+}
@@ -0,0 +1,127 @@
+package usecase
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseMoney(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   string
+		currency string
+		mode     RoundingMode
+		want     money
+		wantErr  bool
+	}{
+		{name: "integer", amount: "10", want: 1000},
+		{name: "no decimals", amount: "1500", currency: "JPY", want: 1500},
+		{name: "rounded to the decimals of the currency", amount: "1500.5", currency: "jpy", mode: RoundHalfUp, want: 1501},
+		{name: "three decimals", amount: "1.2345", currency: "KWD", want: 1234},
+		{name: "four decimals", amount: "1.5", currency: "CLF", want: 15000},
+		{name: "signed decimals", amount: "-0.05", want: -5},
+		{name: "leading dot", amount: ".5", want: 50},
+		{name: "half-even tie rounds to even", amount: "0.125", mode: RoundHalfEven, want: 12},
+		{name: "half-even tie rounds to even up", amount: "0.135", mode: RoundHalfEven, want: 14},
+		{name: "half-even negative tie", amount: "-0.125", mode: RoundHalfEven, want: -12},
+		{name: "half-up tie", amount: "-0.125", mode: RoundHalfUp, want: -13},
+		{name: "half-down tie", amount: "0.135", mode: RoundHalfDown, want: 13},
+		{name: "half-down over half", amount: "0.1351", mode: RoundHalfDown, want: 14},
+		{name: "up", amount: "0.121", mode: RoundUp, want: 13},
+		{name: "down", amount: "-0.129", mode: RoundDown, want: -12},
+		{name: "no thousands separators", amount: "1,000.00", wantErr: true},
+		{name: "no exponents", amount: "1e5", wantErr: true},
+		{name: "no fractions", amount: "1/3", wantErr: true},
+		{name: "out of range", amount: "999999999999999999999", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMoney(tt.amount, tt.currency, tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseMoney() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_money_sumDoesNotDrift(t *testing.T) {
+	var sum money
+	for i := 0; i < 10000; i++ {
+		amount, err := getAmount("0.10", "", RoundHalfEven)
+		assert.NoError(t, err)
+		sum += amount
+	}
+	assert.Equal(t, "1000.00", sum.format(""))
+}
+
+func Test_money_format(t *testing.T) {
+	assert.Equal(t, "-15.38", money(-1538).format(""))
+	assert.Equal(t, "0.05", money(5).format("MXN"))
+	assert.Equal(t, "-0.05", money(-5).format(""))
+	assert.Equal(t, "1234567.00", money(123456700).format("EUR"))
+	assert.Equal(t, "-1538", money(-1538).format("JPY"))
+	assert.Equal(t, "0.005", money(5).format("KWD"))
+	assert.Equal(t, "-1.5380", money(-15380).format("CLF"))
+}
+
+func Test_money_convert(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   money
+		from, to string
+		rate     *big.Rat
+		want     money
+	}{
+		{name: "same decimals", amount: 1050, from: "USD", to: "MXN", rate: big.NewRat(20, 1), want: 21000},
+		{name: "to fewer decimals", amount: 1050, from: "USD", to: "JPY", rate: big.NewRat(150, 1), want: 1575},
+		{name: "to more decimals", amount: 1575, from: "JPY", to: "KWD", rate: big.NewRat(2, 1000), want: 3150},
+		{name: "without currency", amount: 1050, from: "", to: "JPY", rate: big.NewRat(1, 1), want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.amount.convert(tt.from, tt.to, tt.rate, RoundHalfEven)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_processStatement_currencyDecimals(t *testing.T) {
+	const ofx = `<OFX><BANKMSGSRSV1><STMTTRNRS><STMTRS>
+<CURDEF>JPY</CURDEF>
+<BANKTRANLIST>
+<STMTTRN><DTPOSTED>20210715</DTPOSTED><TRNAMT>1500</TRNAMT><FITID>0</FITID></STMTTRN>
+<STMTTRN><DTPOSTED>20210802</DTPOSTED><TRNAMT>-250</TRNAMT><FITID>1</FITID></STMTTRN>
+</BANKTRANLIST>
+<LEDGERBAL><BALAMT>3250</BALAMT><DTASOF>20210831</DTASOF></LEDGERBAL>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1></OFX>`
+	summary, err := processStatement("user@mail.com.ofx", strings.NewReader(ofx), parseConfig{})
+	assert.NoError(t, err)
+	summary, err = summary.toReportingCurrency("", nil, RoundHalfEven)
+	assert.NoError(t, err)
+	summary.applyBalances()
+	data, err := getEmailTemplateData("user@mail.com.ofx", summary)
+	assert.NoError(t, err)
+
+	// yens have no minor units
+	assert.Equal(t, "JPY", data.Currency)
+	assert.Equal(t, "1250", data.TotalBalance)
+	assert.Equal(t, "2000", data.PreviousBalance)
+	assert.Equal(t, "3250", data.NewBalance)
+}
+
+func TestParseRoundingMode(t *testing.T) {
+	mode, err := ParseRoundingMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, RoundHalfEven, mode)
+	mode, err = ParseRoundingMode("Half-Up")
+	assert.NoError(t, err)
+	assert.Equal(t, RoundHalfUp, mode)
+	_, err = ParseRoundingMode("bankers")
+	assert.Error(t, err)
+}
@@ -0,0 +1,226 @@
+package usecase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// outboxBucket is the bbolt bucket with the emails waiting to be delivered, keyed like the ledger
+var outboxBucket = []byte("outbox")
+
+const (
+	// minRetryDelay and maxRetryDelay bound the delay before a failed delivery is retried, it doubles on every attempt
+	minRetryDelay = time.Minute
+	maxRetryDelay = time.Hour
+)
+
+// outboxMessage is an email waiting in the outbox to be delivered
+type outboxMessage struct {
+	// Key is the key of the statement in the ledger
+	Key       string       `json:"key"`
+	Recipient string       `json:"recipient"`
+	Data      templateData `json:"data"`
+	// Envelope has the sender and the copies of the email
+	Envelope Envelope `json:"envelope"`
+	// Attachments are sent with the email, e.g. the statement document
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Attempts    int          `json:"attempts"`
+	// NextAttempt is when the message can be delivered, failed deliveries are retried later
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// enqueue writes the email of a statement to the outbox and records the statement as rendered, both in the
+// same transaction so a crash can't leave one without the other
+func (l *Ledger) enqueue(e *ledgerEntry, envelope Envelope, data templateData, attachments []Attachment) error {
+	now := time.Now()
+	msg := outboxMessage{
+		Key:         string(e.key()),
+		Recipient:   e.Recipient,
+		Data:        data,
+		Envelope:    envelope,
+		Attachments: attachments,
+		NextAttempt: now,
+		CreatedAt:   now,
+	}
+	e.State, e.Error, e.UpdatedAt = stateRendered, "", now
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		if err := putJSON(tx.Bucket(outboxBucket), e.key(), msg); err != nil {
+			return err
+		}
+		return putJSON(tx.Bucket(ledgerBucket), e.key(), e)
+	})
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	return nil
+}
+
+// queued tells if the email of a statement is waiting in the outbox
+func (l *Ledger) queued(e ledgerEntry) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	var found bool
+	err := l.db.View(func(tx *bbolt.Tx) error {
+		found = tx.Bucket(outboxBucket).Get(e.key()) != nil
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("outbox: %w", err)
+	}
+	return found, nil
+}
+
+// pending returns the messages of the outbox that are due at now
+func (l *Ledger) pending(now time.Time) ([]outboxMessage, error) {
+	var messages []outboxMessage
+	err := l.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(k, v []byte) error {
+			var msg outboxMessage
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return fmt.Errorf("message %s: %w", k, err)
+			}
+			if !msg.NextAttempt.After(now) {
+				messages = append(messages, msg)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	return messages, nil
+}
+
+// delivered removes a message from the outbox and records its statement as sent with the message ID given
+// by the email provider. It returns the ledger entry of the statement
+func (l *Ledger) delivered(msg outboxMessage, messageID string) (*ledgerEntry, error) {
+	var entry *ledgerEntry
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		key := []byte(msg.Key)
+		var err error
+		if entry, err = getEntry(tx, key); err != nil {
+			return err
+		}
+		entry.State, entry.Error, entry.MessageID, entry.UpdatedAt = stateSent, "", messageID, time.Now()
+		if err := putJSON(tx.Bucket(ledgerBucket), key, entry); err != nil {
+			return err
+		}
+		return tx.Bucket(outboxBucket).Delete(key)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	return entry, nil
+}
+
+// abandon removes a message that can't be delivered from the outbox, recording its statement as failed and
+// keeping the message as a dead letter with the email as it was rendered. It returns the ledger entry of the
+// statement
+func (l *Ledger) abandon(msg outboxMessage, reason error, email *RenderedEmail) (*ledgerEntry, error) {
+	now := time.Now()
+	msg.Attempts++
+	msg.LastError = reason.Error()
+	var entry *ledgerEntry
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		key := []byte(msg.Key)
+		var err error
+		if entry, err = getEntry(tx, key); err != nil {
+			return err
+		}
+		entry.State, entry.Error, entry.UpdatedAt = stateFailed, reason.Error(), now
+		if err := putJSON(tx.Bucket(ledgerBucket), key, entry); err != nil {
+			return err
+		}
+		dead := tx.Bucket(deadLetterBucket)
+		id, err := dead.NextSequence()
+		if err != nil {
+			return err
+		}
+		letter := DeadLetter{
+			ID:        id,
+			Recipient: msg.Recipient,
+			Class:     errorClass(reason),
+			Error:     reason.Error(),
+			Attempts:  msg.Attempts,
+			FailedAt:  now,
+			Email:     email,
+			Message:   msg,
+		}
+		if err := putJSON(dead, deadLetterKey(id), letter); err != nil {
+			return err
+		}
+		return tx.Bucket(outboxBucket).Delete(key)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	return entry, nil
+}
+
+// retry keeps a message in the outbox to be delivered again after a delay, recording its statement as failed.
+// The delay is longer if the email provider asked for it
+func (l *Ledger) retry(msg outboxMessage, reason error, now time.Time) error {
+	msg.Attempts++
+	msg.LastError = reason.Error()
+	delay := retryDelay(msg.Attempts)
+	var delayed DelayedError
+	if errors.As(reason, &delayed) && delayed.Delay() > delay {
+		delay = delayed.Delay()
+	}
+	msg.NextAttempt = now.Add(delay)
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		key := []byte(msg.Key)
+		entry, err := getEntry(tx, key)
+		if err != nil {
+			return err
+		}
+		entry.State, entry.Error, entry.UpdatedAt = stateFailed, msg.LastError, now
+		if err := putJSON(tx.Bucket(ledgerBucket), key, entry); err != nil {
+			return err
+		}
+		return putJSON(tx.Bucket(outboxBucket), key, msg)
+	})
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	return nil
+}
+
+// retryDelay is the delay before the next attempt after a number of failed ones
+func retryDelay(attempts int) time.Duration {
+	delay := minRetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func getEntry(tx *bbolt.Tx, key []byte) (*ledgerEntry, error) {
+	data := tx.Bucket(ledgerBucket).Get(key)
+	if data == nil {
+		return nil, fmt.Errorf("statement %s not found in the ledger", key)
+	}
+	entry := &ledgerEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func putJSON(bucket *bbolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
@@ -0,0 +1,179 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func Test_calculator_Dispatch(t *testing.T) {
+	dir := t.TempDir()
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "user@mail.com.csv"), []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n"), 0o600))
+	mailer := &recordingMailer{messageID: "msg-1"}
+	c := NewCalculator(WithDirPath(dir), WithLedger(ledger), WithMailer(mailer))
+
+	// the statement is parsed even if it can't be delivered yet, its file stays until it is
+	c.Run()
+	mailer.err = errors.New("something bad happened")
+	c.Dispatch()
+	_, err = os.Stat(path.Join(dir, "user@mail.com.csv"))
+	assert.NoError(t, err)
+	// reading it again doesn't queue it twice
+	c.Run()
+	messages, err := ledger.pending(time.Now().Add(minRetryDelay))
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, 1, messages[0].Attempts)
+	assert.Equal(t, "something bad happened", messages[0].LastError)
+	assert.Equal(t, stateFailed, ledgerEntryByKey(t, ledger, messages[0].Key).State)
+
+	// the failed delivery is not retried before its delay
+	mailer.err = nil
+	c.Dispatch()
+	messages, err = ledger.pending(time.Now().Add(minRetryDelay))
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+
+	msg := messages[0]
+	assert.NoError(t, ledger.retry(msg, errors.New("something bad happened"), time.Now().Add(-2*maxRetryDelay)))
+	c.Dispatch()
+	messages, err = ledger.pending(time.Now().Add(maxRetryDelay))
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+	entry := ledgerEntryByKey(t, ledger, msg.Key)
+	assert.Equal(t, stateSent, entry.State)
+	assert.Equal(t, "msg-1", entry.MessageID)
+	// the events of the email are correlated with the statement
+	assert.Equal(t, msg.Key, mailer.envelopes[0].Statement)
+	now := time.Now()
+	_, err = os.Stat(path.Join(dir, "archive", now.Format("2006"), now.Format("01"), "user@mail.com.csv"))
+	assert.NoError(t, err)
+}
+
+// ledgerEntryByKey returns the ledger entry of a statement by its key
+func ledgerEntryByKey(t *testing.T, ledger *Ledger, key string) *ledgerEntry {
+	var entry *ledgerEntry
+	assert.NoError(t, ledger.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		entry, err = getEntry(tx, []byte(key))
+		return err
+	}))
+	return entry
+}
+
+func Test_retryDelay(t *testing.T) {
+	assert.Equal(t, time.Minute, retryDelay(1))
+	assert.Equal(t, 2*time.Minute, retryDelay(2))
+	assert.Equal(t, 8*time.Minute, retryDelay(4))
+	assert.Equal(t, time.Hour, retryDelay(10))
+}
+
+func Test_calculator_Dispatch_permanentError(t *testing.T) {
+	dir := t.TempDir()
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "user@mail.com.csv"), []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n"), 0o600))
+	mailer := &recordingMailer{err: &SendGridError{
+		StatusCode: http.StatusBadRequest,
+		Errors:     []SendGridErrorDetail{{Message: "Does not contain a valid address.", Field: "personalizations.0.to.0.email"}},
+	}}
+	c := NewCalculator(WithDirPath(dir), WithLedger(ledger), WithMailer(mailer))
+
+	c.Run()
+	messages, err := ledger.pending(time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+	key := messages[0].Key
+	c.Dispatch()
+	c.Dispatch()
+
+	// the email is not retried, the statement is left as failed with the reason
+	messages, err = ledger.pending(time.Now().Add(maxRetryDelay))
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+	assert.Equal(t, 1, mailer.attempts)
+	entry := ledgerEntryByKey(t, ledger, key)
+	assert.Equal(t, stateFailed, entry.State)
+	assert.Contains(t, entry.Error, "Does not contain a valid address.")
+	// the file is quarantined with the reason, like the statements that can't be parsed
+	reason, err := ioutil.ReadFile(path.Join(dir, "quarantine", "user@mail.com.csv.error"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(reason), "Does not contain a valid address.")
+}
+
+func TestLedger_retry_retryAfter(t *testing.T) {
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	entry := &ledgerEntry{Recipient: "user@mail.com", Period: "2021-07/2021-07", Hash: "abc"}
+	assert.NoError(t, ledger.enqueue(entry, Envelope{}, templateData{Email: "user@mail.com"}, nil))
+	now := time.Now()
+	messages, err := ledger.pending(now)
+	assert.NoError(t, err)
+
+	// sendgrid asked to wait longer than the first retry delay
+	assert.NoError(t, ledger.retry(messages[0], &SendGridError{StatusCode: http.StatusTooManyRequests, RetryAfter: 10 * time.Minute}, now))
+	messages, err = ledger.pending(now.Add(9 * time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+	messages, err = ledger.pending(now.Add(10 * time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+}
+
+// concurrentMailer keeps the highest number of emails sent at once
+type concurrentMailer struct {
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	sent        int
+}
+
+func (m *concurrentMailer) Send(Envelope, templateData, ...Attachment) (string, error) {
+	m.mu.Lock()
+	m.inFlight++
+	if m.inFlight > m.maxInFlight {
+		m.maxInFlight = m.inFlight
+	}
+	m.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.sent++
+	return "", nil
+}
+
+func Test_calculator_Dispatch_concurrency(t *testing.T) {
+	dir := t.TempDir()
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, fmt.Sprintf("user%d@mail.com.csv", i)), []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n"), 0o600))
+	}
+	mailer := &concurrentMailer{}
+	c := NewCalculator(WithDirPath(dir), WithLedger(ledger), WithMailer(mailer), WithDispatchConcurrency(3))
+
+	c.Run()
+	c.Dispatch()
+
+	assert.Equal(t, 6, mailer.sent)
+	assert.Equal(t, 3, mailer.maxInFlight)
+	messages, err := ledger.pending(time.Now())
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+}
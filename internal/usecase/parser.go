@@ -0,0 +1,123 @@
+package usecase
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// sniffLen is the number of bytes inspected to detect the format of a statement without a known extension
+const sniffLen = 512
+
+// statementParser reads the transactions of a statement, calling emit for each one of them and invalid for each
+// row that can't be read. Formats that carry information about the whole statement (e.g. balances) return it in
+// statementMeta. Errors that prevent reading the rest of the statement are returned instead
+type statementParser interface {
+	parse(r io.Reader, emit func(transaction) error, invalid func(rowError) error) (statementMeta, error)
+}
+
+// rowError is a row (CSV record, OFX transaction, camt entry or MT940 statement line) that can't be read.
+// The parser skips it and keeps reading
+type rowError struct {
+	// line is the line the row starts at, 1-based
+	line int
+	// column is the column, field or tag of the row with the problem, empty if it's the whole row
+	column string
+	reason string
+}
+
+func (e rowError) Error() string {
+	if e.column == "" {
+		return fmt.Sprintf("line %d: %s", e.line, e.reason)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.line, e.column, e.reason)
+}
+
+// parseConfig holds the settings of the source a statement comes from that the parsers depend on
+type parseConfig struct {
+	csv      CSVMapping
+	rounding RoundingMode
+}
+
+// parserFactory builds the parser of a format for the settings of a source
+type parserFactory func(cfg parseConfig) statementParser
+
+func newCSVParser(cfg parseConfig) statementParser {
+	return csvParser{mapping: cfg.csv, rounding: cfg.rounding}
+}
+
+func newOFXParser(cfg parseConfig) statementParser {
+	return ofxParser{rounding: cfg.rounding}
+}
+
+func newCamtParser(cfg parseConfig) statementParser {
+	return camtParser{rounding: cfg.rounding}
+}
+
+func newMT940Parser(cfg parseConfig) statementParser {
+	return mt940Parser{rounding: cfg.rounding}
+}
+
+// parsersByExt maps the file extension to the parser of its format
+var parsersByExt = map[string]parserFactory{
+	".csv": newCSVParser,
+	".ofx": newOFXParser,
+	".qfx": newOFXParser,
+	".sta": newMT940Parser,
+	".940": newMT940Parser,
+}
+
+// parserFor chooses the parser by file extension, falling back to sniffing the contents of the statement.
+// Statements that can't be identified are parsed as CSV
+func parserFor(name string, r *bufio.Reader, cfg parseConfig) (statementParser, error) {
+	if newParser, ok := parsersByExt[strings.ToLower(path.Ext(name))]; ok {
+		return newParser(cfg), nil
+	}
+	head, err := r.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	switch {
+	case isOFX(head):
+		return newOFXParser(cfg), nil
+	case isCamt(head):
+		return newCamtParser(cfg), nil
+	case isMT940(head):
+		return newMT940Parser(cfg), nil
+	}
+	return newCSVParser(cfg), nil
+}
+
+// trimBOM removes the UTF-8 byte order mark and leading whitespace before sniffing
+func trimBOM(head []byte) []byte {
+	return bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")))
+}
+
+// lineCounter counts the lines of what is read through it, so formats read with a decoder that only
+// knows byte offsets can report line numbers
+type lineCounter struct {
+	r      io.Reader
+	offset int64
+	// newlines are the offsets of the line breaks read so far
+	newlines []int64
+}
+
+func (l *lineCounter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	for i, c := range p[:n] {
+		if c == '\n' {
+			l.newlines = append(l.newlines, l.offset+int64(i))
+		}
+	}
+	l.offset += int64(n)
+	return n, err
+}
+
+// lineAt returns the 1-based line of an offset that has already been read
+func (l *lineCounter) lineAt(offset int64) int {
+	return sort.Search(len(l.newlines), func(i int) bool { return l.newlines[i] >= offset }) + 1
+}
@@ -0,0 +1,272 @@
+package usecase
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// camt codes: balance types (BalanceType12Code), credit/debit indicator and entry status
+const (
+	camtOpeningBooked    = "OPBD"
+	camtPreviouslyClosed = "PRCD"
+	camtClosingBooked    = "CLBD"
+	camtInterimBooked    = "ITBD"
+	camtDebit            = "DBIT"
+	camtBooked           = "BOOK"
+)
+
+const (
+	camtDateLayout           = "2006-01-02"
+	camtDateTimeLayout       = "2006-01-02T15:04:05"
+	camtDateTimeLayoutLength = len(camtDateTimeLayout)
+)
+
+// camtParser parses ISO 20022 bank-to-customer statements: camt.053 (end-of-day statement) and
+// camt.052 (intraday account report). Only booked entries are read as transactions
+type camtParser struct {
+	rounding RoundingMode
+}
+
+type camtAmount struct {
+	Value string `xml:",chardata"`
+	Ccy   string `xml:"Ccy,attr"`
+}
+
+type camtDate struct {
+	Dt   string `xml:"Dt"`
+	DtTm string `xml:"DtTm"`
+}
+
+// camtStatus is a plain code up to camt.053.001.07 (<Sts>BOOK</Sts>) and a choice after it (<Sts><Cd>BOOK</Cd></Sts>)
+type camtStatus struct {
+	Value string `xml:",chardata"`
+	Cd    string `xml:"Cd"`
+}
+
+type camtEntry struct {
+	NtryRef      string     `xml:"NtryRef"`
+	AcctSvcrRef  string     `xml:"AcctSvcrRef"`
+	Amt          camtAmount `xml:"Amt"`
+	CdtDbtInd    string     `xml:"CdtDbtInd"`
+	Sts          camtStatus `xml:"Sts"`
+	BookgDt      camtDate   `xml:"BookgDt"`
+	AddtlNtryInf string     `xml:"AddtlNtryInf"`
+}
+
+// camtTotals are the controls of the statement, camt.053.001.02 has TtlNetNtryAmt and later versions TtlNetNtry
+type camtTotals struct {
+	TtlNtries struct {
+		NbOfNtries    string `xml:"NbOfNtries"`
+		TtlNetNtryAmt string `xml:"TtlNetNtryAmt"`
+		CdtDbtInd     string `xml:"CdtDbtInd"`
+		TtlNetNtry    struct {
+			Amt       string `xml:"Amt"`
+			CdtDbtInd string `xml:"CdtDbtInd"`
+		} `xml:"TtlNetNtry"`
+	} `xml:"TtlNtries"`
+}
+
+type camtBalance struct {
+	Tp struct {
+		CdOrPrtry struct {
+			Cd string `xml:"Cd"`
+		} `xml:"CdOrPrtry"`
+	} `xml:"Tp"`
+	Amt       camtAmount `xml:"Amt"`
+	CdtDbtInd string     `xml:"CdtDbtInd"`
+	Dt        camtDate   `xml:"Dt"`
+}
+
+func (p camtParser) parse(r io.Reader, emit func(transaction) error, invalid func(rowError) error) (statementMeta, error) {
+	var (
+		meta    statementMeta
+		interim *balance
+		totals  *camtTotals
+		skipped int
+		lines   = &lineCounter{r: r}
+	)
+	decoder := xml.NewDecoder(lines)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return statementMeta{}, fmt.Errorf("camt: %w", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "Bal":
+			var bal camtBalance
+			if err := decoder.DecodeElement(&bal, &start); err != nil {
+				return statementMeta{}, fmt.Errorf("camt: %w", err)
+			}
+			b, err := bal.balance(p.rounding)
+			if err != nil {
+				return statementMeta{}, err
+			}
+			switch bal.Tp.CdOrPrtry.Cd {
+			case camtOpeningBooked, camtPreviouslyClosed:
+				meta.openingBalance = b
+			case camtClosingBooked:
+				meta.closingBalance = b
+			case camtInterimBooked:
+				interim = b
+			}
+		case "TxsSummry":
+			totals = &camtTotals{}
+			if err := decoder.DecodeElement(totals, &start); err != nil {
+				return statementMeta{}, fmt.Errorf("camt: %w", err)
+			}
+		case "Ntry":
+			// the offset is right after the start element, which is on the line the entry starts at
+			line := lines.lineAt(decoder.InputOffset())
+			var entry camtEntry
+			if err := decoder.DecodeElement(&entry, &start); err != nil {
+				return statementMeta{}, fmt.Errorf("camt: %w", err)
+			}
+			if !entry.booked() {
+				skipped++
+				continue
+			}
+			trn, rowErr := entry.transaction(p.rounding)
+			if rowErr != nil {
+				rowErr.line = line
+				if err := invalid(*rowErr); err != nil {
+					return statementMeta{}, err
+				}
+				continue
+			}
+			if err := emit(trn); err != nil {
+				return statementMeta{}, err
+			}
+		}
+	}
+	// intraday reports (camt.052) don't have a closing balance, the interim one is the latest known
+	if meta.closingBalance == nil {
+		meta.closingBalance = interim
+	}
+	// the totals count every entry, they can only be checked when there are no pending entries
+	if totals != nil && skipped == 0 {
+		if err := totals.controls(&meta, p.rounding); err != nil {
+			return statementMeta{}, err
+		}
+	}
+	return meta, nil
+}
+
+// controls sets the record count and the control sum of the statement from the totals, the sum is in the currency
+// of the balances
+func (t camtTotals) controls(meta *statementMeta, mode RoundingMode) error {
+	if nb := strings.TrimSpace(t.TtlNtries.NbOfNtries); nb != "" {
+		count, err := strconv.Atoi(nb)
+		if err != nil {
+			return fmt.Errorf("camt: TxsSummry: NbOfNtries: %w", err)
+		}
+		meta.controlCount = &count
+	}
+	amount, indicator := t.TtlNtries.TtlNetNtry.Amt, t.TtlNtries.TtlNetNtry.CdtDbtInd
+	if amount == "" {
+		amount, indicator = t.TtlNtries.TtlNetNtryAmt, t.TtlNtries.CdtDbtInd
+	}
+	if strings.TrimSpace(amount) != "" {
+		var currency string
+		for _, b := range []*balance{meta.closingBalance, meta.openingBalance} {
+			if b != nil && currency == "" {
+				currency = b.currency
+			}
+		}
+		sum, err := camtSignedAmount(camtAmount{Value: amount, Ccy: currency}, indicator, mode)
+		if err != nil {
+			return fmt.Errorf("camt: TxsSummry: TtlNetNtry: %w", err)
+		}
+		meta.controlSum = &sum
+	}
+	return nil
+}
+
+func (e camtEntry) booked() bool {
+	status := strings.TrimSpace(e.Sts.Cd)
+	if status == "" {
+		status = strings.TrimSpace(e.Sts.Value)
+	}
+	return status == "" || status == camtBooked
+}
+
+// transaction reads the transaction of a booked entry, the line of the returned rowError is left to the caller
+func (e camtEntry) transaction(mode RoundingMode) (transaction, *rowError) {
+	id := e.AcctSvcrRef
+	if id == "" {
+		id = e.NtryRef
+	}
+	date, err := e.BookgDt.parse()
+	if err != nil {
+		return transaction{}, &rowError{column: "BookgDt", reason: fmt.Sprintf("entry %s: %v", id, err)}
+	}
+	amount, err := camtSignedAmount(e.Amt, e.CdtDbtInd, mode)
+	if err != nil {
+		return transaction{}, &rowError{column: "Amt", reason: fmt.Sprintf("entry %s: %v", id, err)}
+	}
+	return transaction{
+		id:          id,
+		date:        date,
+		amount:      amount,
+		description: strings.TrimSpace(e.AddtlNtryInf),
+		currency:    strings.ToUpper(strings.TrimSpace(e.Amt.Ccy)),
+	}, nil
+}
+
+func (b camtBalance) balance(mode RoundingMode) (*balance, error) {
+	date, err := b.Dt.parse()
+	if err != nil {
+		return nil, fmt.Errorf("camt: balance %s: Dt: %w", b.Tp.CdOrPrtry.Cd, err)
+	}
+	amount, err := camtSignedAmount(b.Amt, b.CdtDbtInd, mode)
+	if err != nil {
+		return nil, fmt.Errorf("camt: balance %s: Amt: %w", b.Tp.CdOrPrtry.Cd, err)
+	}
+	return &balance{amount: amount, date: date, currency: strings.ToUpper(strings.TrimSpace(b.Amt.Ccy))}, nil
+}
+
+// camtSignedAmount applies the credit/debit indicator to an amount, camt amounts are always positive
+func camtSignedAmount(amt camtAmount, indicator string, mode RoundingMode) (money, error) {
+	amount, err := parseMoney(amt.Value, strings.TrimSpace(amt.Ccy), mode)
+	if err != nil {
+		return 0, err
+	}
+	if strings.TrimSpace(indicator) == camtDebit {
+		amount *= -1
+	}
+	return amount, nil
+}
+
+func (d camtDate) parse() (time.Time, error) {
+	if d.Dt != "" {
+		return time.Parse(camtDateLayout, strings.TrimSpace(d.Dt))
+	}
+	// the time zone of a DtTm is optional, only the date is kept
+	dateTime := strings.TrimSpace(d.DtTm)
+	if len(dateTime) < camtDateTimeLayoutLength {
+		return time.Time{}, fmt.Errorf("invalid date %q", dateTime)
+	}
+	t, err := time.Parse(camtDateTimeLayout, dateTime[:camtDateTimeLayoutLength])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+// isCamt tells if the beginning of a statement looks like a camt.053 or camt.052 document
+func isCamt(head []byte) bool {
+	head = trimBOM(head)
+	return bytes.Contains(head, []byte("camt.053")) || bytes.Contains(head, []byte("camt.052")) ||
+		bytes.Contains(head, []byte("<BkToCstmrStmt")) || bytes.Contains(head, []byte("<BkToCstmrAcctRpt"))
+}
@@ -0,0 +1,171 @@
+package usecase
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const camt053 = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.02">
+  <BkToCstmrStmt>
+    <Stmt>
+      <Id>STMT-2021-08</Id>
+      <Bal>
+        <Tp><CdOrPrtry><Cd>OPBD</Cd></CdOrPrtry></Tp>
+        <Amt Ccy="EUR">100.00</Amt>
+        <CdtDbtInd>CRDT</CdtDbtInd>
+        <Dt><Dt>2021-07-01</Dt></Dt>
+      </Bal>
+      <Bal>
+        <Tp><CdOrPrtry><Cd>CLBD</Cd></CdOrPrtry></Tp>
+        <Amt Ccy="EUR">140.04</Amt>
+        <CdtDbtInd>CRDT</CdtDbtInd>
+        <Dt><Dt>2021-08-31</Dt></Dt>
+      </Bal>
+      <TxsSummry>
+        <TtlNtries>
+          <NbOfNtries>2</NbOfNtries>
+          <TtlNetNtryAmt>40.04</TtlNetNtryAmt>
+          <CdtDbtInd>CRDT</CdtDbtInd>
+        </TtlNtries>
+      </TxsSummry>
+      <Ntry>
+        <NtryRef>0</NtryRef>
+        <Amt Ccy="EUR">60.50</Amt>
+        <CdtDbtInd>CRDT</CdtDbtInd>
+        <Sts>BOOK</Sts>
+        <BookgDt><Dt>2021-07-15</Dt></BookgDt>
+        <AddtlNtryInf>Payroll</AddtlNtryInf>
+      </Ntry>
+      <Ntry>
+        <NtryRef>1</NtryRef>
+        <Amt Ccy="EUR">20.46</Amt>
+        <CdtDbtInd>DBIT</CdtDbtInd>
+        <Sts>BOOK</Sts>
+        <BookgDt><DtTm>2021-08-02T10:15:00+02:00</DtTm></BookgDt>
+        <AddtlNtryInf>Groceries</AddtlNtryInf>
+      </Ntry>
+    </Stmt>
+  </BkToCstmrStmt>
+</Document>
+`
+
+const camt052 = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.052.001.08">
+  <BkToCstmrAcctRpt>
+    <Rpt>
+      <Bal>
+        <Tp><CdOrPrtry><Cd>PRCD</Cd></CdOrPrtry></Tp>
+        <Amt Ccy="EUR">100.00</Amt>
+        <CdtDbtInd>CRDT</CdtDbtInd>
+        <Dt><Dt>2021-08-01</Dt></Dt>
+      </Bal>
+      <Bal>
+        <Tp><CdOrPrtry><Cd>ITBD</Cd></CdOrPrtry></Tp>
+        <Amt Ccy="EUR">79.54</Amt>
+        <CdtDbtInd>CRDT</CdtDbtInd>
+        <Dt><DtTm>2021-08-02T12:00:00</DtTm></Dt>
+      </Bal>
+      <Ntry>
+        <AcctSvcrRef>1</AcctSvcrRef>
+        <Amt Ccy="EUR">20.46</Amt>
+        <CdtDbtInd>DBIT</CdtDbtInd>
+        <Sts><Cd>BOOK</Cd></Sts>
+        <BookgDt><Dt>2021-08-02</Dt></BookgDt>
+      </Ntry>
+      <Ntry>
+        <AcctSvcrRef>2</AcctSvcrRef>
+        <Amt Ccy="EUR">5.00</Amt>
+        <CdtDbtInd>DBIT</CdtDbtInd>
+        <Sts><Cd>PDNG</Cd></Sts>
+      </Ntry>
+    </Rpt>
+  </BkToCstmrAcctRpt>
+</Document>
+`
+
+func Test_camtParser_parse(t *testing.T) {
+	tests := []struct {
+		name        string
+		contents    string
+		want        []transaction
+		wantMeta    statementMeta
+		wantInvalid []rowError
+		wantErr     bool
+	}{
+		{
+			name:     "must parse camt.053 entries and balances",
+			contents: camt053,
+			want: []transaction{
+				{id: "0", date: time.Date(2021, 7, 15, 0, 0, 0, 0, time.UTC), amount: 6050, description: "Payroll", currency: "EUR"},
+				{id: "1", date: time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC), amount: -2046, description: "Groceries", currency: "EUR"},
+			},
+			wantMeta: statementMeta{
+				openingBalance: &balance{amount: 10000, date: time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC), currency: "EUR"},
+				closingBalance: &balance{amount: 14004, date: time.Date(2021, 8, 31, 0, 0, 0, 0, time.UTC), currency: "EUR"},
+				controlCount:   intPtr(2),
+				controlSum:     moneyPtr(4004),
+			},
+		},
+		{
+			name:     "must skip pending camt.052 entries and use the interim balance as closing",
+			contents: camt052,
+			want: []transaction{
+				{id: "1", date: time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC), amount: -2046, currency: "EUR"},
+			},
+			wantMeta: statementMeta{
+				openingBalance: &balance{amount: 10000, date: time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC), currency: "EUR"},
+				closingBalance: &balance{amount: 7954, date: time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC), currency: "EUR"},
+			},
+		},
+		{
+			name:     "must report entries with an invalid amount with their line number",
+			contents: "<Document><BkToCstmrStmt><Stmt>\n<Ntry><NtryRef>7</NtryRef><Amt>abc</Amt><BookgDt><Dt>2021-08-02</Dt></BookgDt></Ntry>\n</Stmt></BkToCstmrStmt></Document>",
+			wantInvalid: []rowError{
+				{line: 2, column: "Amt", reason: `entry 7: invalid amount "abc"`},
+			},
+		},
+		{
+			name:     "must return an error if the document is not well formed",
+			contents: `<Document><BkToCstmrStmt>`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got     []transaction
+				invalid []rowError
+			)
+			meta, err := camtParser{}.parse(strings.NewReader(tt.contents), func(trn transaction) error {
+				got = append(got, trn)
+				return nil
+			}, func(e rowError) error {
+				invalid = append(invalid, e)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				assert.Equal(t, tt.want, got)
+				assert.Equal(t, tt.wantInvalid, invalid)
+				assert.Equal(t, tt.wantMeta, meta)
+			}
+		})
+	}
+}
+
+func Test_processStatement_sniffsCamt(t *testing.T) {
+	got, err := processStatement("user@mail.com.xml", strings.NewReader(camt053), parseConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, "EUR", got.currency)
+	assert.Equal(t, time.Date(2021, 8, 31, 0, 0, 0, 0, time.UTC), got.statementDate)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"2021-07": 1, "2021-08": 1}, got.monthSummary)
+	assert.Equal(t, money(14004), got.closingBalance.amount)
+}
@@ -0,0 +1,314 @@
+package usecase
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSVMapping describes the layout of the CSV statements of a source. The zero value is the
+// ID,Date,Transaction layout documented in statements/readme.md
+type CSVMapping struct {
+	// Delimiter separates the fields, a comma by default
+	Delimiter rune
+	// Quote is the character used to quote fields, a double quote by default
+	Quote rune
+	// NoHeader tells that the first row is a transaction instead of the column names
+	NoHeader bool
+	// ID, Date, Amount, Description and Currency are the column names as they appear in the header or
+	// zero-based column indexes. Only Date and Amount are required
+	ID          string
+	Date        string
+	Amount      string
+	Description string
+	Currency    string
+	// DateLayout is the layout of the dates, using Go's reference time. 2006-01-02 by default
+	DateLayout string
+	// OpeningLabel and ClosingLabel are the IDs of the header and trailer rows that hold the opening and
+	// closing balances in their date and amount columns. OPENING and CLOSING by default
+	OpeningLabel string
+	ClosingLabel string
+	// TrailerLabel is the ID of the trailer row with the controls: the record count in the date column and
+	// the control sum in the amount column. TRAILER by default
+	TrailerLabel string
+}
+
+func (m CSVMapping) withDefaults() CSVMapping {
+	if m.Delimiter == 0 {
+		m.Delimiter = ','
+	}
+	if m.Quote == 0 {
+		m.Quote = '"'
+	}
+	if m.ID == "" && m.Date == "" && m.Amount == "" {
+		m.ID, m.Date, m.Amount = "0", "1", "2"
+	}
+	if m.DateLayout == "" {
+		m.DateLayout = "2006-01-02"
+	}
+	if m.OpeningLabel == "" {
+		m.OpeningLabel = "OPENING"
+	}
+	if m.ClosingLabel == "" {
+		m.ClosingLabel = "CLOSING"
+	}
+	if m.TrailerLabel == "" {
+		m.TrailerLabel = "TRAILER"
+	}
+	return m
+}
+
+// csvColumns are the indexes of the mapped columns, -1 for the ones that are not mapped
+type csvColumns struct {
+	id          int
+	date        int
+	amount      int
+	description int
+	currency    int
+	// header are the column names, nil for CSVs without header
+	header []string
+}
+
+// name returns the name of a column as it appears in the header, or its index
+func (c csvColumns) name(idx int) string {
+	if idx < len(c.header) {
+		return strings.TrimSpace(c.header[idx])
+	}
+	return strconv.Itoa(idx)
+}
+
+// columns resolves the mapped columns against the header, header is nil for CSVs without one
+func (m CSVMapping) columns(header []string) (csvColumns, error) {
+	cols := csvColumns{header: header}
+	specs := []struct {
+		field    string
+		spec     string
+		required bool
+		idx      *int
+	}{
+		{field: "id", spec: m.ID, idx: &cols.id},
+		{field: "date", spec: m.Date, required: true, idx: &cols.date},
+		{field: "amount", spec: m.Amount, required: true, idx: &cols.amount},
+		{field: "description", spec: m.Description, idx: &cols.description},
+		{field: "currency", spec: m.Currency, idx: &cols.currency},
+	}
+	for _, s := range specs {
+		idx, err := resolveCSVColumn(s.spec, header)
+		if err == nil && idx < 0 && s.required {
+			err = errors.New("not mapped")
+		}
+		if err != nil {
+			return csvColumns{}, fmt.Errorf("csv: column for %s: %w", s.field, err)
+		}
+		*s.idx = idx
+	}
+	return cols, nil
+}
+
+// resolveCSVColumn returns the index of a column given by index or by name, -1 if spec is empty
+func resolveCSVColumn(spec string, header []string) (int, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return -1, nil
+	}
+	if idx, err := strconv.Atoi(spec); err == nil {
+		if idx < 0 {
+			return -1, fmt.Errorf("invalid index %d", idx)
+		}
+		return idx, nil
+	}
+	if header == nil {
+		return -1, fmt.Errorf("%q can't be found by name in a CSV without header", spec)
+	}
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), spec) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("%q not found in the header", spec)
+}
+
+// csvParser parses CSV statements laid out as described by its mapping
+type csvParser struct {
+	mapping  CSVMapping
+	rounding RoundingMode
+}
+
+func (p csvParser) parse(r io.Reader, emit func(transaction) error, invalid func(rowError) error) (statementMeta, error) {
+	var (
+		m       = p.mapping.withDefaults()
+		meta    statementMeta
+		cols    csvColumns
+		resolve = !m.NoHeader
+		// currency is the currency of the last row, the control sum of a trailer without currency is in it
+		currency string
+	)
+	if m.Quote > 127 || m.Quote == m.Delimiter {
+		return statementMeta{}, fmt.Errorf("csv: invalid quote character %q", m.Quote)
+	}
+	// encoding/csv only understands double quotes, other quote characters are swapped with it while reading
+	swap := m.Quote != '"'
+	if swap {
+		r = quoteSwapReader{r: r, quote: byte(m.Quote)}
+	}
+	parser := csv.NewReader(r)
+	parser.Comma = m.Delimiter
+	parser.FieldsPerRecord = -1
+	if m.NoHeader {
+		var err error
+		if cols, err = m.columns(nil); err != nil {
+			return statementMeta{}, err
+		}
+	}
+	// read the file line by line to save memory (versus reading all the file at once)
+	for {
+		record, err := parser.Read()
+		if err == io.EOF {
+			return meta, nil
+		}
+		// malformed quotes spoil the record, the reader carries on with the next one
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && !resolve {
+			if err := invalid(rowError{line: parseErr.StartLine, reason: parseErr.Err.Error()}); err != nil {
+				return statementMeta{}, err
+			}
+			continue
+		}
+		if err != nil {
+			return statementMeta{}, fmt.Errorf("csv: %w", err)
+		}
+		if swap {
+			for i := range record {
+				record[i] = swapQuote(record[i], byte(m.Quote))
+			}
+		}
+		// the first line has the headers of the CSV
+		if resolve {
+			resolve = false
+			if cols, err = m.columns(record); err != nil {
+				return statementMeta{}, err
+			}
+			continue
+		}
+		line, _ := parser.FieldPos(0)
+		if cols.id >= 0 && cols.id < len(record) && strings.EqualFold(strings.TrimSpace(record[cols.id]), m.TrailerLabel) {
+			count, sum, rowErr := cols.controls(record, currency, p.rounding)
+			if rowErr != nil {
+				rowErr.line = line
+				if err := invalid(*rowErr); err != nil {
+					return statementMeta{}, err
+				}
+				continue
+			}
+			meta.controlCount, meta.controlSum = count, sum
+			continue
+		}
+		trn, rowErr := cols.transaction(record, m.DateLayout, p.rounding)
+		if rowErr != nil {
+			rowErr.line = line
+			if err := invalid(*rowErr); err != nil {
+				return statementMeta{}, err
+			}
+			continue
+		}
+		currency = trn.currency
+		// balance rows are told apart from transactions by their ID
+		switch {
+		case strings.EqualFold(trn.id, m.OpeningLabel):
+			meta.openingBalance = &balance{amount: trn.amount, date: trn.date, currency: trn.currency}
+			continue
+		case strings.EqualFold(trn.id, m.ClosingLabel):
+			meta.closingBalance = &balance{amount: trn.amount, date: trn.date, currency: trn.currency}
+			continue
+		}
+		if err := emit(trn); err != nil {
+			return statementMeta{}, err
+		}
+	}
+}
+
+// transaction reads the transaction of a record, the line of the returned rowError is left to the caller
+func (c csvColumns) transaction(record []string, dateLayout string, mode RoundingMode) (transaction, *rowError) {
+	for _, idx := range []int{c.id, c.date, c.amount, c.description, c.currency} {
+		if idx >= len(record) {
+			return transaction{}, &rowError{column: c.name(idx), reason: "missing column"}
+		}
+	}
+	field := func(idx int) string {
+		if idx < 0 {
+			return ""
+		}
+		return strings.TrimSpace(record[idx])
+	}
+	date, err := time.Parse(dateLayout, field(c.date))
+	if err != nil {
+		return transaction{}, &rowError{column: c.name(c.date), reason: fmt.Sprintf("invalid date %q", field(c.date))}
+	}
+	currency := strings.ToUpper(field(c.currency))
+	amount, err := getAmount(field(c.amount), currency, mode)
+	if err != nil {
+		return transaction{}, &rowError{column: c.name(c.amount), reason: err.Error()}
+	}
+	return transaction{
+		id:          field(c.id),
+		date:        date,
+		amount:      amount,
+		description: field(c.description),
+		currency:    currency,
+	}, nil
+}
+
+// controls reads the record count and the control sum of a trailer row, the sum is in the currency of the row or in
+// currency when it has none
+func (c csvColumns) controls(record []string, currency string, mode RoundingMode) (*int, *money, *rowError) {
+	if c.date >= len(record) || c.amount >= len(record) {
+		return nil, nil, &rowError{reason: "trailer: missing columns"}
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(record[c.date]))
+	if err != nil {
+		return nil, nil, &rowError{column: c.name(c.date), reason: fmt.Sprintf("trailer: invalid record count %q", strings.TrimSpace(record[c.date]))}
+	}
+	if c.currency >= 0 && c.currency < len(record) && strings.TrimSpace(record[c.currency]) != "" {
+		currency = strings.ToUpper(strings.TrimSpace(record[c.currency]))
+	}
+	sum, err := parseMoney(record[c.amount], currency, mode)
+	if err != nil {
+		return nil, nil, &rowError{column: c.name(c.amount), reason: "trailer: control sum: " + err.Error()}
+	}
+	return &count, &sum, nil
+}
+
+// quoteSwapReader swaps a custom quote character with double quotes (and vice versa) so that
+// encoding/csv can read the quoted fields
+type quoteSwapReader struct {
+	r     io.Reader
+	quote byte
+}
+
+func (q quoteSwapReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	swapQuoteBytes(p[:n], q.quote)
+	return n, err
+}
+
+// swapQuote restores the original characters of a field read through a quoteSwapReader
+func swapQuote(field string, quote byte) string {
+	b := []byte(field)
+	swapQuoteBytes(b, quote)
+	return string(b)
+}
+
+func swapQuoteBytes(b []byte, quote byte) {
+	for i, c := range b {
+		switch c {
+		case quote:
+			b[i] = '"'
+		case '"':
+			b[i] = quote
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package usecase
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_csvParser_parse(t *testing.T) {
+	tests := []struct {
+		name        string
+		mapping     CSVMapping
+		contents    string
+		want        []transaction
+		wantMeta    statementMeta
+		wantInvalid []rowError
+		wantErr     string
+	}{
+		{
+			name:     "must parse the default layout",
+			contents: "ID,Date,Transaction\n0,2021-07-15,+60.5\n1,2021-08-02,-20.46\n",
+			want: []transaction{
+				{id: "0", date: time.Date(2021, 7, 15, 0, 0, 0, 0, time.UTC), amount: 6050},
+				{id: "1", date: time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC), amount: -2046},
+			},
+		},
+		{
+			name: "must map reordered and extra columns by header name",
+			mapping: CSVMapping{
+				Delimiter:   ';',
+				Quote:       '\'',
+				ID:          "Reference",
+				Date:        "booking date",
+				Amount:      "Amount",
+				Description: "Concept",
+				Currency:    "Currency",
+				DateLayout:  "02/01/2006",
+			},
+			contents: "Amount;Channel;Booking date;Concept;Reference;Currency\n" +
+				"60.5;web;15/07/2021;'Payroll; July';0;mxn\n" +
+				"-20.46;pos;02/08/2021;'Rock ''n'' \"roll\"';1;usd\n",
+			want: []transaction{
+				{id: "0", date: time.Date(2021, 7, 15, 0, 0, 0, 0, time.UTC), amount: 6050, description: "Payroll; July", currency: "MXN"},
+				{id: "1", date: time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC), amount: -2046, description: `Rock 'n' "roll"`, currency: "USD"},
+			},
+		},
+		{
+			name:     "must read the balances of the header and trailer rows",
+			contents: "ID,Date,Transaction\nopening,2021-07-01,+100\n0,2021-07-15,+60.5\nCLOSING,2021-07-31,+160.5\n",
+			want: []transaction{
+				{id: "0", date: time.Date(2021, 7, 15, 0, 0, 0, 0, time.UTC), amount: 6050},
+			},
+			wantMeta: statementMeta{
+				openingBalance: &balance{amount: 10000, date: time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)},
+				closingBalance: &balance{amount: 16050, date: time.Date(2021, 7, 31, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:     "must map columns by index when there's no header",
+			mapping:  CSVMapping{NoHeader: true, Date: "0", Amount: "1"},
+			contents: "2021-07-15,60.5\n",
+			want: []transaction{
+				{date: time.Date(2021, 7, 15, 0, 0, 0, 0, time.UTC), amount: 6050},
+			},
+		},
+		{
+			name:     "must return an error if a column is mapped by name without header",
+			mapping:  CSVMapping{NoHeader: true, Date: "Date", Amount: "1"},
+			contents: "2021-07-15,60.5\n",
+			wantErr:  `csv: column for date: "Date" can't be found by name in a CSV without header`,
+		},
+		{
+			name:     "must return an error if a column is not in the header",
+			mapping:  CSVMapping{Date: "Date", Amount: "Amount"},
+			contents: "Date,Transaction\n2021-07-15,60.5\n",
+			wantErr:  `csv: column for amount: "Amount" not found in the header`,
+		},
+		{
+			name:     "must report the rows that can't be read and keep reading",
+			contents: "ID,Date,Transaction\n0,2021-07-15,+60.5\n1,2021-08-02\n2,2021-08-03,abc\n3,08/04/2021,+1\n4,2021-08-05,+1\n",
+			want: []transaction{
+				{id: "0", date: time.Date(2021, 7, 15, 0, 0, 0, 0, time.UTC), amount: 6050},
+				{id: "4", date: time.Date(2021, 8, 5, 0, 0, 0, 0, time.UTC), amount: 100},
+			},
+			wantInvalid: []rowError{
+				{line: 3, column: "Transaction", reason: "missing column"},
+				{line: 4, column: "Transaction", reason: `invalid amount "abc"`},
+				{line: 5, column: "Date", reason: `invalid date "08/04/2021"`},
+			},
+		},
+		{
+			name:     "must report malformed quotes and keep reading",
+			contents: "ID,Date,Transaction\n0,2021-07-15,+6\"0.5\n1,2021-08-02,-20.46\n",
+			want: []transaction{
+				{id: "1", date: time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC), amount: -2046},
+			},
+			wantInvalid: []rowError{
+				{line: 2, reason: `bare " in non-quoted-field`},
+			},
+		},
+		{
+			name:     "must report a trailer that can't be read by column index without header",
+			mapping:  CSVMapping{NoHeader: true, ID: "0", Date: "1", Amount: "2"},
+			contents: "0,2021-07-15,+60.5\nTRAILER,one,+60.5\n",
+			want: []transaction{
+				{id: "0", date: time.Date(2021, 7, 15, 0, 0, 0, 0, time.UTC), amount: 6050},
+			},
+			wantInvalid: []rowError{
+				{line: 2, column: "1", reason: `trailer: invalid record count "one"`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got     []transaction
+				invalid []rowError
+			)
+			meta, err := csvParser{mapping: tt.mapping}.parse(strings.NewReader(tt.contents), func(trn transaction) error {
+				got = append(got, trn)
+				return nil
+			}, func(e rowError) error {
+				invalid = append(invalid, e)
+				return nil
+			})
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantInvalid, invalid)
+			assert.Equal(t, tt.wantMeta, meta)
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package usecase
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// mt940Tag matches the beginning of a field, e.g. :61: or :60F:
+	mt940Tag = regexp.MustCompile(`^:([0-9]{2}[A-Z]?):(.*)$`)
+	// mt940Balance matches :60a:/:62a: balances: D/C mark, YYMMDD, currency and amount
+	mt940Balance = regexp.MustCompile(`^([CD])([0-9]{6})([A-Z]{3})([0-9]+,[0-9]*)$`)
+	// mt940StatementLine matches a :61: statement line: value date, optional entry date (MMDD), D/C mark
+	// (R for reversals), optional funds code, amount, transaction type and the rest of the references
+	mt940StatementLine = regexp.MustCompile(`^([0-9]{6})([0-9]{4})?(R?[CD])([A-Z])?([0-9]+,[0-9]*)([NSF][A-Z0-9]{3})(.*)$`)
+)
+
+// mt940Error reports a malformed field of an MT940 statement
+type mt940Error struct {
+	line   int
+	tag    string
+	reason string
+}
+
+func (e *mt940Error) Error() string {
+	if e.tag == "" {
+		return fmt.Sprintf("mt940: line %d: %s", e.line, e.reason)
+	}
+	return fmt.Sprintf("mt940: line %d: :%s: %s", e.line, e.tag, e.reason)
+}
+
+// mt940Field is a tag with its value, including the continuation lines
+type mt940Field struct {
+	line  int
+	tag   string
+	value string
+}
+
+// mt940Parser parses SWIFT MT940 customer statements. Every :61: statement line is a transaction,
+// the :86: information that follows it is used as its description. Malformed statement lines are
+// reported as invalid rows, any other malformed field stops the parsing
+type mt940Parser struct {
+	rounding RoundingMode
+}
+
+func (p mt940Parser) parse(r io.Reader, emit func(transaction) error, invalid func(rowError) error) (statementMeta, error) {
+	var (
+		meta    statementMeta
+		pending *transaction
+		field   *mt940Field
+		lineNo  int
+		// currency is the currency of the account, as given by the opening balance
+		currency string
+	)
+	flushTransaction := func() error {
+		if pending == nil {
+			return nil
+		}
+		trn := *pending
+		pending = nil
+		return emit(trn)
+	}
+	handle := func(f *mt940Field) error {
+		if f == nil {
+			return nil
+		}
+		switch f.tag {
+		case "60F", "60M":
+			// statements split in several messages repeat the opening balance (60M), only the first one is kept
+			if meta.openingBalance != nil {
+				return nil
+			}
+			b, cur, err := parseMT940Balance(f, p.rounding)
+			if err != nil {
+				return err
+			}
+			meta.openingBalance = b
+			currency = cur
+		case "62F", "62M":
+			if err := flushTransaction(); err != nil {
+				return err
+			}
+			b, _, err := parseMT940Balance(f, p.rounding)
+			if err != nil {
+				return err
+			}
+			meta.closingBalance = b
+		case "61":
+			if err := flushTransaction(); err != nil {
+				return err
+			}
+			trn, err := parseMT940StatementLine(f, currency, p.rounding)
+			if err != nil {
+				return invalid(rowError{line: err.line, column: err.tag, reason: err.reason})
+			}
+			pending = &trn
+		case "86":
+			if pending != nil && pending.description == "" {
+				pending.description = f.value
+			}
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r ")
+		// SWIFT block headers ({1:...}{2:...}{4:) and the end of text block (-})
+		if line == "" || strings.HasPrefix(line, "{") || line == "-" || strings.HasPrefix(line, "-}") {
+			continue
+		}
+		if m := mt940Tag.FindStringSubmatch(line); m != nil {
+			if err := handle(field); err != nil {
+				return statementMeta{}, err
+			}
+			field = &mt940Field{line: lineNo, tag: m[1], value: m[2]}
+			continue
+		}
+		if field == nil {
+			return statementMeta{}, &mt940Error{line: lineNo, reason: fmt.Sprintf("unexpected line %q before the first tag", line)}
+		}
+		// continuation line of the current field
+		field.value += "\n" + line
+	}
+	if err := scanner.Err(); err != nil {
+		return statementMeta{}, err
+	}
+	if err := handle(field); err != nil {
+		return statementMeta{}, err
+	}
+	if err := flushTransaction(); err != nil {
+		return statementMeta{}, err
+	}
+	return meta, nil
+}
+
+// parseMT940Balance returns the balance and its currency
+func parseMT940Balance(f *mt940Field, mode RoundingMode) (*balance, string, error) {
+	m := mt940Balance.FindStringSubmatch(f.value)
+	if m == nil {
+		return nil, "", &mt940Error{line: f.line, tag: f.tag, reason: fmt.Sprintf("malformed balance %q", f.value)}
+	}
+	date, err := time.Parse("060102", m[2])
+	if err != nil {
+		return nil, "", &mt940Error{line: f.line, tag: f.tag, reason: fmt.Sprintf("invalid date %q", m[2])}
+	}
+	amount, err := parseMT940Amount(m[4], m[1], m[3], mode)
+	if err != nil {
+		return nil, "", &mt940Error{line: f.line, tag: f.tag, reason: err.Error()}
+	}
+	return &balance{amount: amount, date: date, currency: m[3]}, m[3], nil
+}
+
+// parseMT940StatementLine reads a transaction, in the currency of the account
+func parseMT940StatementLine(f *mt940Field, currency string, mode RoundingMode) (transaction, *mt940Error) {
+	// the supplementary details are in the second line of the field
+	firstLine := strings.SplitN(f.value, "\n", 2)[0]
+	m := mt940StatementLine.FindStringSubmatch(firstLine)
+	if m == nil {
+		return transaction{}, &mt940Error{line: f.line, tag: f.tag, reason: fmt.Sprintf("malformed statement line %q", firstLine)}
+	}
+	valueDate, err := time.Parse("060102", m[1])
+	if err != nil {
+		return transaction{}, &mt940Error{line: f.line, tag: f.tag, reason: fmt.Sprintf("invalid value date %q", m[1])}
+	}
+	date := valueDate
+	if m[2] != "" {
+		date, err = mt940EntryDate(valueDate, m[2])
+		if err != nil {
+			return transaction{}, &mt940Error{line: f.line, tag: f.tag, reason: fmt.Sprintf("invalid entry date %q", m[2])}
+		}
+	}
+	amount, err := parseMT940Amount(m[5], m[3], currency, mode)
+	if err != nil {
+		return transaction{}, &mt940Error{line: f.line, tag: f.tag, reason: err.Error()}
+	}
+	// the reference for the account owner comes after the transaction type, up to the bank reference (//)
+	id := strings.SplitN(m[7], "//", 2)[0]
+	return transaction{
+		id:       id,
+		date:     date,
+		amount:   amount,
+		currency: currency,
+	}, nil
+}
+
+// mt940EntryDate returns the booking date (MMDD) in the year of the value date, it may fall in the
+// previous or next year when the value date is close to the turn of the year
+func mt940EntryDate(valueDate time.Time, mmdd string) (time.Time, error) {
+	entry, err := time.Parse("0102", mmdd)
+	if err != nil {
+		return time.Time{}, err
+	}
+	date := time.Date(valueDate.Year(), entry.Month(), entry.Day(), 0, 0, 0, 0, time.UTC)
+	switch {
+	case date.Sub(valueDate) > 180*24*time.Hour:
+		date = date.AddDate(-1, 0, 0)
+	case valueDate.Sub(date) > 180*24*time.Hour:
+		date = date.AddDate(1, 0, 0)
+	}
+	return date, nil
+}
+
+// parseMT940Amount parses an amount with a comma as the decimal separator and applies the D/C mark.
+// Reversals swap the sign: RC is a reversal of a credit (a debit) and RD a reversal of a debit
+func parseMT940Amount(value, mark, currency string, mode RoundingMode) (money, error) {
+	amount, err := parseMoney(strings.Replace(value, ",", ".", 1), currency, mode)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	if mark == "D" || mark == "RC" {
+		amount *= -1
+	}
+	return amount, nil
+}
+
+// isMT940 tells if the beginning of a statement looks like an MT940 statement
+func isMT940(head []byte) bool {
+	head = trimBOM(head)
+	return bytes.HasPrefix(head, []byte(":20:")) || bytes.HasPrefix(head, []byte("{1:")) ||
+		bytes.Contains(head, []byte("\n:20:"))
+}
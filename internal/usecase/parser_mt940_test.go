@@ -0,0 +1,104 @@
+package usecase
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const mt940 = `{1:F01BANKDEFFAXXX0000000000}{2:O9400000000000BANKDEFFXXXX00000000000000000000N}{4:
+:20:STMT2021-08
+:25:DE89370400440532013000
+:28C:00001/001
+:60F:C210701EUR100,00
+:61:2107150715C60,50NTRFNONREF//B1
+Payroll reference
+:86:Payroll
+:61:2108020802D20,46NMSC0001
+:86:Groceries
+:61:2112310102RD5,00NCHK0002
+:62F:C210831EUR135,04
+-}
+`
+
+func Test_mt940Parser_parse(t *testing.T) {
+	tests := []struct {
+		name        string
+		contents    string
+		want        []transaction
+		wantMeta    statementMeta
+		wantInvalid []rowError
+		wantErr     string
+	}{
+		{
+			name:     "must parse statement lines and balances",
+			contents: mt940,
+			want: []transaction{
+				{id: "NONREF", date: time.Date(2021, 7, 15, 0, 0, 0, 0, time.UTC), amount: 6050, description: "Payroll", currency: "EUR"},
+				{id: "0001", date: time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC), amount: -2046, description: "Groceries", currency: "EUR"},
+				{id: "0002", date: time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC), amount: 500, currency: "EUR"},
+			},
+			wantMeta: statementMeta{
+				openingBalance: &balance{amount: 10000, date: time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC), currency: "EUR"},
+				closingBalance: &balance{amount: 13504, date: time.Date(2021, 8, 31, 0, 0, 0, 0, time.UTC), currency: "EUR"},
+			},
+		},
+		{
+			name:     "must report malformed statement lines with their line number and keep reading",
+			contents: ":20:STMT\n:60F:C210701EUR100,00\n:61:21071X5C60,50NTRF\n:86:Payroll\n:61:2108020802D20,46NTRF0001\n",
+			want: []transaction{
+				{id: "0001", date: time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC), amount: -2046, currency: "EUR"},
+			},
+			wantMeta: statementMeta{
+				openingBalance: &balance{amount: 10000, date: time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC), currency: "EUR"},
+			},
+			wantInvalid: []rowError{
+				{line: 3, column: "61", reason: `malformed statement line "21071X5C60,50NTRF"`},
+			},
+		},
+		{
+			name:     "must report malformed balances with their line number",
+			contents: ":20:STMT\n:60F:X210701EUR100,00\n",
+			wantErr:  `mt940: line 2: :60F: malformed balance "X210701EUR100,00"`,
+		},
+		{
+			name:     "must report lines outside of a tag",
+			contents: "garbage\n:20:STMT\n",
+			wantErr:  `mt940: line 1: unexpected line "garbage" before the first tag`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got     []transaction
+				invalid []rowError
+			)
+			meta, err := mt940Parser{}.parse(strings.NewReader(tt.contents), func(trn transaction) error {
+				got = append(got, trn)
+				return nil
+			}, func(e rowError) error {
+				invalid = append(invalid, e)
+				return nil
+			})
+			if tt.wantErr != "" {
+				var mtErr *mt940Error
+				assert.True(t, errors.As(err, &mtErr))
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantInvalid, invalid)
+			assert.Equal(t, tt.wantMeta, meta)
+		})
+	}
+}
+
+func Test_processStatement_sniffsMT940(t *testing.T) {
+	got, err := processStatement("user@mail.com.txt", strings.NewReader(mt940), parseConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"2021-07": 1, "2021-08": 1, "2022-01": 1}, got.monthSummary)
+}
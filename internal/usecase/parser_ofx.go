@@ -0,0 +1,166 @@
+package usecase
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+)
+
+// ofxParser parses the <STMTTRN> records of OFX 1.x (SGML) and OFX 2.x (XML) statements.
+// Both versions are read with the same tokenizer: the text that follows an opening tag is the value of
+// that tag, so it doesn't matter whether leaf elements are closed (XML) or not (SGML)
+type ofxParser struct {
+	rounding RoundingMode
+}
+
+func (p ofxParser) parse(r io.Reader, emit func(transaction) error, invalid func(rowError) error) (statementMeta, error) {
+	var (
+		meta    statementMeta
+		br      = bufio.NewReader(r)
+		pending string
+		// record holds the fields of the <STMTTRN> or <LEDGERBAL> aggregate being read
+		record map[string]string
+		// curdef is the default currency of the statement
+		curdef string
+		// inOrig tells if the tokenizer is inside an <ORIGCURRENCY> aggregate
+		inOrig bool
+		// line is the current line and recordLine the line the <STMTTRN> being read starts at
+		line       = 1
+		recordLine int
+	)
+	for {
+		// the text before a tag is the value of the last opened tag
+		text, err := br.ReadString('<')
+		line += strings.Count(text, "\n")
+		if pending != "" {
+			value := html.UnescapeString(strings.TrimSpace(strings.TrimSuffix(text, "<")))
+			switch {
+			case value == "":
+			// the amounts of a transaction with <ORIGCURRENCY> are already in the default currency
+			case inOrig && pending == "CURSYM":
+			case record != nil:
+				record[pending] = value
+			case pending == "CURDEF":
+				curdef = strings.ToUpper(value)
+			}
+		}
+		pending = ""
+		if err == io.EOF {
+			if record != nil {
+				return statementMeta{}, fmt.Errorf("ofx: unterminated STMTTRN")
+			}
+			return meta, nil
+		}
+		if err != nil {
+			return statementMeta{}, err
+		}
+		tag, err := br.ReadString('>')
+		if err != nil {
+			return statementMeta{}, fmt.Errorf("ofx: unterminated tag <%s", tag)
+		}
+		line += strings.Count(tag, "\n")
+		tag = strings.ToUpper(strings.TrimSpace(strings.TrimSuffix(tag, ">")))
+		switch {
+		// processing instructions (<?xml ...?>, <?OFX ...?>) and comments
+		case strings.HasPrefix(tag, "?"), strings.HasPrefix(tag, "!"):
+		case tag == "STMTTRN", tag == "LEDGERBAL":
+			record = map[string]string{}
+			recordLine = line
+		case tag == "/LEDGERBAL":
+			// the ledger balance is the balance of the account at the end of the statement
+			if meta.closingBalance, err = p.balance(record, curdef); err != nil {
+				return statementMeta{}, err
+			}
+			record = nil
+		case tag == "ORIGCURRENCY", tag == "/ORIGCURRENCY":
+			inOrig = tag == "ORIGCURRENCY"
+		case tag == "/STMTTRN":
+			if record == nil {
+				return statementMeta{}, fmt.Errorf("ofx: unexpected </STMTTRN>")
+			}
+			trn, rowErr := p.transaction(record, curdef)
+			record = nil
+			if rowErr != nil {
+				rowErr.line = recordLine
+				if err := invalid(*rowErr); err != nil {
+					return statementMeta{}, err
+				}
+				continue
+			}
+			if err := emit(trn); err != nil {
+				return statementMeta{}, err
+			}
+		case !strings.HasPrefix(tag, "/"):
+			pending = tag
+		}
+	}
+}
+
+// balance builds a balance from the fields of a <LEDGERBAL> aggregate, it's in the default currency
+func (p ofxParser) balance(record map[string]string, curdef string) (*balance, error) {
+	if record == nil {
+		return nil, fmt.Errorf("ofx: unexpected </LEDGERBAL>")
+	}
+	date, err := parseOFXDate(record["DTASOF"])
+	if err != nil {
+		return nil, fmt.Errorf("ofx: LEDGERBAL: DTASOF: %w", err)
+	}
+	amount, err := parseMoney(strings.Replace(record["BALAMT"], ",", ".", 1), curdef, p.rounding)
+	if err != nil {
+		return nil, fmt.Errorf("ofx: LEDGERBAL: BALAMT: %w", err)
+	}
+	return &balance{amount: amount, date: date, currency: curdef}, nil
+}
+
+// transaction builds a transaction from the fields of a <STMTTRN> record, the line of the returned rowError
+// is left to the caller
+func (p ofxParser) transaction(record map[string]string, curdef string) (transaction, *rowError) {
+	id := record["FITID"]
+	date, err := parseOFXDate(record["DTPOSTED"])
+	if err != nil {
+		return transaction{}, &rowError{column: "DTPOSTED", reason: fmt.Sprintf("transaction %s: %v", id, err)}
+	}
+	// the amounts of a transaction with a <CURRENCY> aggregate are in that currency
+	currency := curdef
+	if record["CURSYM"] != "" {
+		currency = strings.ToUpper(record["CURSYM"])
+	}
+	// some institutions use a comma as the decimal separator
+	amount, err := parseMoney(strings.Replace(record["TRNAMT"], ",", ".", 1), currency, p.rounding)
+	if err != nil {
+		return transaction{}, &rowError{column: "TRNAMT", reason: fmt.Sprintf("transaction %s: %v", id, err)}
+	}
+	description := record["NAME"]
+	if description == "" {
+		description = record["MEMO"]
+	}
+	return transaction{
+		id:          id,
+		date:        date,
+		amount:      amount,
+		description: description,
+		currency:    currency,
+	}, nil
+}
+
+// parseOFXDate parses the date part of an OFX datetime, e.g.: 20210715120000.000[-5:EST]
+func parseOFXDate(value string) (time.Time, error) {
+	if len(value) < 8 {
+		return time.Time{}, fmt.Errorf("invalid date %q", value)
+	}
+	return time.Parse("20060102", value[:8])
+}
+
+// isOFX tells if the beginning of a statement looks like an OFX document
+func isOFX(head []byte) bool {
+	head = trimBOM(head)
+	if bytes.HasPrefix(head, []byte("OFXHEADER")) {
+		return true
+	}
+	upper := bytes.ToUpper(head)
+	return bytes.Contains(upper, []byte("<OFX>")) || bytes.Contains(upper, []byte("<?OFX "))
+}
@@ -0,0 +1,135 @@
+package usecase
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const ofxSGML = `OFXHEADER:100
+DATA:OFXSGML
+VERSION:102
+
+<OFX>
+<BANKMSGSRSV1><STMTTRNRS><STMTRS>
+<CURDEF>MXN
+<BANKTRANLIST>
+<DTSTART>20210701
+<STMTTRN>
+<TRNTYPE>CREDIT
+<DTPOSTED>20210715120000.000[-5:EST]
+<TRNAMT>60.50
+<FITID>0
+<NAME>Payroll &amp; bonus
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>DEBIT
+<DTPOSTED>20210802
+<TRNAMT>-20,46
+<FITID>1
+<MEMO>Groceries
+<ORIGCURRENCY><CURRATE>17.5<CURSYM>USD</ORIGCURRENCY>
+</STMTTRN>
+</BANKTRANLIST>
+<LEDGERBAL><BALAMT>140.04<DTASOF>20210831</LEDGERBAL>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`
+
+const ofxXML = `<?xml version="1.0" encoding="UTF-8"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+  <BANKMSGSRSV1><STMTTRNRS><STMTRS>
+    <CURDEF>MXN</CURDEF>
+    <BANKTRANLIST>
+      <STMTTRN>
+        <TRNTYPE>CREDIT</TRNTYPE>
+        <DTPOSTED>20210715</DTPOSTED>
+        <TRNAMT>60.50</TRNAMT>
+        <FITID>0</FITID>
+        <NAME>Payroll &amp; bonus</NAME>
+      </STMTTRN>
+      <STMTTRN>
+        <TRNTYPE>DEBIT</TRNTYPE>
+        <DTPOSTED>20210802</DTPOSTED>
+        <TRNAMT>-20.46</TRNAMT>
+        <FITID>1</FITID>
+        <MEMO>Groceries</MEMO>
+        <CURRENCY><CURRATE>17.5</CURRATE><CURSYM>USD</CURSYM></CURRENCY>
+      </STMTTRN>
+    </BANKTRANLIST>
+    <LEDGERBAL><BALAMT>140.04</BALAMT><DTASOF>20210831</DTASOF></LEDGERBAL>
+  </STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`
+
+func Test_ofxParser_parse(t *testing.T) {
+	tests := []struct {
+		name        string
+		contents    string
+		want        []transaction
+		wantInvalid []rowError
+		wantErr     bool
+	}{
+		{
+			name:     "must parse OFX 1.x SGML statements",
+			contents: ofxSGML,
+			want: []transaction{
+				{id: "0", date: time.Date(2021, 7, 15, 0, 0, 0, 0, time.UTC), amount: 6050, description: "Payroll & bonus", currency: "MXN"},
+				{id: "1", date: time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC), amount: -2046, description: "Groceries", currency: "MXN"},
+			},
+		},
+		{
+			name:     "must parse OFX 2.x XML statements",
+			contents: ofxXML,
+			want: []transaction{
+				{id: "0", date: time.Date(2021, 7, 15, 0, 0, 0, 0, time.UTC), amount: 6050, description: "Payroll & bonus", currency: "MXN"},
+				{id: "1", date: time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC), amount: -2046, description: "Groceries", currency: "USD"},
+			},
+		},
+		{
+			name:     "must report transactions with an invalid amount with their line number",
+			contents: "<OFX><CURDEF>MXN\n<STMTTRN><DTPOSTED>20210802<TRNAMT>abc<FITID>1</STMTTRN>\n<LEDGERBAL><BALAMT>140.04<DTASOF>20210831</LEDGERBAL></OFX>",
+			wantInvalid: []rowError{
+				{line: 2, column: "TRNAMT", reason: `transaction 1: invalid amount "abc"`},
+			},
+		},
+		{
+			name:     "must return an error if a STMTTRN is not terminated",
+			contents: "<OFX><STMTTRN><DTPOSTED>20210802<TRNAMT>1.00",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got     []transaction
+				invalid []rowError
+			)
+			meta, err := ofxParser{}.parse(strings.NewReader(tt.contents), func(trn transaction) error {
+				got = append(got, trn)
+				return nil
+			}, func(e rowError) error {
+				invalid = append(invalid, e)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				assert.Equal(t, tt.want, got)
+				assert.Equal(t, tt.wantInvalid, invalid)
+				assert.Equal(t, &balance{amount: 14004, date: time.Date(2021, 8, 31, 0, 0, 0, 0, time.UTC), currency: "MXN"}, meta.closingBalance)
+			}
+		})
+	}
+}
+
+func Test_processStatement_sniffsOFX(t *testing.T) {
+	got, err := processStatement("user@mail.com.txt", strings.NewReader(ofxXML), parseConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"2021-07": 1, "2021-08": 1}, got.monthSummary)
+}
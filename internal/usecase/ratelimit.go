@@ -0,0 +1,152 @@
+package usecase
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// minRatePause is how long the requests are held after a 429 without Retry-After
+	minRatePause = time.Second
+	// minRateFraction bounds how far the rate goes down after 429s, as a fraction of the configured rate
+	minRateFraction = 16
+	// rateRecoverySteps is the number of successful requests it takes the rate to go back up to the configured one
+	rateRecoverySteps = 10
+)
+
+// rateLimiter throttles the requests to the email provider: a token bucket of limit requests per second with room
+// for burst requests at once, and at most maxInFlight requests at a time. It adapts to the provider: a 429 halves
+// the rate and holds every request for the delay asked, the rate limit headers hold the requests until the limit
+// resets when there are none left, and successful requests bring the rate back up to the configured one
+type rateLimiter struct {
+	// limit is the configured rate, 0 doesn't limit the rate
+	limit float64
+	burst float64
+	// inFlight has a slot for every request being sent, nil doesn't limit them
+	inFlight chan struct{}
+	now      func() time.Time
+	sleep    func(d time.Duration)
+
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	// pausedUntil holds every request until the limit of the provider resets
+	pausedUntil time.Time
+}
+
+// newRateLimiter returns a limiter of perSecond requests per second and burst at once, with up to maxInFlight
+// requests at a time. 0 doesn't limit the rate or the requests at a time, the burst is at least 1
+func newRateLimiter(perSecond float64, burst, maxInFlight int) *rateLimiter {
+	l := &rateLimiter{
+		limit: perSecond,
+		burst: math.Max(1, float64(burst)),
+		rate:  perSecond,
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+	l.tokens = l.burst
+	if maxInFlight > 0 {
+		l.inFlight = make(chan struct{}, maxInFlight)
+	}
+	return l
+}
+
+// acquire waits until a request can be sent, release must be called once it's done
+func (l *rateLimiter) acquire() {
+	if l.inFlight != nil {
+		l.inFlight <- struct{}{}
+	}
+	for {
+		wait := l.reserve()
+		if wait <= 0 {
+			return
+		}
+		l.sleep(wait)
+	}
+}
+
+// release frees the slot of a request
+func (l *rateLimiter) release() {
+	if l.inFlight != nil {
+		<-l.inFlight
+	}
+}
+
+// reserve takes a token, or returns how long to wait for one
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.limit == 0 {
+		return 0
+	}
+	l.refill(now)
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// refill adds the tokens earned since the last request, l.mu must be held
+func (l *rateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+}
+
+// observe adapts the limiter to a response of the provider
+func (l *rateLimiter) observe(statusCode int, headers map[string][]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if statusCode == http.StatusTooManyRequests {
+		delay := retryAfter(headerValue(headers, "Retry-After"), now)
+		if delay < minRatePause {
+			delay = minRatePause
+		}
+		l.pause(now.Add(delay))
+		if l.limit > 0 {
+			l.refill(now)
+			l.rate = math.Max(l.rate/2, l.limit/minRateFraction)
+			l.tokens = 0
+		}
+		return
+	}
+	if statusCode < 300 && l.rate < l.limit {
+		l.rate = math.Min(l.limit, l.rate+l.limit/rateRecoverySteps)
+	}
+	remaining, err := strconv.Atoi(headerValue(headers, "X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(headerValue(headers, "X-RateLimit-Reset"), 10, 64)
+	if err != nil || !now.Before(time.Unix(reset, 0)) {
+		return
+	}
+	if remaining == 0 {
+		l.pause(time.Unix(reset, 0))
+		return
+	}
+	if l.limit > 0 {
+		// the rate that spreads the requests left until the limit resets
+		l.refill(now)
+		l.rate = math.Max(math.Min(l.rate, float64(remaining)/time.Unix(reset, 0).Sub(now).Seconds()), l.limit/minRateFraction)
+		l.tokens = math.Min(l.tokens, float64(remaining))
+	}
+}
+
+// pause holds the requests until the time given, l.mu must be held
+func (l *rateLimiter) pause(until time.Time) {
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
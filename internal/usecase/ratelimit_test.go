@@ -0,0 +1,168 @@
+package usecase
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is the time of a limiter under test, sleeping moves it forward
+type fakeClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) limiter(perSecond float64, burst, maxInFlight int) *rateLimiter {
+	l := newRateLimiter(perSecond, burst, maxInFlight)
+	l.now = func() time.Time { return c.now }
+	l.sleep = func(d time.Duration) {
+		c.slept = append(c.slept, d)
+		c.now = c.now.Add(d)
+	}
+	return l
+}
+
+func Test_rateLimiter_acquire(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	l := clock.limiter(2, 2, 0)
+
+	// the burst goes at once, then a request every half second
+	for i := 0; i < 4; i++ {
+		l.acquire()
+		l.release()
+	}
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, 500 * time.Millisecond}, clock.slept)
+
+	// unlimited
+	clock.slept = nil
+	l = clock.limiter(0, 0, 0)
+	for i := 0; i < 100; i++ {
+		l.acquire()
+		l.release()
+	}
+	assert.Empty(t, clock.slept)
+}
+
+func Test_rateLimiter_maxInFlight(t *testing.T) {
+	l := newRateLimiter(0, 0, 1)
+	l.acquire()
+	acquired := make(chan struct{})
+	go func() {
+		l.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("a second request was sent with one in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("the request wasn't sent after the first one was done")
+	}
+	l.release()
+}
+
+func Test_rateLimiter_observe(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name       string
+		perSecond  float64
+		statusCode int
+		headers    map[string][]string
+		wantWait   time.Duration
+		wantRate   float64
+	}{
+		{
+			name:       "429 with Retry-After",
+			perSecond:  10,
+			statusCode: http.StatusTooManyRequests,
+			headers:    map[string][]string{"Retry-After": {"3"}},
+			wantWait:   3 * time.Second,
+			wantRate:   5,
+		},
+		{
+			name:       "429 without Retry-After",
+			perSecond:  10,
+			statusCode: http.StatusTooManyRequests,
+			wantWait:   minRatePause,
+			wantRate:   5,
+		},
+		{
+			name:       "429 without a rate limit",
+			statusCode: http.StatusTooManyRequests,
+			headers:    map[string][]string{"Retry-After": {"3"}},
+			wantWait:   3 * time.Second,
+		},
+		{
+			name:       "no requests left until the limit resets",
+			perSecond:  10,
+			statusCode: http.StatusAccepted,
+			headers: map[string][]string{
+				"X-RateLimit-Remaining": {"0"},
+				"X-RateLimit-Reset":     {strconv.FormatInt(start.Add(5*time.Second).Unix(), 10)},
+			},
+			wantWait: 5 * time.Second,
+			wantRate: 10,
+		},
+		{
+			name:       "few requests left until the limit resets",
+			perSecond:  10,
+			statusCode: http.StatusAccepted,
+			headers: map[string][]string{
+				"x-ratelimit-remaining": {"20"},
+				"x-ratelimit-reset":     {strconv.FormatInt(start.Add(10*time.Second).Unix(), 10)},
+			},
+			wantRate: 2,
+		},
+		{
+			name:       "a limit that already reset",
+			perSecond:  10,
+			statusCode: http.StatusAccepted,
+			headers: map[string][]string{
+				"X-RateLimit-Remaining": {"0"},
+				"X-RateLimit-Reset":     {strconv.FormatInt(start.Add(-time.Second).Unix(), 10)},
+			},
+			wantRate: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: start}
+			l := clock.limiter(tt.perSecond, 1, 0)
+			l.observe(tt.statusCode, tt.headers)
+			assert.Equal(t, tt.wantRate, l.rate)
+			l.acquire()
+			var waited time.Duration
+			for _, d := range clock.slept {
+				waited += d
+			}
+			if tt.wantWait > 0 {
+				assert.Equal(t, tt.wantWait, clock.slept[0])
+			} else if waited > time.Second {
+				t.Errorf("acquire() waited %s", waited)
+			}
+		})
+	}
+}
+
+func Test_rateLimiter_recovers(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	l := clock.limiter(10, 10, 0)
+	l.observe(http.StatusTooManyRequests, nil)
+	l.observe(http.StatusTooManyRequests, nil)
+	assert.Equal(t, 2.5, l.rate)
+	for i := 0; i < 5; i++ {
+		l.observe(http.StatusAccepted, nil)
+	}
+	assert.Equal(t, 7.5, l.rate)
+	for i := 0; i < rateRecoverySteps; i++ {
+		l.observe(http.StatusAccepted, nil)
+	}
+	assert.Equal(t, 10.0, l.rate)
+}
@@ -0,0 +1,73 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnreconciled is returned for statements whose transactions don't match their control totals
+var ErrUnreconciled = errors.New("unreconciled statement")
+
+// reconciliationError lists every control total a statement doesn't match
+type reconciliationError struct {
+	reasons []string
+}
+
+func (e *reconciliationError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrUnreconciled, strings.Join(e.reasons, "; "))
+}
+
+func (e *reconciliationError) Is(target error) bool {
+	return target == ErrUnreconciled
+}
+
+// reconcile checks the transactions against the controls declared by the statement: the record count, the control
+// sum and, when the opening balance is declared too, the closing balance. Controls that are not declared are skipped.
+// The statement is reconciled in its own currency, before it's converted to the reporting currency, and the closing
+// balance is only checked when the transactions are in the currency of the balances
+func (s statementSummary) reconcile() error {
+	var reasons []string
+	if s.controlCount != nil && *s.controlCount != len(s.transactions) {
+		reasons = append(reasons, fmt.Sprintf("read %d transactions but the control count is %d", len(s.transactions), *s.controlCount))
+	}
+	var sum money
+	for _, t := range s.transactions {
+		sum += t.amount
+	}
+	if s.controlSum != nil && sum != *s.controlSum {
+		reasons = append(reasons, fmt.Sprintf("transactions add up to %s but the control sum is %s",
+			sum.format(s.currency), s.controlSum.format(s.currency)))
+	}
+	if s.openingBalance != nil && s.closingBalance != nil && s.inBalanceCurrency() {
+		if closing := s.openingBalance.amount + sum; closing != s.closingBalance.amount {
+			currency := s.balanceCurrency()
+			reasons = append(reasons, fmt.Sprintf("opening balance %s plus transactions is %s but the declared closing balance is %s",
+				s.openingBalance.amount.format(currency), closing.format(currency), s.closingBalance.amount.format(currency)))
+		}
+	}
+	if len(reasons) > 0 {
+		return &reconciliationError{reasons: reasons}
+	}
+	return nil
+}
+
+// inBalanceCurrency tells if the transactions are in the currency of the declared balances, amounts without
+// currency are taken to be in it
+func (s statementSummary) inBalanceCurrency() bool {
+	currency := s.balanceCurrency()
+	for _, t := range s.transactions {
+		if t.currency != "" && currency != "" && t.currency != currency {
+			return false
+		}
+	}
+	return true
+}
+
+// balanceCurrency returns the currency of the declared balances, empty when they don't tell
+func (s statementSummary) balanceCurrency() string {
+	if s.closingBalance.currency != "" {
+		return s.closingBalance.currency
+	}
+	return s.openingBalance.currency
+}
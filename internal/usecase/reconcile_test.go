@@ -0,0 +1,91 @@
+package usecase
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func moneyPtr(m money) *money {
+	return &m
+}
+
+// currencyMapping is the default CSV layout with a currency column
+var currencyMapping = CSVMapping{ID: "ID", Date: "Date", Amount: "Transaction", Currency: "Currency"}
+
+func Test_statementSummary_reconcile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		csv      CSVMapping
+		wantErr  string
+	}{
+		{
+			name:     "must reconcile a statement that matches its controls",
+			contents: "ID,Date,Transaction\nOPENING,2021-07-01,+100\n0,2021-07-15,+60.5\n1,2021-07-28,-10.5\nCLOSING,2021-07-31,+150\nTRAILER,2,+50\n",
+		},
+		{
+			name:     "must reconcile a statement without controls",
+			contents: "ID,Date,Transaction\n0,2021-07-15,+60.5\n",
+		},
+		{
+			name:     "must reconcile the balances in the currency of the statement",
+			contents: "ID,Date,Transaction,Currency\nOPENING,2021-07-01,+100,EUR\n0,2021-07-15,+60.5,EUR\nCLOSING,2021-07-31,+160.5,EUR\n",
+			csv:      currencyMapping,
+		},
+		{
+			name:     "must not check the balances of transactions in another currency",
+			contents: "ID,Date,Transaction,Currency\nOPENING,2021-07-01,+100,EUR\n0,2021-07-15,+60.5,USD\nCLOSING,2021-07-31,+100,EUR\n",
+			csv:      currencyMapping,
+		},
+		{
+			name:     "must not reconcile a truncated statement",
+			contents: "ID,Date,Transaction\nOPENING,2021-07-01,+100\n0,2021-07-15,+60.5\nCLOSING,2021-07-31,+150\nTRAILER,2,+50\n",
+			wantErr: "unreconciled statement: read 1 transactions but the control count is 2; " +
+				"transactions add up to 60.50 but the control sum is 50.00; " +
+				"opening balance 100.00 plus transactions is 160.50 but the declared closing balance is 150.00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summary, err := processStatement("user@mail.com.csv", strings.NewReader(tt.contents), parseConfig{csv: tt.csv})
+			assert.NoError(t, err)
+			err = summary.reconcile()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, ErrUnreconciled))
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func Test_calculator_readStatement_reportingCurrency(t *testing.T) {
+	dir := t.TempDir()
+	rates, err := readFXRates(strings.NewReader("date,from,to,rate\n2021-07-01,EUR,MXN,20\n"))
+	assert.NoError(t, err)
+	statement := ":20:STMT\n:25:123456789\n:28C:1/1\n:60F:C210701EUR100,00\n:61:2107150715C60,50NTRF\n:62F:C210731EUR160,50\n"
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "user@mail.com.sta"), []byte(statement), 0o600))
+	src := NewDirSource(DefaultSourceName, dir)
+	c := NewCalculator(WithReportingCurrency("MXN"), WithFXRates(rates)).(*calculator)
+
+	got, err := c.readStatement(src, StatementRef{Source: DefaultSourceName, Name: "user@mail.com.sta"})
+	assert.NoError(t, err, "a balanced statement is reconciled in its own currency")
+	assert.Equal(t, "MXN", got.currency)
+	assert.Equal(t, "2000.00", got.opening.format(got.currency))
+	assert.Equal(t, "3210.00", got.closing.format(got.currency))
+
+	unbalanced := strings.Replace(statement, ":62F:C210731EUR160,50", ":62F:C210731EUR150,00", 1)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "user@mail.com.sta"), []byte(unbalanced), 0o600))
+	_, err = c.readStatement(src, StatementRef{Source: DefaultSourceName, Name: "user@mail.com.sta"})
+	assert.EqualError(t, err, "unreconciled statement: opening balance 100.00 plus transactions is 160.50 but the declared closing balance is 150.00")
+}
@@ -0,0 +1,491 @@
+package usecase
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sendgrid/rest"
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultSendGridHost is the host of the sendgrid v3 API
+	defaultSendGridHost = "https://api.sendgrid.com"
+	// maxSendAttempts is the number of times an email is sent before giving up on a temporary error
+	maxSendAttempts = 4
+	// minSendBackoff and maxSendBackoff bound the delay between attempts, it doubles on every attempt
+	minSendBackoff = 500 * time.Millisecond
+	maxSendBackoff = 30 * time.Second
+	// maxBatchRecipients is the number of recipients sendgrid takes in a request, counting to, cc and bcc of
+	// every personalization
+	maxBatchRecipients = 1000
+)
+
+// personalizationField matches the field of an error about a personalization, e.g. personalizations.3.to.0.email
+var personalizationField = regexp.MustCompile(`^personalizations\.(\d+)\.`)
+
+// sendgridMailer is the Mailer that sends the emails with a sendgrid dynamic template
+type sendgridMailer struct {
+	apiKey     string
+	templateID string
+	// renderer renders the emails locally when there's no dynamic template
+	renderer *Renderer
+	host     string
+	// client does the requests to the API, sendgrid.API by default
+	client func(request rest.Request) (*rest.Response, error)
+	// sleep waits between attempts
+	sleep func(d time.Duration)
+	// rate, burst and maxInFlight configure the limiter, none of them is limited by default
+	rate        float64
+	burst       int
+	maxInFlight int
+	limiter     *rateLimiter
+}
+
+// SendGridOption configures the sendgrid Mailer
+type SendGridOption func(m *sendgridMailer)
+
+// WithSendGridHost sets the host of the sendgrid API, https://api.sendgrid.com by default
+func WithSendGridHost(host string) SendGridOption {
+	return func(m *sendgridMailer) {
+		m.host = host
+	}
+}
+
+// WithSendGridRenderer sends the emails rendered locally instead of with a dynamic template, it's only used when the
+// template ID is empty
+func WithSendGridRenderer(renderer *Renderer) SendGridOption {
+	return func(m *sendgridMailer) {
+		m.renderer = renderer
+	}
+}
+
+// WithSendGridClient sets the function that does the requests to the sendgrid API
+func WithSendGridClient(client func(request rest.Request) (*rest.Response, error)) SendGridOption {
+	return func(m *sendgridMailer) {
+		m.client = client
+	}
+}
+
+// WithSendGridRateLimit sends up to perSecond requests per second, with room for burst requests at once. The rate
+// goes down while sendgrid answers 429 or its rate limit headers say there are few requests left
+func WithSendGridRateLimit(perSecond float64, burst int) SendGridOption {
+	return func(m *sendgridMailer) {
+		m.rate, m.burst = perSecond, burst
+	}
+}
+
+// WithSendGridMaxInFlight sends up to n requests at a time
+func WithSendGridMaxInFlight(n int) SendGridOption {
+	return func(m *sendgridMailer) {
+		m.maxInFlight = n
+	}
+}
+
+// NewSendGridMailer returns a Mailer that sends the emails with the sendgrid dynamic template templateID, or
+// rendered by the renderer set with WithSendGridRenderer
+func NewSendGridMailer(apiKey, templateID string, options ...SendGridOption) Mailer {
+	m := &sendgridMailer{
+		apiKey:     apiKey,
+		templateID: templateID,
+		host:       defaultSendGridHost,
+		client:     sendgrid.API,
+		sleep:      time.Sleep,
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	m.limiter = newRateLimiter(m.rate, m.burst, m.maxInFlight)
+	// the limiter waits like the retries do
+	m.limiter.sleep = func(d time.Duration) { m.sleep(d) }
+	return m
+}
+
+// Send sends the email and returns the ID sendgrid gave to it (X-Message-Id). Temporary errors (429, 5xx and
+// transport errors) are retried with backoff, unless sendgrid asks to wait longer than maxSendBackoff
+func (m *sendgridMailer) Send(envelope Envelope, data templateData, attachments ...Attachment) (string, error) {
+	body, err := m.body(envelope, data, attachments)
+	if err != nil {
+		return "", err
+	}
+	return m.post(body, "the statement of "+data.Email)
+}
+
+// SendBatch sends the emails with a dynamic template and the same sender together, as the personalizations of a
+// request of up to maxBatchRecipients recipients. Emails rendered locally or with attachments are sent one by one.
+// A request is rejected as a whole, the emails whose personalization sendgrid points at fail and the rest are
+// sent again
+func (m *sendgridMailer) SendBatch(emails []Email) []SendResult {
+	results := make([]SendResult, len(emails))
+	var batches [][]int
+	// open are the batches being filled by sender
+	open := map[[2]Address]int{}
+	recipients := make([]int, len(emails))
+	for i, email := range emails {
+		if m.templateID == "" || len(email.Attachments) > 0 {
+			results[i].MessageID, results[i].Err = m.Send(email.Envelope, email.Data, email.Attachments...)
+			continue
+		}
+		cc, bcc := email.Envelope.copies(email.Data.Email)
+		recipients[i] = 1 + len(cc) + len(bcc)
+		key := [2]Address{email.Envelope.From, email.Envelope.ReplyTo}
+		b, found := open[key]
+		if found {
+			total := 0
+			for _, j := range batches[b] {
+				total += recipients[j]
+			}
+			found = total+recipients[i] <= maxBatchRecipients
+		}
+		if !found {
+			batches = append(batches, nil)
+			b = len(batches) - 1
+			open[key] = b
+		}
+		batches[b] = append(batches[b], i)
+	}
+	for _, batch := range batches {
+		m.sendBatch(emails, batch, results)
+	}
+	return results
+}
+
+// sendBatch sends the emails of a batch in one request, setting their results
+func (m *sendgridMailer) sendBatch(emails []Email, batch []int, results []SendResult) {
+	for len(batch) > 0 {
+		first := emails[batch[0]].Envelope
+		if first.From.Email == "" {
+			for _, i := range batch {
+				results[i].Err = fmt.Errorf("%w: the email has no sender", ErrPermanentDelivery)
+			}
+			return
+		}
+		mail := sendgridMail{From: sendgridAddress(first.From), TemplateID: m.templateID}
+		if first.ReplyTo.Email != "" {
+			replyTo := sendgridAddress(first.ReplyTo)
+			mail.ReplyTo = &replyTo
+		}
+		for _, i := range batch {
+			mail.Personalizations = append(mail.Personalizations, personalization(emails[i].Envelope, emails[i].Data))
+		}
+		body, err := json.Marshal(mail)
+		if err == nil {
+			var messageID string
+			messageID, err = m.post(body, fmt.Sprintf("a batch of %d statements", len(batch)))
+			if err == nil {
+				for _, i := range batch {
+					results[i].MessageID = messageID
+				}
+				return
+			}
+		}
+		rejected := rejectedPersonalizations(err)
+		if len(rejected) == 0 {
+			for _, i := range batch {
+				results[i].Err = err
+			}
+			return
+		}
+		var rest []int
+		for n, i := range batch {
+			if reason, found := rejected[n]; found {
+				results[i].Err = reason
+				continue
+			}
+			rest = append(rest, i)
+		}
+		if len(rest) == len(batch) {
+			// the errors point at no email of the batch, sending it again would be rejected the same way
+			for _, i := range rest {
+				results[i].Err = err
+			}
+			return
+		}
+		batch = rest
+	}
+}
+
+// rejectedPersonalizations returns the errors of the personalizations a rejected request points at, by their
+// index. It's empty when any error is not about a personalization, the whole request failed
+func rejectedPersonalizations(err error) map[int]*SendGridError {
+	var sgErr *SendGridError
+	if !errors.As(err, &sgErr) || sgErr.StatusCode != http.StatusBadRequest || len(sgErr.Errors) == 0 {
+		return nil
+	}
+	rejected := map[int]*SendGridError{}
+	for _, detail := range sgErr.Errors {
+		match := personalizationField.FindStringSubmatch(detail.Field)
+		if match == nil {
+			return nil
+		}
+		n, _ := strconv.Atoi(match[1])
+		if rejected[n] == nil {
+			rejected[n] = &SendGridError{StatusCode: sgErr.StatusCode}
+		}
+		rejected[n].Errors = append(rejected[n].Errors, detail)
+	}
+	return rejected
+}
+
+// post sends a request to the mail send endpoint and returns the ID sendgrid gave to it. Temporary errors are
+// retried with backoff, what describes the emails of the request in the logs
+func (m *sendgridMailer) post(body []byte, what string) (string, error) {
+	var (
+		messageID string
+		err       error
+	)
+	for attempt := 1; ; attempt++ {
+		messageID, err = m.postOnce(body)
+		if err == nil || errors.Is(err, ErrPermanentDelivery) || attempt == maxSendAttempts {
+			return messageID, err
+		}
+		backoff := sendBackoff(attempt, err)
+		if backoff > maxSendBackoff {
+			return "", err
+		}
+		logrus.Warnf("sending %s failed, attempt %d of %d, retrying in %s: %v", what, attempt, maxSendAttempts, backoff, err)
+		m.sleep(backoff)
+	}
+}
+
+func (m *sendgridMailer) postOnce(body []byte) (string, error) {
+	request := sendgrid.GetRequest(m.apiKey, "/v3/mail/send", m.host)
+	request.Method = "POST"
+	request.Body = body
+	m.limiter.acquire()
+	response, err := m.client(request)
+	m.limiter.release()
+	if err != nil {
+		return "", err
+	}
+	if response == nil {
+		// without a response the email may not have been sent, it's retried
+		return "", errors.New("sendgrid: no response")
+	}
+	m.limiter.observe(response.StatusCode, response.Headers)
+	if err := checkSendGridResponse(response); err != nil {
+		return "", err
+	}
+	return headerValue(response.Headers, "X-Message-Id"), nil
+}
+
+// SendGridErrorDetail is an entry of the errors sendgrid returns with a failed response
+type SendGridErrorDetail struct {
+	Message string `json:"message"`
+	Field   string `json:"field"`
+	Help    string `json:"help"`
+}
+
+// body returns the body of the request that sends the email
+func (m *sendgridMailer) body(envelope Envelope, data templateData, attachments []Attachment) ([]byte, error) {
+	if envelope.From.Email == "" {
+		return nil, fmt.Errorf("%w: the email has no sender", ErrPermanentDelivery)
+	}
+	mail := sendgridMail{
+		Personalizations: []sendgridPersonalization{personalization(envelope, data)},
+		From:             sendgridAddress(envelope.From),
+	}
+	if envelope.ReplyTo.Email != "" {
+		replyTo := sendgridAddress(envelope.ReplyTo)
+		mail.ReplyTo = &replyTo
+	}
+	if m.templateID == "" && m.renderer != nil {
+		email, err := m.renderer.Render(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: rendering the email: %v", ErrPermanentDelivery, err)
+		}
+		// the data is only for dynamic templates
+		mail.Personalizations[0].DynamicTemplateData = nil
+		mail.Subject = email.Subject
+		if email.Text != "" {
+			// sendgrid wants the plain text first
+			mail.Content = append(mail.Content, sendgridContent{Type: "text/plain", Value: email.Text})
+		}
+		mail.Content = append(mail.Content, sendgridContent{Type: "text/html", Value: email.HTML})
+	} else {
+		mail.TemplateID = m.templateID
+	}
+	for _, a := range attachments {
+		mail.Attachments = append(mail.Attachments, sendgridAttachment{
+			Content:     base64.StdEncoding.EncodeToString(a.Content),
+			Type:        a.ContentType,
+			Filename:    a.Filename,
+			Disposition: "attachment",
+		})
+	}
+	return json.Marshal(mail)
+}
+
+// sendgridMail is the body of a request to the mail send endpoint, with a dynamic template or an email rendered
+// locally
+type sendgridMail struct {
+	Personalizations []sendgridPersonalization `json:"personalizations"`
+	From             sendgridAddress           `json:"from"`
+	ReplyTo          *sendgridAddress          `json:"reply_to,omitempty"`
+	TemplateID       string                    `json:"template_id,omitempty"`
+	Subject          string                    `json:"subject,omitempty"`
+	Content          []sendgridContent         `json:"content,omitempty"`
+	Attachments      []sendgridAttachment      `json:"attachments,omitempty"`
+}
+
+// personalization returns the recipients of an email and the data of its dynamic template
+func personalization(envelope Envelope, data templateData) sendgridPersonalization {
+	cc, bcc := envelope.copies(data.Email)
+	p := sendgridPersonalization{
+		To:                  []sendgridAddress{{Email: data.Email}},
+		CC:                  sendgridAddresses(cc),
+		BCC:                 sendgridAddresses(bcc),
+		DynamicTemplateData: &data,
+	}
+	if envelope.Statement != "" {
+		// the events of the email come back with it
+		p.CustomArgs = map[string]string{statementArg: envelope.Statement}
+	}
+	return p
+}
+
+type sendgridPersonalization struct {
+	To                  []sendgridAddress `json:"to"`
+	CC                  []sendgridAddress `json:"cc,omitempty"`
+	BCC                 []sendgridAddress `json:"bcc,omitempty"`
+	DynamicTemplateData *templateData     `json:"dynamic_template_data,omitempty"`
+	CustomArgs          map[string]string `json:"custom_args,omitempty"`
+}
+
+type sendgridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+func sendgridAddresses(addresses []Address) []sendgridAddress {
+	var out []sendgridAddress
+	for _, a := range addresses {
+		out = append(out, sendgridAddress(a))
+	}
+	return out
+}
+
+type sendgridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// sendgridAttachment is an attachment of an email, its content is base64 encoded
+type sendgridAttachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+}
+
+// SendGridError is a response of sendgrid with a status other than 2xx. 429 and 5xx are temporary,
+// any other status is permanent and matches ErrPermanentDelivery
+type SendGridError struct {
+	StatusCode int
+	Errors     []SendGridErrorDetail
+	// RetryAfter is the delay asked by sendgrid with the Retry-After header, 0 if there was none
+	RetryAfter time.Duration
+}
+
+func (e *SendGridError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, detail := range e.Errors {
+		if detail.Field != "" {
+			messages = append(messages, fmt.Sprintf("%s (field: %s)", detail.Message, detail.Field))
+			continue
+		}
+		messages = append(messages, detail.Message)
+	}
+	status := fmt.Sprintf("sendgrid: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if len(messages) == 0 {
+		return status
+	}
+	return status + ": " + strings.Join(messages, "; ")
+}
+
+// Temporary tells if sending the email again may succeed
+func (e *SendGridError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+func (e *SendGridError) Is(target error) bool {
+	return target == ErrPermanentDelivery && !e.Temporary()
+}
+
+// Delay returns the delay asked by sendgrid with the Retry-After header
+func (e *SendGridError) Delay() time.Duration {
+	return e.RetryAfter
+}
+
+// checkSendGridResponse returns a SendGridError for responses with a status other than 2xx
+func checkSendGridResponse(response *rest.Response) error {
+	if response == nil || (response.StatusCode >= 200 && response.StatusCode < 300) {
+		return nil
+	}
+	sgErr := &SendGridError{
+		StatusCode: response.StatusCode,
+		RetryAfter: retryAfter(headerValue(response.Headers, "Retry-After"), time.Now()),
+	}
+	var body struct {
+		Errors []SendGridErrorDetail `json:"errors"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &body); err == nil {
+		sgErr.Errors = body.Errors
+	} else if text := strings.TrimSpace(response.Body); text != "" {
+		// errors from proxies and load balancers don't come in sendgrid's format
+		sgErr.Errors = []SendGridErrorDetail{{Message: text}}
+	}
+	return sgErr
+}
+
+// headerValue returns the first value of a header, the names of headers are case insensitive
+func headerValue(headers map[string][]string, name string) string {
+	for key, values := range headers {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// retryAfter parses a Retry-After header, either a number of seconds or an HTTP date. 0 if it's missing or invalid
+func retryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// sendBackoff returns the delay before an attempt after a temporary error: the Retry-After asked by sendgrid
+// or an exponential backoff with jitter, so the retries of many emails don't hit sendgrid at the same time
+func sendBackoff(attempt int, err error) time.Duration {
+	var delayed DelayedError
+	if errors.As(err, &delayed) && delayed.Delay() > 0 {
+		return delayed.Delay()
+	}
+	backoff := minSendBackoff
+	for i := 1; i < attempt && backoff < maxSendBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxSendBackoff {
+		backoff = maxSendBackoff
+	}
+	// a random delay between half and the whole backoff
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
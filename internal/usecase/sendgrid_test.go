@@ -0,0 +1,418 @@
+package usecase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/rest"
+	"github.com/stretchr/testify/assert"
+)
+
+// testEnvelope is the sender of the emails of the tests
+var testEnvelope = Envelope{From: Address{Email: "statements@bank.com"}}
+
+func TestNewSendGridMailer(t *testing.T) {
+	m := NewSendGridMailer("abcdefg", "template-id", WithSendGridHost("http://localhost:8080")).(*sendgridMailer)
+	assert.Equal(t, "abcdefg", m.apiKey)
+	assert.Equal(t, "template-id", m.templateID)
+	assert.Equal(t, "http://localhost:8080", m.host)
+}
+
+func Test_sendgridMailer_Send(t *testing.T) {
+	type args struct {
+		data templateData
+	}
+	tests := []struct {
+		name    string
+		args    args
+		client  func(request rest.Request) (*rest.Response, error)
+		wantErr bool
+	}{
+		{
+			name: "success: must send an email",
+			args: args{
+				data: templateData{
+					Email:          "test@email.com",
+					Name:           "test",
+					TotalBalance:   "34.74",
+					FirstMonthYear: "July 2021",
+					LastMonthYear:  "August 2021",
+					AvgDebit:       "35.25",
+					AvgCredit:      "-15.38",
+					MonthSummary: []monthOperation{
+						{
+							Month:        "July of 2021",
+							Transactions: 2,
+						},
+						{
+							Month:        "August of 2021",
+							Transactions: 2,
+						},
+					},
+				},
+			},
+			client: func(request rest.Request) (*rest.Response, error) {
+				body := "{\"personalizations\": [{\"to\": [{\"email\": \"test@email.com\"}],\"dynamic_template_data\":{\"email\":\"test@email.com\",\"name\":\"test\",\"total_balance\":\"34.74\",\"first_month_year\":\"July 2021\",\"last_month_year\":\"August 2021\",\"avg_debit\":\"35.25\",\"avg_credit\":\"-15.38\",\"month_summary\":[{\"month\":\"July of 2021\",\"transactions\":2},{\"month\":\"August of 2021\",\"transactions\":2}]}}],\"from\": {\"email\": \"statements@bank.com\"}}"
+				assert.JSONEq(t, body, string(request.Body))
+				return &rest.Response{
+					StatusCode: http.StatusAccepted,
+				}, nil
+			},
+			wantErr: false,
+		},
+		{
+			name: "failure: returns an error if couldn't send an email",
+			args: args{
+				data: templateData{
+					Email:          "test@email.com",
+					Name:           "test",
+					TotalBalance:   "34.74",
+					FirstMonthYear: "July 2021",
+					LastMonthYear:  "August 2021",
+					AvgDebit:       "35.25",
+					AvgCredit:      "-15.38",
+					MonthSummary: []monthOperation{
+						{
+							Month:        "July of 2021",
+							Transactions: 2,
+						},
+						{
+							Month:        "August of 2021",
+							Transactions: 2,
+						},
+					},
+				},
+			},
+			client: func(request rest.Request) (*rest.Response, error) {
+				body := "{\"personalizations\": [{\"to\": [{\"email\": \"test@email.com\"}],\"dynamic_template_data\":{\"email\":\"test@email.com\",\"name\":\"test\",\"total_balance\":\"34.74\",\"first_month_year\":\"July 2021\",\"last_month_year\":\"August 2021\",\"avg_debit\":\"35.25\",\"avg_credit\":\"-15.38\",\"month_summary\":[{\"month\":\"July of 2021\",\"transactions\":2},{\"month\":\"August of 2021\",\"transactions\":2}]}}],\"from\": {\"email\": \"statements@bank.com\"}}"
+				assert.JSONEq(t, body, string(request.Body))
+				return &rest.Response{
+					StatusCode: http.StatusBadRequest,
+				}, errors.New("something bad happened")
+			},
+			wantErr: true,
+		},
+		{
+			name: "failure: returns an error without a response, the email may not have been sent",
+			args: args{data: templateData{Email: "test@email.com"}},
+			client: func(request rest.Request) (*rest.Response, error) {
+				return nil, nil
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewSendGridMailer("abcdefg", "", WithSendGridClient(tt.client)).(*sendgridMailer)
+			m.sleep = func(time.Duration) {}
+			if _, err := m.Send(testEnvelope, tt.args.data); (err != nil) != tt.wantErr {
+				t.Errorf("Send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_checkSendGridResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		response      *rest.Response
+		wantErr       string
+		wantTemporary bool
+		wantRetry     time.Duration
+	}{
+		{
+			name:     "success: accepted",
+			response: &rest.Response{StatusCode: http.StatusAccepted},
+		},
+		{
+			name: "failure: bad request with sendgrid errors is permanent",
+			response: &rest.Response{
+				StatusCode: http.StatusBadRequest,
+				Body:       `{"errors":[{"message":"Does not contain a valid address.","field":"personalizations.0.to.0.email","help":null},{"message":"The from address does not match a verified Sender Identity."}]}`,
+			},
+			wantErr: "sendgrid: 400 Bad Request: Does not contain a valid address. (field: personalizations.0.to.0.email); " +
+				"The from address does not match a verified Sender Identity.",
+		},
+		{
+			name:          "failure: too many requests is temporary and keeps the retry after",
+			response:      &rest.Response{StatusCode: http.StatusTooManyRequests, Headers: map[string][]string{"retry-after": {"7"}}},
+			wantErr:       "sendgrid: 429 Too Many Requests",
+			wantTemporary: true,
+			wantRetry:     7 * time.Second,
+		},
+		{
+			name:          "failure: a body that is not json is kept as the message",
+			response:      &rest.Response{StatusCode: http.StatusBadGateway, Body: "upstream unavailable\n"},
+			wantErr:       "sendgrid: 502 Bad Gateway: upstream unavailable",
+			wantTemporary: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSendGridResponse(tt.response)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var sgErr *SendGridError
+			if !errors.As(err, &sgErr) {
+				t.Fatalf("checkSendGridResponse() error = %v, want a *SendGridError", err)
+			}
+			assert.EqualError(t, err, tt.wantErr)
+			assert.Equal(t, tt.wantTemporary, sgErr.Temporary())
+			assert.Equal(t, !tt.wantTemporary, errors.Is(err, ErrPermanentDelivery))
+			assert.Equal(t, tt.wantRetry, sgErr.RetryAfter)
+		})
+	}
+}
+
+func Test_retryAfter(t *testing.T) {
+	now := time.Date(2021, 8, 31, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 30*time.Second, retryAfter("30", now))
+	assert.Equal(t, 90*time.Second, retryAfter("Tue, 31 Aug 2021 12:01:30 GMT", now))
+	assert.Equal(t, time.Duration(0), retryAfter("Tue, 31 Aug 2021 11:00:00 GMT", now))
+	assert.Equal(t, time.Duration(0), retryAfter("soon", now))
+	assert.Equal(t, time.Duration(0), retryAfter("", now))
+}
+
+func Test_sendBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		backoff := sendBackoff(attempt, errors.New("connection reset"))
+		assert.GreaterOrEqual(t, backoff, minSendBackoff/2)
+		assert.LessOrEqual(t, backoff, maxSendBackoff)
+	}
+	assert.Equal(t, 5*time.Second, sendBackoff(1, &SendGridError{StatusCode: http.StatusTooManyRequests, RetryAfter: 5 * time.Second}))
+}
+
+func Test_sendgridMailer_Send_retries(t *testing.T) {
+	tests := []struct {
+		name         string
+		responses    []*rest.Response
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{
+			name:         "success: temporary errors are retried",
+			responses:    []*rest.Response{{StatusCode: http.StatusServiceUnavailable}, nil, {StatusCode: http.StatusAccepted}},
+			errs:         []error{nil, errors.New("connection reset"), nil},
+			wantAttempts: 3,
+		},
+		{
+			name:         "failure: permanent errors are not retried",
+			responses:    []*rest.Response{{StatusCode: http.StatusUnauthorized, Body: `{"errors":[{"message":"The provided authorization grant is invalid, expired, or revoked"}]}`}},
+			errs:         []error{nil},
+			wantAttempts: 1,
+			wantErr:      ErrPermanentDelivery,
+		},
+		{
+			name: "failure: gives up after the last attempt",
+			responses: []*rest.Response{
+				{StatusCode: http.StatusInternalServerError},
+				{StatusCode: http.StatusInternalServerError},
+				{StatusCode: http.StatusInternalServerError},
+				{StatusCode: http.StatusInternalServerError},
+			},
+			errs:         []error{nil, nil, nil, nil},
+			wantAttempts: maxSendAttempts,
+		},
+		{
+			name:         "failure: a long retry after is left to the outbox",
+			responses:    []*rest.Response{{StatusCode: http.StatusTooManyRequests, Headers: map[string][]string{"Retry-After": {"120"}}}},
+			errs:         []error{nil},
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			m := NewSendGridMailer("abcdefg", "", WithSendGridClient(func(request rest.Request) (*rest.Response, error) {
+				attempts++
+				return tt.responses[attempts-1], tt.errs[attempts-1]
+			})).(*sendgridMailer)
+			m.sleep = func(time.Duration) {}
+			_, err := m.Send(testEnvelope, templateData{Email: "test@email.com"})
+			assert.Equal(t, tt.wantAttempts, attempts)
+			last := tt.responses[len(tt.responses)-1]
+			if last != nil && last.StatusCode == http.StatusAccepted {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_sendgridMailer_Send_rendered(t *testing.T) {
+	renderer, err := NewRenderer("Statement of {{first_month_year}}", `<p class="x">Dear {{name}}</p>`, "Dear {{name}}")
+	assert.NoError(t, err)
+	var body string
+	m := NewSendGridMailer("abcdefg", "", WithSendGridRenderer(renderer), WithSendGridClient(func(request rest.Request) (*rest.Response, error) {
+		body = string(request.Body)
+		return &rest.Response{StatusCode: http.StatusAccepted}, nil
+	}))
+	_, err = m.Send(testEnvelope, templateData{Email: "test@email.com", Name: "test", FirstMonthYear: "July 2021"})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"personalizations": [{"to": [{"email": "test@email.com"}]}],
+		"from": {"email": "statements@bank.com"},
+		"subject": "Statement of July 2021",
+		"content": [{"type": "text/plain", "value": "Dear test"}, {"type": "text/html", "value": "<p class=\"x\">Dear test</p>"}]
+	}`, body)
+}
+
+func Test_sendgridMailer_Send_attachments(t *testing.T) {
+	var body string
+	m := NewSendGridMailer("abcdefg", "d-123", WithSendGridClient(func(request rest.Request) (*rest.Response, error) {
+		body = string(request.Body)
+		return &rest.Response{StatusCode: http.StatusAccepted}, nil
+	}))
+	_, err := m.Send(testEnvelope, templateData{Email: "test@email.com", Name: "test"},
+		Attachment{Filename: "statement-2021-07.pdf", ContentType: "application/pdf", Content: []byte("%PDF-1.7")})
+	assert.NoError(t, err)
+	var mail sendgridMail
+	assert.NoError(t, json.Unmarshal([]byte(body), &mail))
+	assert.Equal(t, "d-123", mail.TemplateID)
+	assert.Equal(t, []sendgridAttachment{
+		{Content: "JVBERi0xLjc=", Type: "application/pdf", Filename: "statement-2021-07.pdf", Disposition: "attachment"},
+	}, mail.Attachments)
+}
+
+func Test_sendgridMailer_Send_envelope(t *testing.T) {
+	var body []byte
+	m := NewSendGridMailer("abcdefg", "d-123", WithSendGridClient(func(request rest.Request) (*rest.Response, error) {
+		body = request.Body
+		return &rest.Response{StatusCode: http.StatusAccepted}, nil
+	}))
+	_, err := m.Send(Envelope{
+		From:      Address{Email: "statements@tenant.com", Name: `Tenant "Bank", S.A. de C.V.`},
+		ReplyTo:   Address{Email: "support@tenant.com", Name: "Soporte"},
+		CC:        []Address{{Email: "john@mail.com"}, {Email: "TEST@email.com"}},
+		BCC:       []Address{{Email: "compliance@bank.com"}, {Email: "john@mail.com"}},
+		Statement: "test@email.com|2021-07/2021-07|abc",
+	}, templateData{Email: "test@email.com", Name: `O'Brien "Jr"`})
+	assert.NoError(t, err)
+
+	var mail sendgridMail
+	assert.NoError(t, json.Unmarshal(body, &mail))
+	assert.Equal(t, sendgridAddress{Email: "statements@tenant.com", Name: `Tenant "Bank", S.A. de C.V.`}, mail.From)
+	assert.Equal(t, &sendgridAddress{Email: "support@tenant.com", Name: "Soporte"}, mail.ReplyTo)
+	// sendgrid rejects an address given twice in a personalization
+	assert.Equal(t, []sendgridAddress{{Email: "john@mail.com"}}, mail.Personalizations[0].CC)
+	assert.Equal(t, []sendgridAddress{{Email: "compliance@bank.com"}}, mail.Personalizations[0].BCC)
+	assert.Equal(t, `O'Brien "Jr"`, mail.Personalizations[0].DynamicTemplateData.Name)
+	assert.Equal(t, map[string]string{"statement": "test@email.com|2021-07/2021-07|abc"}, mail.Personalizations[0].CustomArgs)
+
+	_, err = m.Send(Envelope{}, templateData{Email: "test@email.com"})
+	assert.True(t, errors.Is(err, ErrPermanentDelivery), err)
+}
+
+func Test_sendgridMailer_SendBatch(t *testing.T) {
+	var requests []sendgridMail
+	m := NewSendGridMailer("abcdefg", "d-123", WithSendGridClient(func(request rest.Request) (*rest.Response, error) {
+		var mail sendgridMail
+		assert.NoError(t, json.Unmarshal(request.Body, &mail))
+		requests = append(requests, mail)
+		for n, p := range mail.Personalizations {
+			if p.To[0].Email == "invalid@email" {
+				return &rest.Response{
+					StatusCode: http.StatusBadRequest,
+					Body:       fmt.Sprintf(`{"errors": [{"message": "Does not contain a valid address.", "field": "personalizations.%d.to.0.email"}]}`, n),
+				}, nil
+			}
+		}
+		return &rest.Response{
+			StatusCode: http.StatusAccepted,
+			Headers:    map[string][]string{"X-Message-Id": {fmt.Sprintf("msg-%d", len(requests))}},
+		}, nil
+	}))
+	tenant := Envelope{From: Address{Email: "statements@tenant.com"}}
+	results := m.(BatchMailer).SendBatch([]Email{
+		{Envelope: testEnvelope, Data: templateData{Email: "a@email.com"}},
+		{Envelope: tenant, Data: templateData{Email: "b@email.com"}},
+		{Envelope: testEnvelope, Data: templateData{Email: "invalid@email"}},
+		{Envelope: testEnvelope, Data: templateData{Email: "c@email.com"}, Attachments: []Attachment{{Filename: "statement.pdf"}}},
+		{Envelope: testEnvelope, Data: templateData{Email: "d@email.com"}},
+	})
+
+	// the attachment goes alone, then a request by sender, and the rejected one is sent again without its email
+	if assert.Len(t, requests, 4) {
+		assert.Len(t, requests[0].Personalizations, 1)
+		assert.Len(t, requests[0].Attachments, 1)
+		assert.Len(t, requests[1].Personalizations, 3)
+		assert.Equal(t, sendgridAddress{Email: "statements@bank.com"}, requests[1].From)
+		assert.Equal(t, []sendgridAddress{{Email: "a@email.com"}}, requests[2].Personalizations[0].To)
+		assert.Equal(t, []sendgridAddress{{Email: "d@email.com"}}, requests[2].Personalizations[1].To)
+		assert.Equal(t, sendgridAddress{Email: "statements@tenant.com"}, requests[3].From)
+	}
+	assert.Equal(t, SendResult{MessageID: "msg-3"}, results[0])
+	assert.Equal(t, SendResult{MessageID: "msg-4"}, results[1])
+	assert.True(t, errors.Is(results[2].Err, ErrPermanentDelivery), results[2].Err)
+	assert.Contains(t, results[2].Err.Error(), "personalizations.1.to.0.email")
+	assert.Equal(t, SendResult{MessageID: "msg-1"}, results[3])
+	assert.Equal(t, SendResult{MessageID: "msg-3"}, results[4])
+}
+
+func Test_sendgridMailer_SendBatch_maxRecipients(t *testing.T) {
+	var personalizations []int
+	m := NewSendGridMailer("abcdefg", "d-123", WithSendGridClient(func(request rest.Request) (*rest.Response, error) {
+		var mail sendgridMail
+		assert.NoError(t, json.Unmarshal(request.Body, &mail))
+		personalizations = append(personalizations, len(mail.Personalizations))
+		return &rest.Response{StatusCode: http.StatusAccepted}, nil
+	}))
+	envelope := testEnvelope
+	envelope.CC = []Address{{Email: "joint@email.com"}}
+	emails := make([]Email, 600)
+	for i := range emails {
+		emails[i] = Email{Envelope: envelope, Data: templateData{Email: fmt.Sprintf("%d@email.com", i)}}
+	}
+
+	results := m.(BatchMailer).SendBatch(emails)
+	// every personalization has two recipients
+	assert.Equal(t, []int{500, 100}, personalizations)
+	assert.Len(t, results, 600)
+}
+
+func Test_sendgridMailer_SendBatch_unknownPersonalization(t *testing.T) {
+	requests := 0
+	m := NewSendGridMailer("abcdefg", "d-123", WithSendGridClient(func(request rest.Request) (*rest.Response, error) {
+		requests++
+		return &rest.Response{
+			StatusCode: http.StatusBadRequest,
+			Body:       `{"errors": [{"message": "Does not contain a valid address.", "field": "personalizations.5.to.0.email"}]}`,
+		}, nil
+	}))
+	results := m.(BatchMailer).SendBatch([]Email{
+		{Envelope: testEnvelope, Data: templateData{Email: "a@email.com"}},
+		{Envelope: testEnvelope, Data: templateData{Email: "b@email.com"}},
+	})
+
+	// the rejected index matches no email, so the batch isn't sent again
+	assert.Equal(t, 1, requests)
+	for _, result := range results {
+		assert.Empty(t, result.MessageID)
+		assert.Contains(t, result.Err.Error(), "personalizations.5.to.0.email")
+	}
+}
+
+func Test_sendgridMailer_SendBatch_failed(t *testing.T) {
+	m := NewSendGridMailer("abcdefg", "d-123", WithSendGridClient(func(request rest.Request) (*rest.Response, error) {
+		return &rest.Response{StatusCode: http.StatusUnauthorized, Body: `{"errors": [{"message": "invalid api key"}]}`}, nil
+	}))
+	results := m.(BatchMailer).SendBatch([]Email{
+		{Envelope: testEnvelope, Data: templateData{Email: "a@email.com"}},
+		{Envelope: testEnvelope, Data: templateData{Email: "b@email.com"}},
+	})
+	for _, result := range results {
+		assert.Empty(t, result.MessageID)
+		assert.Contains(t, result.Err.Error(), "invalid api key")
+	}
+}
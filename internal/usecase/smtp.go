@@ -0,0 +1,461 @@
+package usecase
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSMTPPoolSize is the number of idle connections kept open to the SMTP server
+	defaultSMTPPoolSize = 2
+	// defaultSMTPTimeout bounds the connection to the SMTP server and then each email, so a server that hangs
+	// doesn't block the dispatch
+	defaultSMTPTimeout = time.Minute
+)
+
+// SMTPError is a reply of the SMTP server refusing an email. 4xx replies are temporary, 5xx replies are
+// permanent and match ErrPermanentDelivery
+type SMTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *SMTPError) Error() string {
+	return fmt.Sprintf("smtp: %d %s", e.Code, e.Message)
+}
+
+func (e *SMTPError) Is(target error) bool {
+	return target == ErrPermanentDelivery && e.Code >= 500
+}
+
+// smtpMailer is the Mailer that sends the emails to an SMTP server, rendering them locally. The connections
+// are upgraded with STARTTLS and kept open to send the next emails
+type smtpMailer struct {
+	addr string
+	host string
+	// from is the address the server returns the bounces to (MAIL FROM), and the From header of the emails
+	// without a sender
+	from     Address
+	renderer *Renderer
+	auth     smtp.Auth
+	// insecure allows sending the emails over a plain connection to servers without STARTTLS
+	insecure  bool
+	tlsConfig *tls.Config
+	// timeout bounds the dial, and the exchange of every email from the moment its connection is taken
+	timeout time.Duration
+	// idle are the open connections waiting for the next email
+	idle chan *smtpConn
+	now  func() time.Time
+}
+
+// smtpConn is a client with its network connection, the deadline of the connection is moved for every email
+type smtpConn struct {
+	*smtp.Client
+	conn net.Conn
+}
+
+// SMTPOption configures the SMTP Mailer
+type SMTPOption func(m *smtpMailer) error
+
+// WithSMTPAuth authenticates to the SMTP server with the PLAIN or LOGIN mechanism. Credentials are only sent over
+// TLS, or to localhost
+func WithSMTPAuth(mechanism, username, password string) SMTPOption {
+	return func(m *smtpMailer) error {
+		switch strings.ToLower(mechanism) {
+		case "", "plain":
+			m.auth = smtp.PlainAuth("", username, password, m.host)
+		case "login":
+			m.auth = &loginAuth{username: username, password: password, host: m.host}
+		default:
+			return fmt.Errorf("unknown SMTP auth mechanism %q, use plain or login", mechanism)
+		}
+		return nil
+	}
+}
+
+// WithSMTPPoolSize sets the number of idle connections kept open, 0 closes every connection after its email
+func WithSMTPPoolSize(size int) SMTPOption {
+	return func(m *smtpMailer) error {
+		if size < 0 {
+			return fmt.Errorf("invalid SMTP pool size %d", size)
+		}
+		m.idle = make(chan *smtpConn, size)
+		return nil
+	}
+}
+
+// WithSMTPTimeout sets how long connecting to the SMTP server, and then sending each email, may take
+func WithSMTPTimeout(timeout time.Duration) SMTPOption {
+	return func(m *smtpMailer) error {
+		if timeout <= 0 {
+			return fmt.Errorf("invalid SMTP timeout %s", timeout)
+		}
+		m.timeout = timeout
+		return nil
+	}
+}
+
+// WithSMTPTLSConfig sets the TLS configuration of STARTTLS, e.g. to trust the certificate of a corporate relay
+func WithSMTPTLSConfig(config *tls.Config) SMTPOption {
+	return func(m *smtpMailer) error {
+		m.tlsConfig = config
+		return nil
+	}
+}
+
+// WithSMTPInsecure allows sending the emails to servers that don't support STARTTLS, e.g. a local test server
+func WithSMTPInsecure() SMTPOption {
+	return func(m *smtpMailer) error {
+		m.insecure = true
+		return nil
+	}
+}
+
+// NewSMTPMailer returns a Mailer that sends the emails rendered with renderer to the SMTP server at addr (host:port).
+// The Mailer implements io.Closer to close the idle connections
+func NewSMTPMailer(addr, from string, renderer *Renderer, options ...SMTPOption) (Mailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: %w", err)
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: invalid from address: %w", err)
+	}
+	m := &smtpMailer{
+		addr:      addr,
+		host:      host,
+		from:      Address{Email: sender.Address, Name: sender.Name},
+		renderer:  renderer,
+		tlsConfig: &tls.Config{ServerName: host},
+		timeout:   defaultSMTPTimeout,
+		idle:      make(chan *smtpConn, defaultSMTPPoolSize),
+		now:       time.Now,
+	}
+	for _, opt := range options {
+		if err := opt(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Send renders the email and sends it, returning the Message-ID it was sent with
+func (m *smtpMailer) Send(envelope Envelope, data templateData, attachments ...Attachment) (string, error) {
+	email, err := m.renderer.Render(data)
+	if err != nil {
+		// the same data will fail to render again
+		return "", fmt.Errorf("%w: rendering the email: %v", ErrPermanentDelivery, err)
+	}
+	messageID, err := m.messageID()
+	if err != nil {
+		return "", err
+	}
+	if envelope.From.Email == "" {
+		envelope.From = m.from
+	}
+	msg, err := m.message(envelope, data.Email, messageID, email, attachments)
+	if err != nil {
+		return "", err
+	}
+	// the blind copies are recipients without a header
+	cc, bcc := envelope.copies(data.Email)
+	recipients := []string{data.Email}
+	for _, a := range append(cc, bcc...) {
+		recipients = append(recipients, a.Email)
+	}
+	c, err := m.client()
+	if err != nil {
+		return "", smtpError(err)
+	}
+	if err := deliver(c.Client, m.from.Email, recipients, msg); err != nil {
+		// the state of the connection is unknown, it's not reused
+		c.Close()
+		return "", smtpError(err)
+	}
+	m.release(c)
+	return messageID, nil
+}
+
+// Close closes the idle connections
+func (m *smtpMailer) Close() error {
+	for {
+		select {
+		case c := <-m.idle:
+			c.Quit()
+		default:
+			return nil
+		}
+	}
+}
+
+// client returns an idle connection that is still alive or a new one, with the deadline of an email
+func (m *smtpMailer) client() (*smtpConn, error) {
+	for {
+		select {
+		case c := <-m.idle:
+			if err := c.conn.SetDeadline(time.Now().Add(m.timeout)); err != nil {
+				c.Close()
+				continue
+			}
+			if err := c.Reset(); err == nil {
+				return c, nil
+			}
+			c.Close()
+		default:
+			return m.dial()
+		}
+	}
+}
+
+// release keeps a connection for the next email, or closes it when there are enough idle ones
+func (m *smtpMailer) release(c *smtpConn) {
+	select {
+	case m.idle <- c:
+	default:
+		c.Quit()
+	}
+}
+
+func (m *smtpMailer) dial() (*smtpConn, error) {
+	conn, err := net.DialTimeout("tcp", m.addr, m.timeout)
+	if err != nil {
+		return nil, err
+	}
+	// the greeting, STARTTLS and the authentication count towards the first email
+	if err := conn.SetDeadline(time.Now().Add(m.timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(m.tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	} else if !m.insecure {
+		c.Close()
+		return nil, fmt.Errorf("%w: smtp: %s doesn't support STARTTLS", ErrPermanentDelivery, m.host)
+	}
+	if m.auth != nil {
+		if err := c.Auth(m.auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return &smtpConn{Client: c, conn: conn}, nil
+}
+
+// message builds the email with its headers. Emails with a plain text body are multipart/alternative, the
+// bodies are quoted-printable encoded. Attachments make it multipart/mixed, with the body as the first part
+func (m *smtpMailer) message(envelope Envelope, to, messageID string, email RenderedEmail, attachments []Attachment) ([]byte, error) {
+	var b bytes.Buffer
+	headers := [][2]string{
+		{"From", envelope.From.String()},
+		{"To", Address{Email: to}.String()},
+	}
+	if cc, _ := envelope.copies(to); len(cc) > 0 {
+		list := make([]string, len(cc))
+		for i, a := range cc {
+			list[i] = a.String()
+		}
+		headers = append(headers, [2]string{"Cc", strings.Join(list, ", ")})
+	}
+	if envelope.ReplyTo.Email != "" {
+		headers = append(headers, [2]string{"Reply-To", envelope.ReplyTo.String()})
+	}
+	headers = append(headers,
+		[2]string{"Subject", mime.QEncoding.Encode("utf-8", email.Subject)},
+		[2]string{"Date", m.now().Format(time.RFC1123Z)},
+		[2]string{"Message-ID", "<" + messageID + ">"},
+		[2]string{"MIME-Version", "1.0"},
+	)
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", h[0], h[1])
+	}
+	contentType, body, err := messageBody(email)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) == 0 {
+		fmt.Fprintf(&b, "Content-Type: %s\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n", contentType)
+		b.Write(body)
+		return b.Bytes(), nil
+	}
+	parts := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+	w, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(a.ContentType, map[string]string{"name": a.Filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64(w, a.Content); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// messageBody returns the content type and the body of an email: the HTML, or the plain text and the HTML as
+// alternatives. The parts are quoted-printable encoded
+func messageBody(email RenderedEmail) (string, []byte, error) {
+	var b bytes.Buffer
+	if email.Text == "" {
+		if err := writeQuotedPrintable(&b, email.HTML); err != nil {
+			return "", nil, err
+		}
+		return "text/html; charset=UTF-8", b.Bytes(), nil
+	}
+	parts := multipart.NewWriter(&b)
+	// the last part is the preferred one
+	for _, part := range [][2]string{{"text/plain", email.Text}, {"text/html", email.HTML}} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part[0] + "; charset=UTF-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		if err := writeQuotedPrintable(w, part[1]); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return "", nil, err
+	}
+	return "multipart/alternative; boundary=" + parts.Boundary(), b.Bytes(), nil
+}
+
+// writeBase64 writes content base64 encoded in lines of 76 characters
+func writeBase64(w io.Writer, content []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 0 {
+		n := 76
+		if len(encoded) < n {
+			n = len(encoded)
+		}
+		if _, err := io.WriteString(w, encoded[:n]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// messageID returns a unique ID for an email, in the domain of the sender
+func (m *smtpMailer) messageID() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	domain := m.from.Email[strings.LastIndex(m.from.Email, "@")+1:]
+	return fmt.Sprintf("%d.%s@%s", m.now().UnixNano(), hex.EncodeToString(random), domain), nil
+}
+
+// deliver sends an email over an open connection
+func deliver(c *smtp.Client, from string, to []string, msg []byte) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// smtpError converts the replies of the SMTP server to a SMTPError, other errors (e.g. network errors) are
+// returned as they are and are temporary
+func smtpError(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return &SMTPError{Code: reply.Code, Message: reply.Msg}
+	}
+	return err
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp doesn't have. Like smtp.PlainAuth, it only sends the
+// credentials over TLS or to localhost
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,295 @@
+package usecase
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpStub is a local SMTP server that keeps the emails it receives. It doesn't support STARTTLS
+type smtpStub struct {
+	addr string
+	// rcptReply is the reply to RCPT TO
+	rcptReply string
+
+	mu          sync.Mutex
+	connections int
+	credentials []string
+	recipients  []string
+	messages    []string
+}
+
+func newSMTPStub(t *testing.T, rcptReply string) *smtpStub {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &smtpStub{addr: ln.Addr().String(), rcptReply: rcptReply}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP stub")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch strings.ToUpper(fields[0]) {
+		case "EHLO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 AUTH PLAIN LOGIN")
+		case "AUTH":
+			s.auth(tp, fields)
+		case "RCPT":
+			s.mu.Lock()
+			s.recipients = append(s.recipients, strings.Trim(strings.TrimPrefix(fields[1], "TO:"), "<>"))
+			s.mu.Unlock()
+			tp.PrintfLine(s.rcptReply)
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (s *smtpStub) auth(tp *textproto.Conn, fields []string) {
+	var credentials string
+	switch strings.ToUpper(fields[1]) {
+	case "PLAIN":
+		decoded, _ := base64.StdEncoding.DecodeString(fields[2])
+		credentials = "PLAIN " + strings.TrimPrefix(strings.ReplaceAll(string(decoded), "\x00", " "), " ")
+	case "LOGIN":
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+		username, _ := tp.ReadLine()
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+		password, _ := tp.ReadLine()
+		decodedUser, _ := base64.StdEncoding.DecodeString(username)
+		decodedPass, _ := base64.StdEncoding.DecodeString(password)
+		credentials = "LOGIN " + string(decodedUser) + " " + string(decodedPass)
+	}
+	s.mu.Lock()
+	s.credentials = append(s.credentials, credentials)
+	s.mu.Unlock()
+	tp.PrintfLine("235 authenticated")
+}
+
+func Test_smtpMailer_Send(t *testing.T) {
+	renderer, err := NewRenderer("Your account statement", "<p>Dear {{name}}, your balance is {{total_balance}}</p>", "")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		mechanism       string
+		wantCredentials string
+	}{
+		{name: "success: sends with AUTH PLAIN", mechanism: "plain", wantCredentials: "PLAIN user secret"},
+		{name: "success: sends with AUTH LOGIN", mechanism: "login", wantCredentials: "LOGIN user secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newSMTPStub(t, "250 OK")
+			mailer, err := NewSMTPMailer(stub.addr, "Statements <statements@bank.com>", renderer,
+				WithSMTPInsecure(), WithSMTPAuth(tt.mechanism, "user", "secret"))
+			assert.NoError(t, err)
+			defer mailer.(*smtpMailer).Close()
+
+			for _, name := range []string{"Jane", "John"} {
+				id, err := mailer.Send(Envelope{}, templateData{Email: strings.ToLower(name) + "@mail.com", Name: name, TotalBalance: "34.74"})
+				assert.NoError(t, err)
+				assert.True(t, strings.HasSuffix(id, "@bank.com"), id)
+			}
+
+			stub.mu.Lock()
+			defer stub.mu.Unlock()
+			// the connection is reused for the second email, the stub reads the lines without CRLF
+			assert.Equal(t, 1, stub.connections)
+			assert.Equal(t, []string{tt.wantCredentials}, stub.credentials)
+			assert.Len(t, stub.messages, 2)
+			assert.Contains(t, stub.messages[0], "From: \"Statements\" <statements@bank.com>\n")
+			assert.Contains(t, stub.messages[0], "To: <jane@mail.com>\n")
+			assert.Contains(t, stub.messages[0], "Subject: Your account statement\n")
+			assert.Contains(t, stub.messages[0], "Content-Type: text/html; charset=UTF-8\n")
+			assert.Contains(t, stub.messages[1], "<p>Dear John, your balance is 34.74</p>")
+		})
+	}
+}
+
+func Test_smtpMailer_Send_envelope(t *testing.T) {
+	renderer, err := NewRenderer("Your account statement", "<p>Dear {{name}}</p>", "")
+	assert.NoError(t, err)
+	stub := newSMTPStub(t, "250 OK")
+	mailer, err := NewSMTPMailer(stub.addr, "bounces@bank.com", renderer, WithSMTPInsecure())
+	assert.NoError(t, err)
+	defer mailer.(*smtpMailer).Close()
+
+	_, err = mailer.Send(Envelope{
+		From:    Address{Email: "statements@tenant.com", Name: "Tenant, Inc."},
+		ReplyTo: Address{Email: "support@tenant.com"},
+		CC:      []Address{{Email: "john@mail.com"}, {Email: "Jane@mail.com"}},
+		BCC:     []Address{{Email: "compliance@bank.com"}, {Email: "john@mail.com"}},
+	}, templateData{Email: "jane@mail.com", Name: "Jane"})
+	assert.NoError(t, err)
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	// the recipient and the repeated addresses are sent once, the blind copies have no header
+	assert.Equal(t, []string{"jane@mail.com", "john@mail.com", "compliance@bank.com"}, stub.recipients)
+	assert.Contains(t, stub.messages[0], "From: \"Tenant, Inc.\" <statements@tenant.com>\n")
+	assert.Contains(t, stub.messages[0], "Cc: <john@mail.com>\n")
+	assert.Contains(t, stub.messages[0], "Reply-To: <support@tenant.com>\n")
+	assert.NotContains(t, stub.messages[0], "compliance@bank.com")
+}
+
+func Test_smtpMailer_Send_errors(t *testing.T) {
+	renderer, err := NewRenderer("Your account statement", "<p>Dear {{name}}</p>", "")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		rcptReply     string
+		options       []SMTPOption
+		wantPermanent bool
+	}{
+		{
+			name:          "failure: a 5xx reply is permanent",
+			rcptReply:     "550 mailbox unavailable",
+			options:       []SMTPOption{WithSMTPInsecure()},
+			wantPermanent: true,
+		},
+		{
+			name:      "failure: a 4xx reply is temporary",
+			rcptReply: "451 try again later",
+			options:   []SMTPOption{WithSMTPInsecure()},
+		},
+		{
+			name:          "failure: servers without STARTTLS are refused",
+			rcptReply:     "250 OK",
+			wantPermanent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newSMTPStub(t, tt.rcptReply)
+			mailer, err := NewSMTPMailer(stub.addr, "statements@bank.com", renderer, tt.options...)
+			assert.NoError(t, err)
+			defer mailer.(*smtpMailer).Close()
+
+			_, err = mailer.Send(Envelope{}, templateData{Email: "jane@mail.com", Name: "Jane"})
+			assert.Error(t, err)
+			assert.Equal(t, tt.wantPermanent, errors.Is(err, ErrPermanentDelivery), err)
+		})
+	}
+}
+
+func Test_smtpMailer_Send_timeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	// a server that accepts the connection and never greets
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(5 * time.Second)
+	}()
+	renderer, err := NewRenderer("Your account statement", "<p>Dear {{name}}</p>", "")
+	assert.NoError(t, err)
+	mailer, err := NewSMTPMailer(ln.Addr().String(), "statements@bank.com", renderer, WithSMTPInsecure(), WithSMTPTimeout(100*time.Millisecond))
+	assert.NoError(t, err)
+
+	start := time.Now()
+	_, err = mailer.Send(Envelope{}, templateData{Email: "jane@mail.com", Name: "Jane"})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestNewSMTPMailer_invalid(t *testing.T) {
+	_, err := NewSMTPMailer("localhost", "statements@bank.com", nil)
+	assert.Error(t, err)
+	_, err = NewSMTPMailer("localhost:25", "statements", nil)
+	assert.Error(t, err)
+	_, err = NewSMTPMailer("localhost:25", "statements@bank.com", nil, WithSMTPAuth("cram-md5", "user", "secret"))
+	assert.Error(t, err)
+	_, err = NewSMTPMailer("localhost:25", "statements@bank.com", nil, WithSMTPTimeout(0))
+	assert.Error(t, err)
+}
+
+func Test_smtpMailer_message(t *testing.T) {
+	m := &smtpMailer{from: Address{Email: "statements@bank.com"}, now: func() time.Time { return time.Date(2021, 8, 31, 12, 0, 0, 0, time.UTC) }}
+	tests := []struct {
+		name        string
+		email       RenderedEmail
+		attachments []Attachment
+		want        []string
+	}{
+		{
+			name:  "success: html only",
+			email: RenderedEmail{Subject: "Estado de cuenta año 2021", HTML: "<p>Dear Jane</p>"},
+			want: []string{
+				"Subject: =?utf-8?q?Estado_de_cuenta_a=C3=B1o_2021?=\r\n",
+				"Date: Tue, 31 Aug 2021 12:00:00 +0000\r\n",
+				"Message-ID: <id@bank.com>\r\n",
+				"Content-Type: text/html; charset=UTF-8\r\n",
+				"\r\n\r\n<p>Dear Jane</p>",
+			},
+		},
+		{
+			name:  "success: html and text are alternatives",
+			email: RenderedEmail{Subject: "Your statement", HTML: "<p>Dear Jane</p>", Text: "Dear Jane"},
+			want: []string{
+				"Content-Type: multipart/alternative; boundary=",
+				"Content-Type: text/plain; charset=UTF-8\r\n",
+				"\r\n\r\nDear Jane\r\n",
+				"Content-Type: text/html; charset=UTF-8\r\n",
+				"\r\n\r\n<p>Dear Jane</p>\r\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.message(Envelope{From: Address{Email: "statements@bank.com"}}, "jane@mail.com", "id@bank.com", tt.email, tt.attachments)
+			assert.NoError(t, err)
+			for _, want := range tt.want {
+				assert.Contains(t, string(got), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package usecase
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultSourceName is the name of the source built from the directory set with WithDirPath
+const DefaultSourceName = "default"
+
+const (
+	// defaultArchiveDir and defaultQuarantineDir are the directories processed and rejected statements are
+	// moved to, inside the directory of the source unless configured otherwise
+	defaultArchiveDir    = "archive"
+	defaultQuarantineDir = "quarantine"
+	// errorSuffix is the extension of the sidecar file with the reason a statement was quarantined
+	errorSuffix = ".error"
+)
+
+// ignoredFiles are files that live next to the statements but must not be processed
+var ignoredFiles = map[string]bool{
+	".gitignore": true,
+	"readme.md":  true,
+}
+
+// dirSource is the default StatementSource, it reads the statements from a flat local directory.
+// Processed statements are moved to a date-partitioned archive and rejected ones to a quarantine directory
+type dirSource struct {
+	name          string
+	dirPath       string
+	archiveDir    string
+	quarantineDir string
+	now           func() time.Time
+}
+
+// DirSourceOption configures a directory StatementSource
+type DirSourceOption func(s *dirSource)
+
+// WithArchiveDir sets the directory processed statements are moved to, archive/ inside the source directory by default
+func WithArchiveDir(dir string) DirSourceOption {
+	return func(s *dirSource) {
+		s.archiveDir = dir
+	}
+}
+
+// WithQuarantineDir sets the directory rejected statements are moved to, quarantine/ inside the source directory by default
+func WithQuarantineDir(dir string) DirSourceOption {
+	return func(s *dirSource) {
+		s.quarantineDir = dir
+	}
+}
+
+// NewDirSource returns a StatementSource that lists the files in dirPath
+func NewDirSource(name, dirPath string, options ...DirSourceOption) StatementSource {
+	s := &dirSource{
+		name:          name,
+		dirPath:       dirPath,
+		archiveDir:    path.Join(dirPath, defaultArchiveDir),
+		quarantineDir: path.Join(dirPath, defaultQuarantineDir),
+		now:           time.Now,
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	return s
+}
+
+func (s *dirSource) Name() string {
+	return s.name
+}
+
+// List returns every regular file in the directory, skipping the files that are not statements.
+// The archive and quarantine directories are not listed, as any other subdirectory
+func (s *dirSource) List() ([]StatementRef, error) {
+	files, err := ioutil.ReadDir(s.dirPath)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]StatementRef, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || ignoredFiles[file.Name()] {
+			continue
+		}
+		refs = append(refs, StatementRef{Source: s.name, Name: file.Name()})
+	}
+	return refs, nil
+}
+
+func (s *dirSource) Open(ref StatementRef) (io.ReadCloser, error) {
+	return os.Open(path.Join(s.dirPath, ref.Name))
+}
+
+// Ack moves the statement to the archive, in a YYYY/MM directory of the date it was processed
+func (s *dirSource) Ack(ref StatementRef) error {
+	now := s.now()
+	_, err := moveFile(path.Join(s.dirPath, ref.Name), path.Join(s.archiveDir, now.Format("2006"), now.Format("01")), ref.Name)
+	return err
+}
+
+// Reject moves the statement to the quarantine directory, next to a sidecar file with the reason.
+// Moving the statement back to the source directory makes it be processed again
+func (s *dirSource) Reject(ref StatementRef, reason error) error {
+	name, err := moveFile(path.Join(s.dirPath, ref.Name), s.quarantineDir, ref.Name)
+	if err != nil {
+		return err
+	}
+	sidecar := fmt.Sprintf("%s\nrejected at %s\n", reason, s.now().Format(time.RFC3339))
+	return writeFileAtomic(path.Join(s.quarantineDir, name+errorSuffix), []byte(sidecar))
+}
+
+// moveFile moves a file to a directory without overwriting the files already there, a name taken by another
+// file gets a numeric suffix (user@mail.com-2.csv). It returns the name the file was moved with.
+// The file is hard linked to the new path before it's removed from the old one, so a crash can leave it
+// in both places but never in none
+func moveFile(src, dir, name string) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		target := name
+		if i > 1 {
+			target = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		err := linkOrCopy(src, path.Join(dir, target))
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return target, os.Remove(src)
+	}
+}
+
+// linkOrCopy hard links src to dst, copying it when they are in different file systems. It fails with
+// an error satisfying os.IsExist when dst exists
+func linkOrCopy(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+	if _, statErr := os.Lstat(dst); statErr == nil {
+		return os.ErrExist
+	}
+	data, readErr := ioutil.ReadFile(src)
+	if readErr != nil {
+		return readErr
+	}
+	return writeFileAtomic(dst, data)
+}
+
+// writeFileAtomic writes to a temporary file first and renames it, so a crash can't leave the file half written
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	// the contents must be on disk before the rename makes them visible
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,74 @@
+package usecase
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_dirSource_List(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"user@mail.com.csv", ".gitignore", "readme.md"} {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte("ID,Date,Transaction\n"), 0o600))
+	}
+	assert.NoError(t, os.Mkdir(path.Join(dir, "nested"), 0o700))
+
+	src := NewDirSource("test", dir)
+	got, err := src.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []StatementRef{{Source: "test", Name: "user@mail.com.csv"}}, got)
+
+	f, err := src.Open(got[0])
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+}
+
+func Test_dirSource_List_missingDir(t *testing.T) {
+	src := NewDirSource("test", path.Join(t.TempDir(), "missing"))
+	_, err := src.List()
+	assert.Error(t, err)
+}
+
+func Test_dirSource_Ack(t *testing.T) {
+	dir := t.TempDir()
+	src := NewDirSource("test", dir).(*dirSource)
+	src.now = func() time.Time { return time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC) }
+	ref := StatementRef{Source: "test", Name: "user@mail.com.csv"}
+
+	// the second statement with the same name must not overwrite the first one
+	for _, contents := range []string{"first", "second"} {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, ref.Name), []byte(contents), 0o600))
+		assert.NoError(t, src.Ack(ref))
+	}
+
+	for name, want := range map[string]string{"user@mail.com.csv": "first", "user@mail.com-2.csv": "second"} {
+		got, err := ioutil.ReadFile(path.Join(dir, "archive", "2026", "10", name))
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(got))
+	}
+	refs, err := src.List()
+	assert.NoError(t, err)
+	assert.Empty(t, refs)
+}
+
+func Test_dirSource_Reject(t *testing.T) {
+	dir, quarantine := t.TempDir(), t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "user@mail.com.csv"), []byte("ID,Date,Transaction\n"), 0o600))
+	src := NewDirSource("test", dir, WithQuarantineDir(quarantine)).(*dirSource)
+	src.now = func() time.Time { return time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC) }
+
+	assert.NoError(t, src.Reject(StatementRef{Source: "test", Name: "user@mail.com.csv"}, ErrUnreconciled))
+	_, err := os.Stat(path.Join(quarantine, "user@mail.com.csv"))
+	assert.NoError(t, err)
+	reason, err := ioutil.ReadFile(path.Join(quarantine, "user@mail.com.csv.error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "unreconciled statement\nrejected at 2026-10-18T00:00:00Z\n", string(reason))
+
+	got, err := src.List()
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+}
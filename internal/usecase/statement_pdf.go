@@ -0,0 +1,146 @@
+package usecase
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/hevela/statements/internal/pdf"
+)
+
+const (
+	pdfMargin = 50.0
+	// pdfLine is the height of a line of the tables
+	pdfLine = 16.0
+	// pdfBottom is where the content of a page ends, the page number goes below
+	pdfBottom = pdf.PageHeight - 70
+)
+
+// statementPDF renders the statement document: header, period, balances, monthly breakdown and every transaction.
+// It's encrypted when there's a password
+func statementPDF(data templateData, summary statementSummary, password string) ([]byte, error) {
+	doc := pdf.New(pdf.Info{
+		Title:   fmt.Sprintf("Account statement %s to %s", data.FirstMonthYear, data.LastMonthYear),
+		Subject: data.Email,
+	})
+	right := pdf.PageWidth - pdfMargin
+	doc.AddPage()
+	doc.SetFont(pdf.Bold, 18)
+	doc.Text(pdfMargin, 70, "Account statement")
+	doc.SetFont(pdf.Regular, 10)
+	y := 95.0
+	for _, line := range [][2]string{
+		{"Customer", data.Name},
+		{"Email", data.Email},
+		{"Period", data.FirstMonthYear + " to " + data.LastMonthYear},
+		{"Statement date", summary.statementDate.Format("2006-01-02")},
+	} {
+		doc.Text(pdfMargin, y, line[0]+":")
+		doc.Text(pdfMargin+100, y, line[1])
+		y += 14
+	}
+
+	y = pdfSection(doc, y+10, "Summary")
+	for _, line := range [][2]string{
+		{"Opening balance", data.PreviousBalance},
+		{"Closing balance", data.NewBalance},
+		{"Net movements", data.TotalBalance},
+		{"Lowest balance in the period", data.LowestBalance},
+		{"Average debit amount", data.AvgDebit},
+		{"Average credit amount", data.AvgCredit},
+	} {
+		doc.Text(pdfMargin, y, line[0])
+		doc.TextRight(right, y, strings.TrimSpace(line[1]+" "+data.Currency))
+		y += pdfLine
+	}
+
+	y = pdfSection(doc, y+10, "Monthly breakdown")
+	for _, month := range data.MonthSummary {
+		doc.Text(pdfMargin, y, month.Month)
+		doc.TextRight(right, y, strconv.Itoa(month.Transactions)+" transactions")
+		y += pdfLine
+	}
+	for _, cur := range data.CurrencySummary {
+		doc.Text(pdfMargin, y, fmt.Sprintf("Transactions in %s (%d, rate %s)", cur.Currency, cur.Transactions, cur.Rate))
+		doc.TextRight(right, y, cur.Total+" "+cur.Currency)
+		y += pdfLine
+	}
+
+	y = pdfSection(doc, y+10, "Transactions")
+	y = pdfTransactionsHeader(doc, y)
+	for _, t := range summary.transactions {
+		if y > pdfBottom {
+			doc.AddPage()
+			y = pdfTransactionsHeader(doc, 70)
+		}
+		doc.Text(pdfMargin, y, t.date.Format("2006-01-02"))
+		doc.Text(pdfMargin+70, y, doc.Fit(t.id, 60))
+		doc.Text(pdfMargin+140, y, doc.Fit(t.description, 170))
+		amount := t.reportedAmount.format(summary.currency)
+		if t.currency != "" && t.currency != summary.currency {
+			// foreign currency transactions show their original amount too
+			amount = fmt.Sprintf("%s %s = %s", t.amount.format(t.currency), t.currency, amount)
+		}
+		doc.TextRight(right-80, y, amount)
+		doc.TextRight(right, y, t.balance.format(summary.currency))
+		y += pdfLine
+	}
+
+	if password != "" {
+		doc.Encrypt(password, "")
+	}
+	// the page numbers are written once the number of pages is known
+	for i := 1; i <= doc.PageCount(); i++ {
+		doc.SetPage(i)
+		doc.SetFont(pdf.Regular, 8)
+		doc.TextRight(right, pdf.PageHeight-40, fmt.Sprintf("Page %d of %d", i, doc.PageCount()))
+	}
+	return doc.Output()
+}
+
+// pdfSection writes the title of a section and returns where its content starts
+func pdfSection(doc *pdf.Document, y float64, title string) float64 {
+	if y > pdfBottom-3*pdfLine {
+		doc.AddPage()
+		y = 70
+	}
+	doc.SetFont(pdf.Bold, 12)
+	doc.Text(pdfMargin, y, title)
+	doc.Line(pdfMargin, y+5, pdf.PageWidth-pdfMargin, y+5, 0.5)
+	doc.SetFont(pdf.Regular, 10)
+	return y + 20
+}
+
+// pdfTransactionsHeader writes the header of the transaction table, it's repeated on every page
+func pdfTransactionsHeader(doc *pdf.Document, y float64) float64 {
+	right := pdf.PageWidth - pdfMargin
+	doc.SetFont(pdf.Bold, 10)
+	doc.Text(pdfMargin, y, "Date")
+	doc.Text(pdfMargin+70, y, "ID")
+	doc.Text(pdfMargin+140, y, "Description")
+	doc.TextRight(right-80, y, "Amount")
+	doc.TextRight(right, y, "Balance")
+	doc.Line(pdfMargin, y+4, right, y+4, 0.25)
+	doc.SetFont(pdf.Regular, 10)
+	return y + pdfLine
+}
+
+// statementAttachment returns the name of the statement document, e.g.: statement-2021-07_2021-08.pdf, or
+// statement-2021-07.pdf for a single month
+func statementAttachment(period string) string {
+	if first, last, ok := strings.Cut(period, "/"); ok && first == last {
+		period = first
+	}
+	return "statement-" + strings.ReplaceAll(period, "/", "_") + ".pdf"
+}
+
+// writeStatementPDF keeps a copy of the statement document in dir, in a directory per recipient
+func writeStatementPDF(dir, recipient, period string, content []byte) error {
+	dir = path.Join(dir, recipient)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(dir, statementAttachment(period)), content)
+}
@@ -0,0 +1,90 @@
+package usecase
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_statementPDF(t *testing.T) {
+	summary := statementSummary{statementDate: time.Date(2021, 8, 31, 0, 0, 0, 0, time.UTC)}
+	// enough transactions to span several pages
+	for i := 0; i < 100; i++ {
+		amount, err := parseMoney(fmt.Sprintf("%d.50", i), "", RoundHalfEven)
+		assert.NoError(t, err)
+		summary.transactions = append(summary.transactions, transaction{
+			id:             fmt.Sprint(i),
+			date:           time.Date(2021, 7, 1+i%31, 0, 0, 0, 0, time.UTC),
+			amount:         amount,
+			reportedAmount: amount,
+			description:    "Payment (card)",
+			balance:        amount,
+		})
+	}
+	data := templateData{Email: "user@mail.com", Name: "User", FirstMonthYear: "July of 2021", LastMonthYear: "August of 2021"}
+
+	got, err := statementPDF(data, summary, "")
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(got, []byte("%PDF-")))
+	assert.Contains(t, string(got), "/Count 3")
+	assert.Contains(t, string(got), "/Title (Account statement July of 2021 to August of 2021)")
+}
+
+func Test_calculator_Run_statementPDF(t *testing.T) {
+	dir, pdfDir := t.TempDir(), t.TempDir()
+	mailer := &recordingMailer{}
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "user@mail.com.csv"), []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n"), 0o600))
+
+	NewCalculator(WithDirPath(dir), WithMailer(mailer), WithPDFAttachment(), WithPDFDir(pdfDir)).Run()
+
+	assert.Len(t, mailer.attachments, 1)
+	if assert.Len(t, mailer.attachments[0], 1) {
+		attachment := mailer.attachments[0][0]
+		assert.Equal(t, "statement-2021-07.pdf", attachment.Filename)
+		assert.Equal(t, "application/pdf", attachment.ContentType)
+		kept, err := ioutil.ReadFile(path.Join(pdfDir, "user@mail.com", "statement-2021-07.pdf"))
+		assert.NoError(t, err)
+		assert.Equal(t, kept, attachment.Content)
+	}
+}
+
+func Test_statementAttachment(t *testing.T) {
+	assert.Equal(t, "statement-2021-07_2021-08.pdf", statementAttachment("2021-07/2021-08"))
+	assert.Equal(t, "statement-2021-07.pdf", statementAttachment("2021-07/2021-07"))
+	assert.Equal(t, "statement-2021-08.pdf", statementAttachment("2021-08"))
+}
+
+func Test_calculator_Run_encryptedPDF(t *testing.T) {
+	customers := CustomerProfiles{"user@mail.com": {AccountNumber: "0123456789"}}
+	tests := []struct {
+		name     string
+		filename string
+		wantSent bool
+	}{
+		{name: "success: the attachment is encrypted and the email has the hint", filename: "user@mail.com.csv", wantSent: true},
+		{name: "failure: customers without a profile are not sent", filename: "other@mail.com.csv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			mailer := &recordingMailer{}
+			assert.NoError(t, ioutil.WriteFile(path.Join(dir, tt.filename), []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n"), 0o600))
+
+			NewCalculator(WithDirPath(dir), WithMailer(mailer), WithPDFAttachment(), WithCustomerProfiles(customers), WithPDFPassword(PDFPassword{Digits: 4})).Run()
+
+			if !tt.wantSent {
+				assert.Empty(t, mailer.sent)
+				return
+			}
+			if assert.Len(t, mailer.sent, 1) {
+				assert.Equal(t, "the last 4 digits of your account number", mailer.sent[0].PasswordHint)
+				assert.Contains(t, string(mailer.attachments[0][0].Content), "/Filter /Standard /V 5 /R 6")
+			}
+		})
+	}
+}
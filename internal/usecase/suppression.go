@@ -0,0 +1,218 @@
+package usecase
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// suppressionBucket is the bbolt bucket with the suppressed addresses, keyed by the lowercase address
+var suppressionBucket = []byte("suppressions")
+
+// Reasons of the suppressions, the events of the email provider that suppress an address are named the same
+const (
+	SuppressedBounce      = "bounce"
+	SuppressedSpamReport  = "spamreport"
+	SuppressedUnsubscribe = "unsubscribe"
+	SuppressedManual      = "manual"
+)
+
+// Suppression is an address that is not emailed: it bounced, reported an email as spam, unsubscribed or was
+// added by hand
+type Suppression struct {
+	Email string `json:"email"`
+	// Reason is bounce, spamreport, unsubscribe or manual
+	Reason string `json:"reason"`
+	// Detail tells more about the reason, e.g. the reply of the server that bounced the email
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s Suppression) String() string {
+	if s.Detail == "" {
+		return "recipient suppressed: " + s.Reason
+	}
+	return fmt.Sprintf("recipient suppressed: %s (%s)", s.Reason, s.Detail)
+}
+
+// SuppressedStatement is a statement that is not emailed because its recipient is suppressed
+type SuppressedStatement struct {
+	Recipient string `json:"recipient"`
+	Period    string `json:"period"`
+	Source    string `json:"source"`
+	File      string `json:"file"`
+	// Suppression is why the recipient is suppressed
+	Suppression Suppression  `json:"suppression"`
+	Data        templateData `json:"data"`
+	// Attachments are the documents of the statement, e.g. the PDF
+	Attachments []Attachment `json:"-"`
+}
+
+// Suppress adds an address to the suppression list, replacing its previous suppression
+func (l *Ledger) Suppress(email, reason, detail string) error {
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		return putSuppression(tx, Suppression{Email: email, Reason: reason, Detail: detail, CreatedAt: time.Now()})
+	})
+	if err != nil {
+		return fmt.Errorf("suppressions: %w", err)
+	}
+	return nil
+}
+
+// Unsuppress removes an address from the suppression list
+func (l *Ledger) Unsuppress(email string) error {
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		key := []byte(strings.ToLower(email))
+		if tx.Bucket(suppressionBucket).Get(key) == nil {
+			return fmt.Errorf("%s is not suppressed", email)
+		}
+		return tx.Bucket(suppressionBucket).Delete(key)
+	})
+	if err != nil {
+		return fmt.Errorf("suppressions: %w", err)
+	}
+	return nil
+}
+
+// Suppressions returns the suppression list, sorted by address
+func (l *Ledger) Suppressions() ([]Suppression, error) {
+	var suppressions []Suppression
+	err := l.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(suppressionBucket).ForEach(func(k, v []byte) error {
+			var s Suppression
+			if err := json.Unmarshal(v, &s); err != nil {
+				return fmt.Errorf("suppression %s: %w", k, err)
+			}
+			suppressions = append(suppressions, s)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("suppressions: %w", err)
+	}
+	return suppressions, nil
+}
+
+// suppression returns the suppression of an address, nil when it's not suppressed
+func (l *Ledger) suppression(email string) (*Suppression, error) {
+	var found *Suppression
+	err := l.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(suppressionBucket).Get([]byte(strings.ToLower(email)))
+		if data == nil {
+			return nil
+		}
+		found = &Suppression{}
+		return json.Unmarshal(data, found)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("suppressions: %w", err)
+	}
+	return found, nil
+}
+
+// suppressionsByEmail returns the suppression list keyed by the lowercase address
+func (l *Ledger) suppressionsByEmail() (map[string]Suppression, error) {
+	suppressions, err := l.Suppressions()
+	if err != nil {
+		return nil, err
+	}
+	byEmail := make(map[string]Suppression, len(suppressions))
+	for _, s := range suppressions {
+		byEmail[strings.ToLower(s.Email)] = s
+	}
+	return byEmail, nil
+}
+
+// skip removes the message of a suppressed recipient from the outbox and records its statement as suppressed
+// with the reason. It returns the ledger entry of the statement
+func (l *Ledger) skip(msg outboxMessage, s Suppression) (*ledgerEntry, error) {
+	var entry *ledgerEntry
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		key := []byte(msg.Key)
+		var err error
+		if entry, err = getEntry(tx, key); err != nil {
+			return err
+		}
+		entry.State, entry.Error, entry.UpdatedAt = stateSuppressed, s.String(), time.Now()
+		if err := putJSON(tx.Bucket(ledgerBucket), key, entry); err != nil {
+			return err
+		}
+		return tx.Bucket(outboxBucket).Delete(key)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	return entry, nil
+}
+
+// putSuppression saves a suppression, the address is kept as given and keyed in lowercase
+func putSuppression(tx *bbolt.Tx, s Suppression) error {
+	return putJSON(tx.Bucket(suppressionBucket), []byte(strings.ToLower(s.Email)), s)
+}
+
+// unsuppressed returns the addresses that are not suppressed
+func unsuppressed(addresses []Address, suppressions map[string]Suppression) []Address {
+	var out []Address
+	for _, a := range addresses {
+		if _, found := suppressions[strings.ToLower(a.Email)]; !found {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// dirChannel is the AlternativeChannel that writes the statements to a directory, e.g. for a print and mail
+// provider: the data of the statement as JSON and its documents, in a directory per recipient
+type dirChannel struct {
+	dir string
+}
+
+// NewDirChannel returns an AlternativeChannel that writes the statements to dir
+func NewDirChannel(dir string) AlternativeChannel {
+	return dirChannel{dir: dir}
+}
+
+func (d dirChannel) Deliver(statement SuppressedStatement) error {
+	dir := path.Join(d.dir, statement.Recipient)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(statementAttachment(statement.Period), ".pdf")
+	for _, a := range statement.Attachments {
+		if err := writeFileAtomic(path.Join(dir, a.Filename), a.Content); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(path.Join(dir, name+".json"), data)
+}
+
+// suppressionReport is the report for operations of a statement that wasn't sent to a suppressed recipient
+type suppressionReport struct {
+	SuppressedStatement
+	// Routed tells if the statement was delivered by the alternative channel, Error why it wasn't
+	Routed     bool      `json:"routed"`
+	Error      string    `json:"error,omitempty"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// writeSuppressionReport writes the report of a suppressed statement to the suppressed directory of dir
+func writeSuppressionReport(dir string, report suppressionReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	reportPath := path.Join(dir, "suppressed", report.Source, report.File+".json")
+	if err := os.MkdirAll(path.Dir(reportPath), 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(reportPath, data)
+}
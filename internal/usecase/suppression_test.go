@@ -0,0 +1,219 @@
+package usecase
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingChannel is an AlternativeChannel that keeps the statements delivered
+type recordingChannel struct {
+	delivered []SuppressedStatement
+	err       error
+}
+
+func (r *recordingChannel) Deliver(statement SuppressedStatement) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.delivered = append(r.delivered, statement)
+	return nil
+}
+
+func TestLedger_Suppress(t *testing.T) {
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+
+	assert.NoError(t, ledger.Suppress("User@Mail.com", SuppressedManual, "asked by phone"))
+	assert.NoError(t, ledger.Suppress("other@mail.com", SuppressedBounce, ""))
+	suppressions, err := ledger.Suppressions()
+	assert.NoError(t, err)
+	if assert.Len(t, suppressions, 2) {
+		assert.Equal(t, "other@mail.com", suppressions[0].Email)
+		assert.Equal(t, "User@Mail.com", suppressions[1].Email)
+		assert.Equal(t, "recipient suppressed: manual (asked by phone)", suppressions[1].String())
+	}
+
+	assert.NoError(t, ledger.Unsuppress("user@mail.com"))
+	assert.Error(t, ledger.Unsuppress("user@mail.com"))
+	byEmail, err := ledger.suppressionsByEmail()
+	assert.NoError(t, err)
+	assert.Len(t, byEmail, 1)
+	assert.Contains(t, byEmail, "other@mail.com")
+}
+
+func Test_calculator_Dispatch_suppressed(t *testing.T) {
+	reportsDir := t.TempDir()
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	envelope := testEnvelope
+	envelope.CC = []Address{{Email: "joint@mail.com"}, {Email: "bounced@mail.com"}}
+	suppressed := &ledgerEntry{Recipient: "user@mail.com", Period: "2021-07/2021-07", Hash: "abc", Source: DefaultSourceName, File: "user@mail.com.csv"}
+	pdf := Attachment{Filename: "statement-2021-07.pdf", ContentType: "application/pdf", Content: []byte("%PDF")}
+	assert.NoError(t, ledger.enqueue(suppressed, envelope, templateData{Email: "user@mail.com"}, []Attachment{pdf}))
+	other := &ledgerEntry{Recipient: "other@mail.com", Period: "2021-07/2021-07", Hash: "def", Source: DefaultSourceName, File: "other@mail.com.csv"}
+	assert.NoError(t, ledger.enqueue(other, envelope, templateData{Email: "other@mail.com"}, nil))
+	assert.NoError(t, ledger.Suppress("USER@mail.com", SuppressedSpamReport, ""))
+	assert.NoError(t, ledger.Suppress("bounced@mail.com", SuppressedBounce, "550 no such user"))
+	mailer := &recordingMailer{messageID: "abc"}
+	channel := &recordingChannel{}
+	c := NewCalculator(WithLedger(ledger), WithMailer(mailer), WithAlternativeChannel(channel), WithReportsDir(reportsDir))
+
+	c.Dispatch()
+
+	// only the statement of the other recipient is emailed, without the copy to the suppressed address
+	if assert.Len(t, mailer.envelopes, 1) {
+		assert.Equal(t, "other@mail.com", mailer.sent[0].Email)
+		assert.Equal(t, []Address{{Email: "joint@mail.com"}}, mailer.envelopes[0].CC)
+	}
+	entry := ledgerEntryByKey(t, ledger, string(suppressed.key()))
+	assert.Equal(t, stateSuppressed, entry.State)
+	assert.Equal(t, "recipient suppressed: spamreport", entry.Error)
+	messages, err := ledger.pending(time.Now().Add(maxRetryDelay))
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	if assert.Len(t, channel.delivered, 1) {
+		statement := channel.delivered[0]
+		assert.Equal(t, "user@mail.com", statement.Recipient)
+		assert.Equal(t, "2021-07/2021-07", statement.Period)
+		assert.Equal(t, SuppressedSpamReport, statement.Suppression.Reason)
+		assert.Equal(t, []Attachment{pdf}, statement.Attachments)
+	}
+	data, err := ioutil.ReadFile(path.Join(reportsDir, "suppressed", DefaultSourceName, "user@mail.com.csv.json"))
+	assert.NoError(t, err)
+	var report suppressionReport
+	assert.NoError(t, json.Unmarshal(data, &report))
+	assert.True(t, report.Routed)
+	assert.Equal(t, "user@mail.com", report.Recipient)
+}
+
+func Test_calculator_Run_suppressedStatement(t *testing.T) {
+	dir := t.TempDir()
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	assert.NoError(t, ledger.Suppress("user@mail.com", SuppressedBounce, ""))
+	mailer := &recordingMailer{messageID: "msg-1"}
+	channel := &recordingChannel{}
+	c := NewCalculator(WithDirPath(dir), WithLedger(ledger), WithMailer(mailer), WithAlternativeChannel(channel))
+	run := func() {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "user@mail.com.csv"), []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n"), 0o600))
+		c.Run()
+		c.Dispatch()
+	}
+
+	// the same statement comes back, it's not routed again while the recipient is suppressed
+	run()
+	run()
+	assert.Len(t, channel.delivered, 1)
+	assert.Empty(t, mailer.sent)
+
+	// once unsuppressed it's emailed
+	assert.NoError(t, ledger.Unsuppress("user@mail.com"))
+	run()
+	assert.Len(t, channel.delivered, 1)
+	assert.Len(t, mailer.sent, 1)
+}
+
+func Test_calculator_Run_alternativeChannelWithoutLedger(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "user@mail.com.csv"), []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n"), 0o600))
+	mailer := &recordingMailer{messageID: "msg-1"}
+	c := NewCalculator(WithDirPath(dir), WithMailer(mailer), WithAlternativeChannel(&recordingChannel{}))
+
+	c.Run()
+
+	// the suppression list can't be checked, the statement is set aside instead of emailed
+	assert.Empty(t, mailer.sent)
+	reason, err := ioutil.ReadFile(path.Join(dir, "quarantine", "user@mail.com.csv.error"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(reason), "suppression list")
+}
+
+func Test_calculator_suppress_channelFailure(t *testing.T) {
+	reportsDir := t.TempDir()
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	entry := &ledgerEntry{Recipient: "user@mail.com", Period: "2021-07/2021-07", Hash: "abc", Source: DefaultSourceName, File: "user@mail.com.csv"}
+	assert.NoError(t, ledger.enqueue(entry, testEnvelope, templateData{Email: "user@mail.com"}, nil))
+	messages, err := ledger.pending(time.Now())
+	assert.NoError(t, err)
+	c := NewCalculator(WithLedger(ledger), WithAlternativeChannel(&recordingChannel{err: errors.New("disk full")}),
+		WithReportsDir(reportsDir)).(*calculator)
+
+	c.suppress(messages[0], Suppression{Email: "user@mail.com", Reason: SuppressedUnsubscribe})
+
+	data, err := ioutil.ReadFile(path.Join(reportsDir, "suppressed", DefaultSourceName, "user@mail.com.csv.json"))
+	assert.NoError(t, err)
+	var report suppressionReport
+	assert.NoError(t, json.Unmarshal(data, &report))
+	assert.False(t, report.Routed)
+	assert.Equal(t, "disk full", report.Error)
+	assert.Equal(t, SuppressedUnsubscribe, report.Suppression.Reason)
+}
+
+func Test_dirChannel_Deliver(t *testing.T) {
+	dir := t.TempDir()
+	statement := SuppressedStatement{
+		Recipient:   "user@mail.com",
+		Period:      "2021-07/2021-07",
+		Suppression: Suppression{Email: "user@mail.com", Reason: SuppressedBounce},
+		Data:        templateData{Email: "user@mail.com", Name: "User"},
+		Attachments: []Attachment{{Filename: "statement-2021-07.pdf", Content: []byte("%PDF")}},
+	}
+
+	assert.NoError(t, NewDirChannel(dir).Deliver(statement))
+
+	pdf, err := ioutil.ReadFile(path.Join(dir, "user@mail.com", "statement-2021-07.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, "%PDF", string(pdf))
+	data, err := ioutil.ReadFile(path.Join(dir, "user@mail.com", "statement-2021-07.json"))
+	assert.NoError(t, err)
+	var got SuppressedStatement
+	assert.NoError(t, json.Unmarshal(data, &got))
+	assert.Equal(t, "User", got.Data.Name)
+	assert.Equal(t, SuppressedBounce, got.Suppression.Reason)
+}
+
+func Test_sendgridWebhook_ServeHTTP_suppressions(t *testing.T) {
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	entry := &ledgerEntry{Recipient: "user@mail.com", Period: "2021-07/2021-07", Hash: "abc"}
+	assert.NoError(t, ledger.enqueue(entry, testEnvelope, templateData{Email: "user@mail.com"}, nil))
+	assert.NoError(t, ledger.Suppress("manual@mail.com", SuppressedManual, "closed account"))
+	statement := string(entry.key())
+	privateKey, verificationKey := webhookKey(t)
+	webhook, err := NewSendGridWebhook(ledger, verificationKey)
+	assert.NoError(t, err)
+
+	events := `[
+		{"email": "user@mail.com", "timestamp": 1700000000, "event": "spamreport", "sg_event_id": "e1", "statement": "` + statement + `"},
+		{"email": "joint@mail.com", "timestamp": 1700000000, "event": "bounce", "type": "bounce", "reason": "550 no such user", "sg_event_id": "e2", "statement": "` + statement + `"},
+		{"email": "busy@mail.com", "timestamp": 1700000000, "event": "bounce", "type": "blocked", "sg_event_id": "e3", "statement": "` + statement + `"},
+		{"email": "manual@mail.com", "timestamp": 1700000000, "event": "unsubscribe", "sg_event_id": "e4", "statement": "` + statement + `"},
+		{"email": "stranger@mail.com", "timestamp": 1700000000, "event": "bounce", "sg_event_id": "e5"}
+	]`
+	w := httptest.NewRecorder()
+	webhook.ServeHTTP(w, signedRequest(t, privateKey, events))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	suppressions, err := ledger.Suppressions()
+	assert.NoError(t, err)
+	assert.Equal(t, []Suppression{
+		{Email: "joint@mail.com", Reason: SuppressedBounce, Detail: "550 no such user", CreatedAt: time.Unix(1700000000, 0).UTC()},
+		{Email: "manual@mail.com", Reason: SuppressedManual, Detail: "closed account", CreatedAt: suppressions[1].CreatedAt},
+		{Email: "user@mail.com", Reason: SuppressedSpamReport, CreatedAt: time.Unix(1700000000, 0).UTC()},
+	}, suppressions)
+}
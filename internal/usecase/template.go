@@ -0,0 +1,163 @@
+package usecase
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+)
+
+// handlebarsExpr matches the expressions of a handlebars template: {{name}}, {{#each list}}, {{/each}}, {{#if name}}
+var handlebarsExpr = regexp.MustCompile(`{{\s*([#/]?)\s*([^{}]*?)\s*}}`)
+
+// templateFuncs are the functions the handlebars expressions are converted to
+var templateFuncs = map[string]interface{}{"field": templateField, "list": templateList}
+
+// Renderer renders the subject and the HTML and plain text bodies of the emails locally, from the same handlebars
+// templates sendgrid uses (emailTemplate.html). Only the expressions the templates use are supported: {{field}},
+// {{this.field}}, {{#each list}}...{{/each}} and {{#if field}}...{{/if}}. Missing values are left empty, as sendgrid does, and the values
+// of the HTML body are escaped
+type Renderer struct {
+	subject *texttemplate.Template
+	html    *htmltemplate.Template
+	// text is nil when there's no plain text template
+	text *texttemplate.Template
+}
+
+// RenderedEmail is the subject and the bodies of an email rendered by a Renderer, Text is empty without a plain
+// text template
+type RenderedEmail struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// LoadRenderer reads the templates of the HTML and the plain text bodies, textFile is optional
+func LoadRenderer(subject, htmlFile, textFile string) (*Renderer, error) {
+	html, err := ioutil.ReadFile(htmlFile)
+	if err != nil {
+		return nil, err
+	}
+	var text []byte
+	if textFile != "" {
+		if text, err = ioutil.ReadFile(textFile); err != nil {
+			return nil, err
+		}
+	}
+	return NewRenderer(subject, string(html), string(text))
+}
+
+// NewRenderer parses the templates of the subject and the bodies of the emails, text is optional
+func NewRenderer(subject, html, text string) (*Renderer, error) {
+	if strings.TrimSpace(html) == "" {
+		return nil, errors.New("the HTML template is empty")
+	}
+	r := &Renderer{}
+	converted, err := handlebarsToGo("subject", subject)
+	if err != nil {
+		return nil, err
+	}
+	if r.subject, err = texttemplate.New("subject").Funcs(templateFuncs).Parse(converted); err != nil {
+		return nil, err
+	}
+	if converted, err = handlebarsToGo("html", html); err != nil {
+		return nil, err
+	}
+	if r.html, err = htmltemplate.New("html").Funcs(templateFuncs).Parse(converted); err != nil {
+		return nil, err
+	}
+	if text == "" {
+		return r, nil
+	}
+	if converted, err = handlebarsToGo("text", text); err != nil {
+		return nil, err
+	}
+	if r.text, err = texttemplate.New("text").Funcs(templateFuncs).Parse(converted); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Render renders the email of a statement
+func (r *Renderer) Render(data templateData) (RenderedEmail, error) {
+	// the templates refer to the fields by their JSON names, as the sendgrid dynamic template data
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return RenderedEmail{}, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(jsonData, &fields); err != nil {
+		return RenderedEmail{}, err
+	}
+	var email RenderedEmail
+	var b bytes.Buffer
+	if err := r.subject.Execute(&b, fields); err != nil {
+		return RenderedEmail{}, err
+	}
+	// a subject can't span several lines
+	email.Subject = strings.Join(strings.Fields(b.String()), " ")
+	b.Reset()
+	if err := r.html.Execute(&b, fields); err != nil {
+		return RenderedEmail{}, err
+	}
+	email.HTML = b.String()
+	if r.text != nil {
+		b.Reset()
+		if err := r.text.Execute(&b, fields); err != nil {
+			return RenderedEmail{}, err
+		}
+		email.Text = b.String()
+	}
+	return email, nil
+}
+
+// handlebarsToGo converts the handlebars expressions of a template to Go template actions
+func handlebarsToGo(name, text string) (string, error) {
+	var unsupported []string
+	converted := handlebarsExpr.ReplaceAllStringFunc(text, func(expr string) string {
+		parts := handlebarsExpr.FindStringSubmatch(expr)
+		kind, value := parts[1], parts[2]
+		switch {
+		case kind == "#" && strings.HasPrefix(value, "each "):
+			return fmt.Sprintf("{{range list . %q}}", strings.TrimSpace(strings.TrimPrefix(value, "each ")))
+		case kind == "#" && strings.HasPrefix(value, "if "):
+			return fmt.Sprintf("{{if field . %q}}", strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(value, "if ")), "this."))
+		case kind == "/" && (value == "each" || value == "if"):
+			return "{{end}}"
+		case kind == "" && value == "this":
+			return "{{.}}"
+		case kind == "" && value != "" && !strings.ContainsAny(value, " \"'"):
+			return fmt.Sprintf("{{field . %q}}", strings.TrimPrefix(value, "this."))
+		}
+		unsupported = append(unsupported, expr)
+		return expr
+	})
+	if len(unsupported) > 0 {
+		return "", fmt.Errorf("template %s: unsupported expressions %s", name, strings.Join(unsupported, ", "))
+	}
+	return converted, nil
+}
+
+// templateField returns a field of an object of the template data, an empty string if it's missing
+func templateField(dot interface{}, name string) interface{} {
+	fields, ok := dot.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	value, ok := fields[name]
+	if !ok || value == nil {
+		return ""
+	}
+	return value
+}
+
+// templateList returns a list of the template data, nil if it's missing
+func templateList(dot interface{}, name string) []interface{} {
+	list, _ := templateField(dot, name).([]interface{})
+	return list
+}
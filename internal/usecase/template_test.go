@@ -0,0 +1,132 @@
+package usecase
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// update rewrites the golden files with the current output: go test ./internal/usecase -run Golden -update
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestNewRenderer(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		html    string
+		text    string
+		data    templateData
+		want    RenderedEmail
+		wantErr bool
+	}{
+		{
+			name:    "success: fields and lists",
+			subject: "Statement of {{ first_month_year }}",
+			html:    "Dear {{name}}: {{ total_balance }}{{#each month_summary}} [{{this.month}}: {{this.transactions}}]{{/each}}",
+			text:    "{{name}} & {{total_balance}}",
+			data: templateData{
+				Name:           "Jane",
+				TotalBalance:   "34.74",
+				FirstMonthYear: "July 2021",
+				MonthSummary:   []monthOperation{{Month: "July of 2021", Transactions: 2}, {Month: "August of 2021", Transactions: 12}},
+			},
+			want: RenderedEmail{
+				Subject: "Statement of July 2021",
+				HTML:    "Dear Jane: 34.74 [July of 2021: 2] [August of 2021: 12]",
+				Text:    "Jane & 34.74",
+			},
+		},
+		{
+			name: "success: missing values are left empty",
+			html: "{{currency}}|{{#each currency_summary}}{{this.currency}}{{/each}}|{{unknown}}",
+			want: RenderedEmail{HTML: "||"},
+		},
+		{
+			name:    "success: html values are escaped, text values and subjects are not",
+			subject: "{{name}}\n",
+			html:    "<p>{{name}}</p>",
+			text:    "{{name}}",
+			data:    templateData{Name: "<b>Jane & John</b>"},
+			want:    RenderedEmail{Subject: "<b>Jane & John</b>", HTML: "<p>&lt;b&gt;Jane &amp; John&lt;/b&gt;</p>", Text: "<b>Jane & John</b>"},
+		},
+		{
+			name: "success: conditional sections",
+			html: "{{#if password_hint}}Password: {{password_hint}}{{/if}}|{{#if currency}}{{currency}}{{/if}}",
+			data: templateData{PasswordHint: "your birth date"},
+			want: RenderedEmail{HTML: "Password: your birth date|"},
+		},
+		{
+			name:    "failure: unsupported helpers",
+			html:    "{{#unless name}}Dear customer{{/unless}}",
+			wantErr: true,
+		},
+		{
+			name:    "failure: empty html template",
+			text:    "Dear {{name}}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRenderer(tt.subject, tt.html, tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRenderer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, err := r.Render(tt.data)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRenderer_RenderGolden(t *testing.T) {
+	// the templates of the repo, rendered with every field set
+	_, file, _, _ := runtime.Caller(0)
+	root := path.Join(path.Dir(file), "..", "..")
+	r, err := LoadRenderer("Your account statement for {{first_month_year}} to {{last_month_year}}",
+		path.Join(root, "emailTemplate.html"), path.Join(root, "emailTemplate.txt"))
+	assert.NoError(t, err)
+	got, err := r.Render(templateData{
+		Email:           "user@mail.com",
+		Name:            "user",
+		TotalBalance:    "39.74",
+		PreviousBalance: "100.00",
+		NewBalance:      "139.74",
+		LowestBalance:   "89.50",
+		FirstMonthYear:  "July 2021",
+		LastMonthYear:   "August 2021",
+		AvgDebit:        "-15.38",
+		AvgCredit:       "35.25",
+		MonthSummary:    []monthOperation{{Month: "July of 2021", Transactions: 2}, {Month: "August of 2021", Transactions: 2}},
+		Currency:        "MXN",
+		CurrencySummary: []currencyOperation{{Currency: "USD", Transactions: 1, Total: "10.00", Rate: "20.00"}},
+		PasswordHint:    "the last 4 digits of your account number",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Your account statement for July 2021 to August 2021", got.Subject)
+	assertGolden(t, "email.html", got.HTML)
+	assertGolden(t, "email.txt", got.Text)
+}
+
+// assertGolden compares got with testdata/<name>.golden
+func assertGolden(t *testing.T, name, got string) {
+	t.Helper()
+	golden := path.Join("testdata", name+".golden")
+	if *update {
+		assert.NoError(t, os.MkdirAll("testdata", 0o755))
+		assert.NoError(t, ioutil.WriteFile(golden, []byte(got), 0o644))
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("reading the golden file, run the tests with -update to create it: %v", err)
+	}
+	assert.Equal(t, string(want), got)
+}
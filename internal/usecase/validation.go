@@ -0,0 +1,203 @@
+package usecase
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrInvalidStatement is returned for statements rejected by the validation policy of their source
+var ErrInvalidStatement = errors.New("invalid statement")
+
+// maxReasons is the number of issues included in a validationError, the report has all of them
+const maxReasons = 5
+
+// ValidationAction tells what to do with a statement that has invalid rows
+type ValidationAction int
+
+const (
+	// RejectInvalid rejects statements with any invalid row
+	RejectInvalid ValidationAction = iota
+	// SkipInvalid leaves the invalid rows out, statements with more than MaxSkipped of them are rejected
+	SkipInvalid
+	// AcceptInvalid leaves the invalid rows out, however many there are
+	AcceptInvalid
+)
+
+var validationActions = map[string]ValidationAction{
+	"reject": RejectInvalid,
+	"skip":   SkipInvalid,
+	"accept": AcceptInvalid,
+}
+
+// ParseValidationAction returns the validation action by name: reject, skip or accept. An empty name is reject
+func ParseValidationAction(name string) (ValidationAction, error) {
+	if name == "" {
+		return RejectInvalid, nil
+	}
+	action, ok := validationActions[strings.ToLower(name)]
+	if !ok {
+		return RejectInvalid, fmt.Errorf("unknown validation action %q", name)
+	}
+	return action, nil
+}
+
+func (a ValidationAction) String() string {
+	for name, action := range validationActions {
+		if action == a {
+			return name
+		}
+	}
+	return fmt.Sprintf("ValidationAction(%d)", int(a))
+}
+
+// ValidationPolicy decides what happens to the statements of a source that have invalid rows.
+// The zero value rejects them
+type ValidationPolicy struct {
+	Action ValidationAction
+	// MaxSkipped is the number of invalid rows SkipInvalid leaves out before rejecting the statement
+	MaxSkipped int
+}
+
+// check returns why a statement with valid and invalid rows is rejected, empty if it's accepted
+func (p ValidationPolicy) check(valid, invalid int) string {
+	switch {
+	case invalid == 0:
+		return ""
+	case valid == 0:
+		return "the statement has no valid rows"
+	case p.Action == AcceptInvalid:
+		return ""
+	case p.Action == SkipInvalid && invalid <= p.MaxSkipped:
+		return ""
+	case p.Action == SkipInvalid:
+		return fmt.Sprintf("%d invalid rows, at most %d can be skipped", invalid, p.MaxSkipped)
+	}
+	return fmt.Sprintf("%d invalid rows", invalid)
+}
+
+const (
+	validationAccepted = "accepted"
+	validationRejected = "rejected"
+)
+
+// validationIssue is a problem found in a statement. Line and column are empty for problems with the whole file
+type validationIssue struct {
+	File   string `json:"file"`
+	Line   int    `json:"line,omitempty"`
+	Column string `json:"column,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// validationReport is the machine-readable outcome of validating a statement, written to the reports directory
+type validationReport struct {
+	Source     string            `json:"source"`
+	File       string            `json:"file"`
+	Policy     string            `json:"policy"`
+	MaxSkipped int               `json:"max_skipped,omitempty"`
+	Status     string            `json:"status"`
+	Reason     string            `json:"reason,omitempty"`
+	ValidRows  int               `json:"valid_rows"`
+	Skipped    int               `json:"skipped_rows"`
+	Issues     []validationIssue `json:"issues"`
+	CheckedAt  time.Time         `json:"checked_at"`
+}
+
+// newValidationReport applies a policy to the invalid rows of a parsed statement. parseErr is the error that
+// stopped the parsing, if any, statements that can't be parsed are always rejected
+func newValidationReport(ref StatementRef, policy ValidationPolicy, summary statementSummary, parseErr error) validationReport {
+	report := validationReport{
+		Source:    ref.Source,
+		File:      ref.Name,
+		Policy:    policy.Action.String(),
+		Status:    validationAccepted,
+		ValidRows: len(summary.transactions),
+		Issues:    []validationIssue{},
+	}
+	if policy.Action == SkipInvalid {
+		report.MaxSkipped = policy.MaxSkipped
+	}
+	if parseErr != nil {
+		report.Status = validationRejected
+		report.Reason = "the statement can't be parsed"
+		report.ValidRows = 0
+		report.Issues = append(report.Issues, fileIssue(ref.Name, parseErr))
+		return report
+	}
+	for _, e := range summary.issues {
+		report.Issues = append(report.Issues, validationIssue{File: ref.Name, Line: e.line, Column: e.column, Reason: e.reason})
+	}
+	if report.Reason = policy.check(report.ValidRows, len(summary.issues)); report.Reason != "" {
+		report.Status = validationRejected
+		return report
+	}
+	report.Skipped = len(summary.issues)
+	return report
+}
+
+// fileIssue is the issue of an error that stopped the parsing of a statement, with its line when the format tells it
+func fileIssue(file string, err error) validationIssue {
+	issue := validationIssue{File: file, Reason: err.Error()}
+	var (
+		parseErr *csv.ParseError
+		mt940Err *mt940Error
+	)
+	switch {
+	case errors.As(err, &parseErr):
+		issue.Line = parseErr.StartLine
+		issue.Reason = parseErr.Err.Error()
+	case errors.As(err, &mt940Err):
+		issue.Line, issue.Column = mt940Err.line, mt940Err.tag
+		issue.Reason = mt940Err.reason
+	}
+	return issue
+}
+
+// writeValidationReport writes the report to dir/<source>/<file>.json, replacing the report of a previous run
+func writeValidationReport(dir string, report validationReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	reportPath := path.Join(dir, report.Source, report.File+".json")
+	if err := os.MkdirAll(path.Dir(reportPath), 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(reportPath, data)
+}
+
+// validationError is returned for statements rejected by the validation policy, with their first issues
+type validationError struct {
+	report validationReport
+}
+
+func (e *validationError) Error() string {
+	reasons := make([]string, 0, maxReasons+1)
+	for i, issue := range e.report.Issues {
+		if i == maxReasons {
+			reasons = append(reasons, fmt.Sprintf("and %d more", len(e.report.Issues)-maxReasons))
+			break
+		}
+		reasons = append(reasons, issue.String())
+	}
+	return fmt.Sprintf("%s: %s: %s", ErrInvalidStatement, e.report.Reason, strings.Join(reasons, "; "))
+}
+
+func (e *validationError) Is(target error) bool {
+	return target == ErrInvalidStatement
+}
+
+func (i validationIssue) String() string {
+	switch {
+	case i.Line == 0:
+		return i.Reason
+	case i.Column == "":
+		return fmt.Sprintf("line %d: %s", i.Line, i.Reason)
+	}
+	return fmt.Sprintf("line %d: %s: %s", i.Line, i.Column, i.Reason)
+}
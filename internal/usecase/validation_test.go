@@ -0,0 +1,116 @@
+package usecase
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newValidationReport(t *testing.T) {
+	const contents = "ID,Date,Transaction\n0,2021-07-15,+60.5\n1,2021-07-28,abc\n2,2021-08-02,-20.5\n3,2021-08-13\n"
+	ref := StatementRef{Source: "bank", Name: "user@mail.com.csv"}
+	issues := []validationIssue{
+		{File: "user@mail.com.csv", Line: 3, Column: "Transaction", Reason: `invalid amount "abc"`},
+		{File: "user@mail.com.csv", Line: 5, Column: "Transaction", Reason: "missing column"},
+	}
+	tests := []struct {
+		name       string
+		policy     ValidationPolicy
+		contents   string
+		wantStatus string
+		wantReason string
+		wantIssues []validationIssue
+	}{
+		{
+			name:       "must reject statements with invalid rows by default",
+			contents:   contents,
+			wantStatus: validationRejected,
+			wantReason: "2 invalid rows",
+			wantIssues: issues,
+		},
+		{
+			name:       "must skip invalid rows up to the threshold",
+			policy:     ValidationPolicy{Action: SkipInvalid, MaxSkipped: 2},
+			contents:   contents,
+			wantStatus: validationAccepted,
+			wantIssues: issues,
+		},
+		{
+			name:       "must reject statements with more invalid rows than the threshold",
+			policy:     ValidationPolicy{Action: SkipInvalid, MaxSkipped: 1},
+			contents:   contents,
+			wantStatus: validationRejected,
+			wantReason: "2 invalid rows, at most 1 can be skipped",
+			wantIssues: issues,
+		},
+		{
+			name:       "must accept statements with any number of invalid rows",
+			policy:     ValidationPolicy{Action: AcceptInvalid},
+			contents:   contents,
+			wantStatus: validationAccepted,
+			wantIssues: issues,
+		},
+		{
+			name:       "must reject statements without valid rows whatever the policy",
+			policy:     ValidationPolicy{Action: AcceptInvalid},
+			contents:   "ID,Date,Transaction\n1,2021-07-28,abc\n",
+			wantStatus: validationRejected,
+			wantReason: "the statement has no valid rows",
+			wantIssues: []validationIssue{
+				{File: "user@mail.com.csv", Line: 2, Column: "Transaction", Reason: `invalid amount "abc"`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summary, err := processStatement(ref.Name, strings.NewReader(tt.contents), parseConfig{})
+			assert.NoError(t, err)
+			got := newValidationReport(ref, tt.policy, summary, nil)
+			assert.Equal(t, tt.wantStatus, got.Status)
+			assert.Equal(t, tt.wantReason, got.Reason)
+			assert.Equal(t, tt.wantIssues, got.Issues)
+		})
+	}
+}
+
+func Test_newValidationReport_parseError(t *testing.T) {
+	ref := StatementRef{Source: "bank", Name: "user@mail.com.sta"}
+	_, err := processStatement(ref.Name, strings.NewReader(":20:STMT\n:60F:X210701EUR100,00\n"), parseConfig{})
+	got := newValidationReport(ref, ValidationPolicy{Action: AcceptInvalid}, statementSummary{}, err)
+	assert.Equal(t, validationRejected, got.Status)
+	assert.Equal(t, []validationIssue{
+		{File: "user@mail.com.sta", Line: 2, Column: "60F", Reason: `malformed balance "X210701EUR100,00"`},
+	}, got.Issues)
+
+	verr := &validationError{report: got}
+	assert.True(t, errors.Is(verr, ErrInvalidStatement))
+	assert.EqualError(t, verr, `invalid statement: the statement can't be parsed: line 2: 60F: malformed balance "X210701EUR100,00"`)
+}
+
+func Test_calculator_runStatement_invalidRows(t *testing.T) {
+	dir, reports := t.TempDir(), t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "user@mail.com.csv"), []byte("ID,Date,Transaction\n0,2021-07-15,+60.5\n1,2021-07-28,abc\n"), 0o600))
+	mailer := &recordingMailer{}
+
+	c := NewCalculator(WithDirPath(dir), WithReportsDir(reports), WithMailer(mailer))
+	c.Run()
+
+	assert.Empty(t, mailer.sent, "an invalid statement must not be mailed")
+
+	rejected, err := ioutil.ReadFile(path.Join(dir, "quarantine", "user@mail.com.csv.error"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(rejected), "invalid statement: 1 invalid rows: line 3: Transaction: invalid amount \"abc\"\n"))
+	data, err := ioutil.ReadFile(path.Join(reports, DefaultSourceName, "user@mail.com.csv.json"))
+	assert.NoError(t, err)
+	var report validationReport
+	assert.NoError(t, json.Unmarshal(data, &report))
+	assert.Equal(t, validationRejected, report.Status)
+	assert.Equal(t, "reject", report.Policy)
+	assert.Equal(t, 1, report.ValidRows)
+	assert.Len(t, report.Issues, 1)
+}
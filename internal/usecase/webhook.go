@@ -0,0 +1,186 @@
+package usecase
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// statementArg is the custom argument of the sendgrid emails with the key of their statement, the events of
+	// the emails come back with it
+	statementArg = "statement"
+	// signatureHeader and timestampHeader sign the requests of the sendgrid Event Webhook
+	signatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	timestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+	// maxWebhookBody bounds the size of a request of events
+	maxWebhookBody = 5 << 20
+	// maxWebhookSkew is how far the signed timestamp of a request can be from now, older requests are rejected so
+	// they can't be replayed
+	maxWebhookSkew = 5 * time.Minute
+)
+
+// sendgridWebhook is the handler of the sendgrid Event Webhook, it records the delivery status of the statements
+type sendgridWebhook struct {
+	ledger    *Ledger
+	publicKey *ecdsa.PublicKey
+}
+
+// NewSendGridWebhook returns the handler of the sendgrid Event Webhook. Requests without a valid signature of the
+// verification key of the webhook (the base64 of its DER public key) are rejected. Events are correlated with the
+// statements by their statement custom argument
+func NewSendGridWebhook(ledger *Ledger, verificationKey string) (http.Handler, error) {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(verificationKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook verification key: %w", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook verification key: %w", err)
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("invalid webhook verification key: not an ECDSA key")
+	}
+	return &sendgridWebhook{ledger: ledger, publicKey: publicKey}, nil
+}
+
+// sendgridEvent is an event of the Event Webhook, the custom arguments come with the other fields
+type sendgridEvent struct {
+	Email     string `json:"email"`
+	Timestamp int64  `json:"timestamp"`
+	Event     string `json:"event"`
+	EventID   string `json:"sg_event_id"`
+	MessageID string `json:"sg_message_id"`
+	Reason    string `json:"reason"`
+	Response  string `json:"response"`
+	// Type tells a bounce from a block, a temporary rejection of the receiving server
+	Type      string `json:"type"`
+	Statement string `json:"statement"`
+}
+
+// suppression returns the reason to suppress the address of an event, empty for events that don't suppress it
+func (e sendgridEvent) suppression() string {
+	switch e.Event {
+	case "bounce":
+		if e.Type == "blocked" {
+			return ""
+		}
+		return SuppressedBounce
+	case "spamreport":
+		return SuppressedSpamReport
+	case "unsubscribe", "group_unsubscribe":
+		return SuppressedUnsubscribe
+	}
+	return ""
+}
+
+func (h *sendgridWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "reading the events", http.StatusBadRequest)
+		return
+	}
+	if !h.verify(r.Header.Get(timestampHeader), r.Header.Get(signatureHeader), body) {
+		logrus.Warnf("webhook: rejected events from %s with an invalid or stale signature", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	var events []sendgridEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		http.Error(w, "invalid events", http.StatusBadRequest)
+		return
+	}
+	statementEvents := make([]statementEvent, 0, len(events))
+	for _, e := range events {
+		reason := e.Reason
+		if reason == "" {
+			reason = e.Response
+		}
+		statementEvents = append(statementEvents, statementEvent{
+			Statement: e.Statement,
+			Recipient: e.Email,
+			Suppress:  e.suppression(),
+			DeliveryEvent: DeliveryEvent{
+				Event:     e.Event,
+				Timestamp: time.Unix(e.Timestamp, 0).UTC(),
+				Reason:    reason,
+				MessageID: e.MessageID,
+				ID:        e.EventID,
+			},
+		})
+	}
+	recorded, ignored, err := h.ledger.recordEvents(statementEvents)
+	if err != nil {
+		// sendgrid sends the events again
+		logrus.Errorf("webhook: %v", err)
+		http.Error(w, "recording the events", http.StatusInternalServerError)
+		return
+	}
+	logrus.Debugf("webhook: %d events recorded, %d of unknown statements ignored", recorded, ignored)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verify checks the signature of the timestamp and the body of a request, and that the timestamp is within
+// maxWebhookSkew of now
+func (h *sendgridWebhook) verify(timestamp, signature string, body []byte) bool {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > maxWebhookSkew || skew < -maxWebhookSkew {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	return ecdsa.VerifyASN1(h.publicKey, digest[:], sig)
+}
+
+// NewDeliveryStatusHandler returns the handler that answers if a customer got their statements, GET ?email=
+// returns the statements of the email with their delivery status as JSON
+func NewDeliveryStatusHandler(ledger *Ledger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		email := r.URL.Query().Get("email")
+		if email == "" {
+			http.Error(w, "the email parameter is required", http.StatusBadRequest)
+			return
+		}
+		deliveries, err := ledger.Deliveries(email)
+		if err != nil {
+			logrus.Error(err)
+			http.Error(w, "reading the deliveries", http.StatusInternalServerError)
+			return
+		}
+		if deliveries == nil {
+			deliveries = []StatementDelivery{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(deliveries); err != nil {
+			logrus.Error(err)
+		}
+	})
+}
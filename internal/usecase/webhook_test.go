@@ -0,0 +1,215 @@
+package usecase
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// webhookKey returns a key pair like the one of the sendgrid Event Webhook, with the base64 verification key
+func webhookKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	return key, base64.StdEncoding.EncodeToString(der)
+}
+
+// signedRequest returns a request of the webhook signed as sendgrid does
+func signedRequest(t *testing.T, key *ecdsa.PrivateKey, body string) *http.Request {
+	return signedRequestAt(t, key, body, time.Now())
+}
+
+// signedRequestAt signs a request of the Event Webhook as sent at a time
+func signedRequestAt(t *testing.T, key *ecdsa.PrivateKey, body string, at time.Time) *http.Request {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	digest := sha256.Sum256([]byte(timestamp + body))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	assert.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/sendgrid/events", strings.NewReader(body))
+	r.Header.Set(timestampHeader, timestamp)
+	r.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(sig))
+	return r
+}
+
+func TestNewSendGridWebhook(t *testing.T) {
+	_, err := NewSendGridWebhook(nil, "not base64!")
+	assert.Error(t, err)
+	_, err = NewSendGridWebhook(nil, base64.StdEncoding.EncodeToString([]byte("not a key")))
+	assert.Error(t, err)
+	_, key := webhookKey(t)
+	_, err = NewSendGridWebhook(nil, key)
+	assert.NoError(t, err)
+}
+
+func Test_sendgridWebhook_ServeHTTP(t *testing.T) {
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	entry := &ledgerEntry{Recipient: "user@mail.com", Period: "2021-07/2021-07", Hash: "abc", File: "user@mail.com.csv"}
+	assert.NoError(t, ledger.enqueue(entry, testEnvelope, templateData{Email: "user@mail.com"}, nil))
+	messages, err := ledger.pending(time.Now())
+	assert.NoError(t, err)
+	_, err = ledger.delivered(messages[0], "msg-1")
+	assert.NoError(t, err)
+	statement := string(entry.key())
+	privateKey, verificationKey := webhookKey(t)
+	webhook, err := NewSendGridWebhook(ledger, verificationKey)
+	assert.NoError(t, err)
+
+	events := `[
+		{"email": "user@mail.com", "timestamp": 1700000010, "event": "delivered", "sg_event_id": "e2", "sg_message_id": "msg-1.filter", "response": "250 OK", "statement": "` + statement + `"},
+		{"email": "user@mail.com", "timestamp": 1700000000, "event": "processed", "sg_event_id": "e1", "sg_message_id": "msg-1.filter", "statement": "` + statement + `"},
+		{"email": "joint@mail.com", "timestamp": 1700000000, "event": "bounce", "sg_event_id": "e3", "statement": "` + statement + `"},
+		{"email": "other@mail.com", "timestamp": 1700000000, "event": "delivered", "sg_event_id": "e4"}
+	]`
+	w := httptest.NewRecorder()
+	webhook.ServeHTTP(w, signedRequest(t, privateKey, events))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	// sendgrid sends the events again when it doesn't get an answer
+	w = httptest.NewRecorder()
+	webhook.ServeHTTP(w, signedRequest(t, privateKey, events))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	deliveries, err := ledger.Deliveries("User@Mail.com")
+	assert.NoError(t, err)
+	if assert.Len(t, deliveries, 1) && assert.NotNil(t, deliveries[0].Delivery) {
+		assert.Equal(t, "sent", deliveries[0].State)
+		assert.Equal(t, "msg-1", deliveries[0].MessageID)
+		delivery := deliveries[0].Delivery
+		assert.Equal(t, "delivered", delivery.Status)
+		assert.Equal(t, "250 OK", delivery.Reason)
+		assert.True(t, delivery.Delivered)
+		assert.Equal(t, []DeliveryEvent{
+			{Event: "processed", Timestamp: time.Unix(1700000000, 0).UTC(), MessageID: "msg-1.filter", ID: "e1"},
+			{Event: "delivered", Timestamp: time.Unix(1700000010, 0).UTC(), Reason: "250 OK", MessageID: "msg-1.filter", ID: "e2"},
+		}, delivery.Events)
+	}
+}
+
+func Test_sendgridWebhook_ServeHTTP_rejected(t *testing.T) {
+	privateKey, verificationKey := webhookKey(t)
+	otherKey, _ := webhookKey(t)
+	webhook, err := NewSendGridWebhook(nil, verificationKey)
+	assert.NoError(t, err)
+	tampered := signedRequest(t, privateKey, `[{"event": "delivered"}]`)
+	tampered.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[{"event": "bounce"}]`)).Body
+	unsigned := signedRequest(t, privateKey, `[]`)
+	unsigned.Header.Del(signatureHeader)
+	noTimestamp := signedRequest(t, privateKey, `[]`)
+	noTimestamp.Header.Del(timestampHeader)
+	tests := []struct {
+		name    string
+		request *http.Request
+		want    int
+	}{
+		{name: "tampered body", request: tampered, want: http.StatusForbidden},
+		{name: "another key", request: signedRequest(t, otherKey, `[]`), want: http.StatusForbidden},
+		{name: "unsigned", request: unsigned, want: http.StatusForbidden},
+		{name: "no timestamp", request: noTimestamp, want: http.StatusForbidden},
+		{name: "stale timestamp", request: signedRequestAt(t, privateKey, `[]`, time.Now().Add(-maxWebhookSkew-time.Minute)), want: http.StatusForbidden},
+		{name: "future timestamp", request: signedRequestAt(t, privateKey, `[]`, time.Now().Add(maxWebhookSkew+time.Minute)), want: http.StatusForbidden},
+		{name: "invalid events", request: signedRequest(t, privateKey, `{"event": "delivered"}`), want: http.StatusBadRequest},
+		{name: "GET", request: httptest.NewRequest(http.MethodGet, "/sendgrid/events", nil), want: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			webhook.ServeHTTP(w, tt.request)
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
+
+func TestDeliveryStatus_add(t *testing.T) {
+	at := func(seconds int64) time.Time { return time.Unix(1700000000+seconds, 0) }
+	tests := []struct {
+		name          string
+		events        []DeliveryEvent
+		wantStatus    string
+		wantDelivered bool
+	}{
+		{
+			name:       "deferred",
+			events:     []DeliveryEvent{{Event: "processed", Timestamp: at(0)}, {Event: "deferred", Timestamp: at(1), Reason: "try later"}},
+			wantStatus: "deferred",
+		},
+		{
+			name:          "a late processed doesn't hide the delivery",
+			events:        []DeliveryEvent{{Event: "delivered", Timestamp: at(1)}, {Event: "processed", Timestamp: at(0)}},
+			wantStatus:    "delivered",
+			wantDelivered: true,
+		},
+		{
+			name:       "bounced",
+			events:     []DeliveryEvent{{Event: "deferred", Timestamp: at(0)}, {Event: "bounce", Timestamp: at(1), Reason: "550 no such user"}},
+			wantStatus: "bounce",
+		},
+		{
+			name:          "opened",
+			events:        []DeliveryEvent{{Event: "delivered", Timestamp: at(0)}, {Event: "open", Timestamp: at(5)}, {Event: "group_resubscribe", Timestamp: at(6)}},
+			wantStatus:    "open",
+			wantDelivered: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status DeliveryStatus
+			for _, e := range tt.events {
+				assert.True(t, status.add(e))
+			}
+			assert.Equal(t, tt.wantStatus, status.Status)
+			assert.Equal(t, tt.wantDelivered, status.Delivered)
+		})
+	}
+
+	var status DeliveryStatus
+	for i := 0; i < maxDeliveryEvents+5; i++ {
+		status.add(DeliveryEvent{Event: "open", Timestamp: at(int64(i))})
+	}
+	assert.Len(t, status.Events, maxDeliveryEvents)
+	assert.Equal(t, at(5), status.Events[0].Timestamp)
+}
+
+func TestNewDeliveryStatusHandler(t *testing.T) {
+	ledger, err := OpenLedger(path.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer ledger.Close()
+	for _, period := range []string{"2021-06/2021-06", "2021-07/2021-07"} {
+		entry := &ledgerEntry{Recipient: "user@mail.com", Period: period, Hash: "abc"}
+		assert.NoError(t, ledger.record(entry, stateFailed, ErrNoPDFPassword))
+	}
+	handler := NewDeliveryStatusHandler(ledger)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deliveries?email=user@mail.com", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var deliveries []StatementDelivery
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &deliveries))
+	if assert.Len(t, deliveries, 2) {
+		assert.Equal(t, "2021-07/2021-07", deliveries[0].Period)
+		assert.Equal(t, "failed", deliveries[0].State)
+		assert.Equal(t, ErrNoPDFPassword.Error(), deliveries[0].Error)
+		assert.Nil(t, deliveries[0].Delivery)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deliveries?email=nobody@mail.com", nil))
+	assert.JSONEq(t, "[]", w.Body.String())
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deliveries", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}